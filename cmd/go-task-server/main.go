@@ -18,9 +18,13 @@ import (
 	"os"
 
 	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
 )
 
 func main() {
+	// a run with rlimits starts here
+	task.Init()
+
 	if len(os.Args) == 1 {
 		fmt.Fprintf(os.Stderr, "Missing path to configuration file\n")
 		os.Exit(-1)
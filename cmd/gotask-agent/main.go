@@ -0,0 +1,59 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/nbena/gotask/pkg/agent"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+func main() {
+	// a run with rlimits starts here
+	task.Init()
+
+	if len(os.Args) == 1 {
+		fmt.Fprintf(os.Stderr, "Missing path to configuration file\n")
+		os.Exit(-1)
+	}
+
+	config, err := agent.ReadConfig(os.Args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error in config: %s\n", err.Error())
+		os.Exit(-2)
+	}
+
+	worker, err := agent.New(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error in start agent: %s\n", err.Error())
+		os.Exit(-2)
+	}
+
+	// the running jobs are completed
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		worker.Stop()
+	}()
+
+	if err = worker.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error in run agent: %s\n", err.Error())
+		os.Exit(-2)
+	}
+}
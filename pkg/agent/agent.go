@@ -0,0 +1,416 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/nbena/gotask/pkg/client"
+	"github.com/nbena/gotask/pkg/req"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+const (
+	// DefaultStreamInterval is the default time between
+	// two sends of the output of a job.
+	DefaultStreamInterval = task.Duration(time.Second)
+
+	// retryInterval is the time waited after
+	// an error talking to the server.
+	retryInterval = 5 * time.Second
+	// chunkSize is the most output sent at once.
+	chunkSize = 512 * 1024
+)
+
+// streams are the logs of a run that may be written.
+var streams = []string{task.StreamStdout, task.StreamStderr, task.StreamMerged}
+
+// Config is the configuration used by the agent.
+type Config struct {
+	ServerAddr string `json:"serverAddr"`
+	ServerPort int    `json:"serverPort"`
+	// the agent token of the server
+	Token string `json:"token"`
+
+	Name string `json:"name"`
+	// matched against the Labels of the tasks
+	Labels map[string]string `json:"labels"`
+	// the most jobs run at the same time, if 0 1
+	Capacity int `json:"capacity"`
+
+	// where the output of the jobs is kept while it's
+	// sent, if empty a temporary directory is used
+	WorkDir string `json:"workDir"`
+	// how often the output is sent, if 0
+	// DefaultStreamInterval is used
+	StreamInterval task.Duration `json:"streamInterval"`
+}
+
+// ReadConfig tries to read config from a json file.
+func ReadConfig(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	var config Config
+	if err = decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// Agent takes the jobs matching its labels from
+// the server and runs them.
+type Agent struct {
+	config *Config
+	client *client.TaskClient
+
+	workDir        string
+	streamInterval time.Duration
+
+	// given by the server, under mutex
+	id        string
+	heartbeat time.Duration
+	// the running jobs, by ID
+	running map[string]*task.RuntimeTaskInfo
+	mutex   *sync.Mutex
+
+	// a token for each running job
+	slots chan struct{}
+	// closed by Stop
+	stop     chan struct{}
+	stopOnce *sync.Once
+	jobs     *sync.WaitGroup
+}
+
+// New returns an agent, not yet registered.
+func New(config *Config) (*Agent, error) {
+	a := &Agent{
+		config: config,
+		client: client.NewTaskClient(&client.Config{
+			ServerAddr: config.ServerAddr,
+			ServerPort: config.ServerPort,
+			Token:      config.Token,
+		}),
+		workDir:        config.WorkDir,
+		streamInterval: time.Duration(config.StreamInterval),
+		running:        make(map[string]*task.RuntimeTaskInfo),
+		mutex:          &sync.Mutex{},
+		stop:           make(chan struct{}),
+		stopOnce:       &sync.Once{},
+		jobs:           &sync.WaitGroup{},
+	}
+
+	if config.Capacity <= 0 {
+		a.slots = make(chan struct{}, 1)
+	} else {
+		a.slots = make(chan struct{}, config.Capacity)
+	}
+	if a.streamInterval == 0 {
+		a.streamInterval = time.Duration(DefaultStreamInterval)
+	}
+
+	var err error
+	if a.workDir == "" {
+		a.workDir, err = ioutil.TempDir("", "gotask-agent")
+	} else {
+		err = os.MkdirAll(a.workDir, 0700)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Run registers the agent and runs the jobs given by the server,
+// it returns after Stop, once the running jobs are reported.
+func (a *Agent) Run() error {
+	if err := a.register(); err != nil {
+		return err
+	}
+	go a.heartbeats()
+
+	for {
+		// wait for room before asking
+		select {
+		case <-a.stop:
+			a.jobs.Wait()
+			return nil
+		case a.slots <- struct{}{}:
+		}
+
+		job, err := a.client.NextJob(a.agentID())
+		if err == client.ErrAgentUnknown {
+			// declared dead, its jobs have gone to others
+			log.Printf("Agent unknown to the server, registering again\n")
+			err = a.register()
+		}
+		if err != nil || job == nil {
+			<-a.slots
+			if err != nil {
+				log.Printf("Error in getting jobs: %s\n", err.Error())
+				a.wait(retryInterval)
+			}
+			continue
+		}
+
+		a.jobs.Add(1)
+		go func() {
+			defer a.jobs.Done()
+			a.run(job)
+			<-a.slots
+		}()
+	}
+}
+
+// Stop stops taking jobs, the running
+// ones are completed.
+func (a *Agent) Stop() {
+	a.stopOnce.Do(func() {
+		close(a.stop)
+	})
+}
+
+// wait waits for d or for Stop.
+func (a *Agent) wait(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-a.stop:
+	}
+}
+
+func (a *Agent) agentID() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.id
+}
+
+// register joins the server, getting a new ID.
+func (a *Agent) register() error {
+	resp, err := a.client.RegisterAgent(req.RegisterAgentRequest{
+		Name:     a.config.Name,
+		Labels:   a.config.Labels,
+		Capacity: cap(a.slots),
+	})
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.id = resp.ID
+	a.heartbeat = time.Duration(resp.HeartbeatInterval)
+	return nil
+}
+
+// heartbeats tells the server the agent is alive
+// till Stop, killing the jobs it asks to.
+func (a *Agent) heartbeats() {
+	for {
+		a.mutex.Lock()
+		interval := a.heartbeat
+		a.mutex.Unlock()
+
+		select {
+		case <-time.After(interval):
+		case <-a.stop:
+			return
+		}
+
+		resp, err := a.client.Heartbeat(a.agentID())
+		if err != nil {
+			log.Printf("Error in heartbeat: %s\n", err.Error())
+			continue
+		}
+		for id, reason := range resp.Kill {
+			a.mutex.Lock()
+			runtimeTask := a.running[id]
+			a.mutex.Unlock()
+			if runtimeTask == nil {
+				continue
+			}
+			if err = runtimeTask.Kill(reason); err != nil {
+				log.Printf("Error in kill %s: %s\n", id, err.Error())
+			}
+		}
+	}
+}
+
+// run runs job, its output is sent while it's
+// running and its result at the end.
+func (a *Agent) run(job *req.AgentJob) {
+	agentID := a.agentID()
+	result := &req.AgentResult{}
+
+	runtimeTask, err := job.Task.RunWith(&task.RunOptions{
+		ID:        job.ID,
+		Params:    job.Params,
+		MaxOutput: job.MaxOutput,
+		LogDir:    a.workDir,
+		Attempt:   job.Attempt,
+		Input:     job.Input,
+		Vars:      job.Vars,
+	})
+	if err != nil {
+		result.Error = fmt.Sprintf("Running error: %s", err.Error())
+		result.Failed = true
+	} else {
+		a.mutex.Lock()
+		a.running[job.ID] = runtimeTask
+		a.mutex.Unlock()
+
+		done := make(chan *task.CmdDoneChan)
+		errChan := make(chan *task.CmdDoneChan)
+		runtimeTask.WaitPoll(job.ID, done, errChan)
+
+		offsets := make(map[string]int64)
+		var res *task.CmdDoneChan
+		for res == nil {
+			select {
+			case res = <-done:
+			case res = <-errChan:
+				result.Failed = true
+			case <-time.After(a.streamInterval):
+				a.sendOutput(agentID, job, offsets)
+			}
+		}
+
+		a.mutex.Lock()
+		delete(a.running, job.ID)
+		a.mutex.Unlock()
+		// before the directory of the run is removed
+		if err = a.sendArtifacts(agentID, job, runtimeTask); err != nil {
+			res.Error += fmt.Sprintf("Fail to send the artifacts: %s\n", err.Error())
+			result.Failed = true
+		}
+		if err = runtimeTask.Cleanup(result.Failed); err != nil {
+			log.Printf("Error in cleanup of %s: %s\n", job.ID, err.Error())
+		}
+
+		// the logs are complete now
+		a.sendOutput(agentID, job, offsets)
+		result.Output = res.Output
+		result.Error = res.Error
+		result.Skipped = res.Skipped
+		result.Run = res.Result
+		result.Truncated = res.Truncated
+		result.Structured = res.Structured
+	}
+
+	a.sendResult(agentID, job, result)
+	for _, stream := range streams {
+		os.Remove(a.logPath(job, stream))
+	}
+}
+
+// sendResult sends the result of job till it's taken: the
+// server waits for it as long as the agent is alive. It gives
+// up if the job is not the agent's anymore, or after Stop.
+func (a *Agent) sendResult(agentID string, job *req.AgentJob, result *req.AgentResult) {
+	for {
+		err := a.client.SendResult(agentID, job.ID, result)
+		if err == nil {
+			return
+		}
+		if err == client.ErrAgentUnknown {
+			log.Printf("Result of %s not taken, the job is not the agent's\n", job.ID)
+			return
+		}
+		log.Printf("Error in sending the result of %s: %s\n", job.ID, err.Error())
+
+		select {
+		case <-time.After(retryInterval):
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// sendArtifacts sends the artifacts of the ended run of job,
+// they're copied first, as the server would do.
+func (a *Agent) sendArtifacts(agentID string, job *req.AgentJob,
+	runtimeTask *task.RuntimeTaskInfo) error {
+
+	if len(job.Task.Artifacts) == 0 {
+		return nil
+	}
+	dir, err := ioutil.TempDir(a.workDir, job.ID+"-artifacts")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// the server checks the size
+	artifacts, err := runtimeTask.CollectArtifacts(dir, 0)
+	if err != nil {
+		return err
+	}
+	for _, artifact := range artifacts {
+		file, err := os.Open(path.Join(dir, artifact.Name))
+		if err != nil {
+			return err
+		}
+		err = a.client.SendArtifact(agentID, job.ID, artifact.Name, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Agent) logPath(job *req.AgentJob, stream string) string {
+	return task.LogPath(a.workDir, task.AttemptID(job.ID, job.Attempt), stream)
+}
+
+// sendOutput sends the logs of job written since offsets.
+func (a *Agent) sendOutput(agentID string, job *req.AgentJob, offsets map[string]int64) {
+	for _, stream := range streams {
+		file, err := os.Open(a.logPath(job, stream))
+		if err != nil {
+			continue
+		}
+		if _, err = file.Seek(offsets[stream], io.SeekStart); err == nil {
+			buffer := make([]byte, chunkSize)
+			for {
+				n, readErr := io.ReadFull(file, buffer)
+				if n > 0 {
+					if err = a.client.SendOutput(agentID, job.ID, stream, buffer[:n]); err != nil {
+						break
+					}
+					offsets[stream] += int64(n)
+				}
+				if readErr != nil {
+					break
+				}
+			}
+		}
+		file.Close()
+		if err != nil {
+			log.Printf("Error in sending the output of %s: %s\n", job.ID, err.Error())
+		}
+	}
+}
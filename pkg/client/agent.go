@@ -0,0 +1,188 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/nbena/gotask/pkg/req"
+	"github.com/nbena/gotask/pkg/server"
+)
+
+// ErrAgentUnknown is returned when the server doesn't know
+// the agent, it has to register again.
+var ErrAgentUnknown = errors.New("Agent not registered")
+
+// agentRequest is like request, with ErrAgentUnknown
+// if the server doesn't know the agent.
+func (c *TaskClient) agentRequest(method, postfix string,
+	expectedStatus int, body io.ReadCloser) (*http.Response, error) {
+
+	resp, err := c.do(method, postfix, body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case expectedStatus:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrAgentUnknown
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("Unexpected status: %s", resp.Status)
+	}
+}
+
+// RegisterAgent joins the server as an agent,
+// the Token is the agent token.
+func (c *TaskClient) RegisterAgent(message req.RegisterAgentRequest) (*req.RegisterAgentResponse, error) {
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	body := ioutil.NopCloser(bytes.NewBuffer(data))
+
+	resp, err := c.request(server.MethodAgentRegister, server.APIAgentRegister,
+		server.StatusAgentRegister, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := req.RegisterAgentResponse{}
+	decoder := json.NewDecoder(resp.Body)
+	if err = decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Heartbeat tells the server the agent is alive, it
+// returns the jobs to kill.
+func (c *TaskClient) Heartbeat(agentID string) (*req.HeartbeatResponse, error) {
+
+	resp, err := c.agentRequest(server.MethodAgentHeartbeat,
+		fmt.Sprintf("%s?agent=%s", server.APIAgentHeartbeat, url.QueryEscape(agentID)),
+		server.StatusAgentHeartbeat, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := req.HeartbeatResponse{}
+	decoder := json.NewDecoder(resp.Body)
+	if err = decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// NextJob waits for a job for the agent, it
+// returns nil if none came in time.
+func (c *TaskClient) NextJob(agentID string) (*req.AgentJob, error) {
+
+	resp, err := c.agentRequest(server.MethodAgentJobs,
+		fmt.Sprintf("%s?agent=%s", server.APIAgentJobs, url.QueryEscape(agentID)),
+		server.StatusAgentJobs, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := req.NextJobResponse{}
+	decoder := json.NewDecoder(resp.Body)
+	if err = decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Job, nil
+}
+
+// SendOutput appends data to a stream of the log of a
+// job run by the agent.
+func (c *TaskClient) SendOutput(agentID, jobID, stream string, data []byte) error {
+
+	resp, err := c.agentRequest(server.MethodAgentOutput,
+		fmt.Sprintf("%s?agent=%s&job=%s&stream=%s", server.APIAgentOutput,
+			url.QueryEscape(agentID), url.QueryEscape(jobID), url.QueryEscape(stream)),
+		server.StatusAgentOutput, ioutil.NopCloser(bytes.NewReader(data)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// SendResult reports the end of a job run by the agent.
+func (c *TaskClient) SendResult(agentID, jobID string, result *req.AgentResult) error {
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	body := ioutil.NopCloser(bytes.NewBuffer(data))
+
+	resp, err := c.agentRequest(server.MethodAgentResult,
+		fmt.Sprintf("%s?agent=%s&job=%s", server.APIAgentResult,
+			url.QueryEscape(agentID), url.QueryEscape(jobID)),
+		server.StatusAgentResult, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// SendArtifact sends an artifact of a job run by the agent,
+// name is its path relative to the directory of the run.
+func (c *TaskClient) SendArtifact(agentID, jobID, name string, data io.Reader) error {
+
+	resp, err := c.agentRequest(server.MethodAgentArtifact,
+		fmt.Sprintf("%s?agent=%s&job=%s&name=%s", server.APIAgentArtifact,
+			url.QueryEscape(agentID), url.QueryEscape(jobID), url.QueryEscape(name)),
+		server.StatusAgentArtifact, ioutil.NopCloser(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Agents returns the agents registered to the server.
+func (c *TaskClient) Agents() ([]req.AgentInfo, error) {
+
+	resp, err := c.request(server.MethodAgents, server.APIAgents, server.StatusAgents, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := req.ListAgentsResponse{}
+	decoder := json.NewDecoder(resp.Body)
+	if err = decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Agents, nil
+}
@@ -0,0 +1,173 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/term"
+
+	"github.com/nbena/gotask/pkg/req"
+	"github.com/nbena/gotask/pkg/server"
+)
+
+// Attach connects the local terminal, in raw mode, to the
+// terminal of the running task id, till the process ends.
+func (c *TaskClient) Attach(id string) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return c.AttachIO(id, os.Stdin, os.Stdout, 0, 0)
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	cols, rows, err := term.GetSize(fd)
+	if err != nil {
+		return err
+	}
+
+	conn, err := c.dialAttach(id)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// follow the size of the local terminal
+	resize := make(chan os.Signal, 1)
+	signal.Notify(resize, syscall.SIGWINCH)
+	defer signal.Stop(resize)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-resize:
+				if cols, rows, err := term.GetSize(fd); err == nil {
+					sendResize(conn, uint16(rows), uint16(cols))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return proxyAttach(conn, os.Stdin, os.Stdout, uint16(rows), uint16(cols))
+}
+
+// AttachIO connects in and out to the terminal of the running
+// task id, till the process ends; rows and cols, if not 0,
+// set the size of the terminal.
+func (c *TaskClient) AttachIO(id string, in io.Reader, out io.Writer, rows, cols uint16) error {
+	conn, err := c.dialAttach(id)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return proxyAttach(conn, in, out, rows, cols)
+}
+
+// attachConn serializes the writes, as the
+// WebSocket allows a single writer.
+type attachConn struct {
+	*websocket.Conn
+	mutex sync.Mutex
+}
+
+func (c *attachConn) write(kind int, data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.WriteMessage(kind, data)
+}
+
+func (c *TaskClient) dialAttach(id string) (*attachConn, error) {
+	uri := fmt.Sprintf("ws://%s:%d%s?id=%s", c.config.ServerAddr, c.config.ServerPort,
+		server.APIAttach, url.QueryEscape(id))
+
+	header := http.Header{}
+	if c.config.Token != "" {
+		header.Set(server.AuthHeader, server.AuthPrefix+c.config.Token)
+	}
+
+	conn, resp, err := websocket.DefaultDialer.Dial(uri, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("Unexpected status: %s", resp.Status)
+		}
+		return nil, err
+	}
+	return &attachConn{Conn: conn}, nil
+}
+
+func sendResize(conn *attachConn, rows, cols uint16) error {
+	data, err := json.Marshal(req.AttachControl{
+		Type: req.AttachResize,
+		Rows: rows,
+		Cols: cols,
+	})
+	if err != nil {
+		return err
+	}
+	return conn.write(websocket.TextMessage, data)
+}
+
+// proxyAttach copies in to the terminal and its output to out.
+func proxyAttach(conn *attachConn, in io.Reader, out io.Writer, rows, cols uint16) error {
+	if rows != 0 && cols != 0 {
+		if err := sendResize(conn, rows, cols); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			n, err := in.Read(buffer)
+			if n > 0 {
+				if conn.write(websocket.BinaryMessage, buffer[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
+			return err
+		}
+		if _, err = out.Write(data); err != nil {
+			return err
+		}
+	}
+}
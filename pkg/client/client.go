@@ -20,6 +20,8 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -49,24 +51,35 @@ func NewTaskClient(config *Config) *TaskClient {
 func (c *TaskClient) request(method, postfix string,
 	expectedStatus int, body io.ReadCloser) (*http.Response, error) {
 
-	uri := fmt.Sprintf("http://%s:%d%s",
-		c.config.ServerAddr, c.config.ServerPort, postfix)
-
-	req, err := http.NewRequest(method, uri, body)
+	resp, err := c.do(method, postfix, body)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := c.client.Do(req)
+	if resp.StatusCode != expectedStatus {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Unexpected status: %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+// do sends a request, whatever the status of the response.
+func (c *TaskClient) do(method, postfix string, body io.ReadCloser) (*http.Response, error) {
+
+	uri := fmt.Sprintf("http://%s:%d%s",
+		c.config.ServerAddr, c.config.ServerPort, postfix)
+
+	req, err := http.NewRequest(method, uri, body)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != expectedStatus {
-		return nil, err
+	if c.config.Token != "" {
+		req.Header.Set(server.AuthHeader, server.AuthPrefix+c.config.Token)
 	}
 
-	return resp, nil
+	return c.client.Do(req)
 }
 
 // List returns the list of tasks on the server.
@@ -119,10 +132,21 @@ func (c *TaskClient) AddModify(toAdd task.Task) error {
 
 // Execute runs the task on the server.
 func (c *TaskClient) Execute(taskName string) (*req.ShortRunningTaskResponse, error) {
+	return c.ExecuteWithParams(taskName, nil)
+}
+
+// ExecuteWithParams runs the task on the server, giving
+// params to its templates.
+func (c *TaskClient) ExecuteWithParams(taskName string,
+	params map[string]string) (*req.ShortRunningTaskResponse, error) {
 
-	message := req.ExecuteMessageRequest{
+	return c.execute(req.ExecuteMessageRequest{
 		TaskName: taskName,
-	}
+		Params:   params,
+	})
+}
+
+func (c *TaskClient) execute(message req.ExecuteMessageRequest) (*req.ShortRunningTaskResponse, error) {
 
 	data, err := json.Marshal(message)
 	if err != nil {
@@ -135,6 +159,13 @@ func (c *TaskClient) Execute(taskName string) (*req.ShortRunningTaskResponse, er
 	if err != nil {
 		return nil, err
 	}
+	return c.executeResponse(resp)
+}
+
+// executeResponse decodes the response to /exec,
+// polling till the end of a long task.
+func (c *TaskClient) executeResponse(resp *http.Response) (*req.ShortRunningTaskResponse, error) {
+	defer resp.Body.Close()
 
 	// now we try to decode the response
 	respData, err := ioutil.ReadAll(resp.Body)
@@ -143,12 +174,13 @@ func (c *TaskClient) Execute(taskName string) (*req.ShortRunningTaskResponse, er
 	}
 
 	result := req.ShortRunningTaskResponse{}
-	if strings.Index(string(respData), req.PollStatusInProgress) != -1 {
-		// long task
-		receiver := req.LongRunningTaskResponse{}
-		if err = json.Unmarshal(respData, &receiver); err != nil {
-			return nil, err
-		}
+	receiver := req.LongRunningTaskResponse{}
+	if err = json.Unmarshal(respData, &receiver); err != nil {
+		return nil, err
+	}
+
+	// only a long task has an ID
+	if receiver.ID != "" {
 		result, err = c.longTask(&receiver)
 		if err != nil {
 			return nil, err
@@ -163,6 +195,189 @@ func (c *TaskClient) Execute(taskName string) (*req.ShortRunningTaskResponse, er
 	return &result, nil
 }
 
+// ExecuteWithPriority runs the task on the server, overriding
+// its priority in the queue.
+func (c *TaskClient) ExecuteWithPriority(taskName string, params map[string]string,
+	priority int) (*req.ShortRunningTaskResponse, error) {
+
+	return c.execute(req.ExecuteMessageRequest{
+		TaskName: taskName,
+		Params:   params,
+		Priority: &priority,
+	})
+}
+
+// ExecuteWithInput runs the task on the server, writing
+// input to the stdin of the process.
+func (c *TaskClient) ExecuteWithInput(taskName string, params map[string]string,
+	input []byte) (*req.ShortRunningTaskResponse, error) {
+
+	return c.execute(req.ExecuteMessageRequest{
+		TaskName:  taskName,
+		Params:    params,
+		InputData: input,
+	})
+}
+
+// ExecuteMatrix runs the task once for each combination of
+// matrix, nil for the one of the task, and waits for all.
+func (c *TaskClient) ExecuteMatrix(taskName string, params map[string]string,
+	matrix *task.Matrix) (*req.ShortRunningTaskResponse, error) {
+
+	return c.execute(req.ExecuteMessageRequest{
+		TaskName: taskName,
+		Params:   params,
+		Matrix:   matrix,
+	})
+}
+
+// ExecuteStream runs the task on the server, sending input
+// as the body of the request, for large inputs.
+func (c *TaskClient) ExecuteStream(taskName string, input io.Reader) (*req.ShortRunningTaskResponse, error) {
+
+	resp, err := c.request(server.MethodExecute,
+		fmt.Sprintf("%s?%s=%s", server.APIExecute, server.QueryTask, url.QueryEscape(taskName)),
+		server.StatusExecute, ioutil.NopCloser(input))
+	if err != nil {
+		return nil, err
+	}
+	return c.executeResponse(resp)
+}
+
+// Cancel kills a running long task.
+func (c *TaskClient) Cancel(id string) error {
+
+	_, err := c.request(server.MethodCancel,
+		fmt.Sprintf("%s?id=%s", server.APICancel, url.QueryEscape(id)),
+		server.StatusCancel, nil)
+	return err
+}
+
+// Queue returns the jobs waiting and running on the server.
+func (c *TaskClient) Queue() (*req.QueueResponse, error) {
+
+	resp, err := c.request(server.MethodQueue, server.APIQueue, server.StatusQueue, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := req.QueueResponse{}
+	decoder := json.NewDecoder(resp.Body)
+	if err = decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Logs reads the full log of a stream of a run from offset,
+// it returns the data and the size of the whole log.
+func (c *TaskClient) Logs(id, stream string, offset int64) ([]byte, int64, error) {
+
+	resp, err := c.request(server.MethodLogs,
+		fmt.Sprintf("%s?id=%s&stream=%s&offset=%d", server.APILogs,
+			url.QueryEscape(id), url.QueryEscape(stream), offset),
+		server.StatusLogs, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err := strconv.ParseInt(resp.Header.Get(server.HeaderLogSize), 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, size, nil
+}
+
+// Artifacts returns the artifacts kept after the run id.
+func (c *TaskClient) Artifacts(id string) ([]task.Artifact, error) {
+
+	resp, err := c.request(server.MethodArtifacts, artifactsPath(id),
+		server.StatusArtifacts, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := req.ListArtifactsResponse{}
+	decoder := json.NewDecoder(resp.Body)
+	if err = decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Artifacts, nil
+}
+
+// DownloadArtifact writes the artifact name of the run id to out.
+func (c *TaskClient) DownloadArtifact(id, name string, out io.Writer) error {
+
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	resp, err := c.request(server.MethodArtifacts,
+		artifactsPath(id)+"/"+strings.Join(segments, "/"),
+		server.StatusArtifacts, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// DownloadArtifacts writes all the artifacts of
+// the run id to out, in a tar.gz.
+func (c *TaskClient) DownloadArtifacts(id string, out io.Writer) error {
+
+	resp, err := c.request(server.MethodArtifacts,
+		fmt.Sprintf("%s?%s=%s", artifactsPath(id), server.QueryFormat,
+			url.QueryEscape(server.FormatTarGz)),
+		server.StatusArtifacts, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+func artifactsPath(id string) string {
+	return server.APIRuns + url.PathEscape(id) + "/" + server.APIArtifacts
+}
+
+// Validate asks the server to check a task without running it.
+func (c *TaskClient) Validate(message req.ValidateRequest) (*req.ValidateResponse, error) {
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	body := ioutil.NopCloser(bytes.NewBuffer(data))
+
+	resp, err := c.request(server.MethodValidate, server.APIValidate, server.StatusValidate, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := req.ValidateResponse{}
+	decoder := json.NewDecoder(resp.Body)
+	if err = decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
 func (c *TaskClient) longTask(response *req.LongRunningTaskResponse) (req.ShortRunningTaskResponse, error) {
 
 	// prepare a new request.
@@ -174,7 +389,8 @@ func (c *TaskClient) longTask(response *req.LongRunningTaskResponse) (req.ShortR
 		<-waiter
 		// ok do the request
 		resp, err := c.request(server.MethodPoll,
-			fmt.Sprintf("poll?id=%s", response.ID), server.StatusPoll, nil)
+			fmt.Sprintf("%s?id=%s", server.APIPoll, url.QueryEscape(response.ID)),
+			server.StatusPoll, nil)
 		if err != nil {
 			return req.ShortRunningTaskResponse{}, err
 		}
@@ -184,15 +400,62 @@ func (c *TaskClient) longTask(response *req.LongRunningTaskResponse) (req.ShortR
 		}
 
 		resp.Body.Close()
-		if strings.Index(string(respData), req.PollStatusCompleted) != -1 {
-			// completed
-			err = json.Unmarshal(respData, &result)
-			if err != nil {
-				return req.ShortRunningTaskResponse{}, err
-			}
+		receiver := req.PollStatusCompletedResponse{}
+		if err = json.Unmarshal(respData, &receiver); err != nil {
+			return req.ShortRunningTaskResponse{}, err
+		}
+		if receiver.Status == req.PollStatusCompleted ||
+			receiver.Status == req.PollStatusSkipped {
+			result = receiver.ShortRunningTaskResponse
 			loop = false
-		} // else still poll
+		} // else queued or in progress, still poll
 
 	}
 	return result, nil
 }
+
+// SetSecret adds or rotates a secret in the server store.
+func (c *TaskClient) SetSecret(name, value string) error {
+
+	message := req.SetSecretRequest{
+		Name:  name,
+		Value: value,
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	body := ioutil.NopCloser(bytes.NewBuffer(data))
+
+	_, err = c.request(server.MethodSecretSet, server.APISecrets, server.StatusSecretSet, body)
+	return err
+}
+
+// DeleteSecret removes a secret from the server store.
+func (c *TaskClient) DeleteSecret(name string) error {
+
+	_, err := c.request(server.MethodSecretDelete,
+		fmt.Sprintf("%s?name=%s", server.APISecrets, url.QueryEscape(name)),
+		server.StatusSecretDelete, nil)
+	return err
+}
+
+// ListSecrets returns the names of the secrets in the server store.
+func (c *TaskClient) ListSecrets() ([]req.SecretInfo, error) {
+
+	resp, err := c.request(server.MethodSecretList, server.APISecrets, server.StatusSecretList, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	rec := req.ListSecretsResponse{}
+	decoder := json.NewDecoder(resp.Body)
+	if err = decoder.Decode(&rec); err != nil {
+		return nil, err
+	}
+
+	return rec.Secrets, nil
+}
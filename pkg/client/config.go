@@ -20,4 +20,8 @@ type Config struct {
 	ServerAddr   string
 	ServerPort   int
 	PollInterval time.Duration
+
+	// sent to the server, needed by the
+	// admin-only operations
+	Token string
 }
@@ -13,21 +13,67 @@
 
 package req
 
-import "github.com/nbena/gotask/pkg/task"
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nbena/gotask/pkg/task"
+)
 
 // here definition of Requests/Responses.
 
 // ExecuteMessageRequest represents a /POST request execution
 type ExecuteMessageRequest struct {
 	TaskName string `json:"taskName"`
+	// available to the templates of the task
+	Params map[string]string `json:"params,omitempty"`
+	// overrides the priority of the task
+	Priority *int `json:"priority,omitempty"`
+	// written to the stdin of the process, either
+	// as a string or as bytes, base64 encoded
+	Input     string `json:"input,omitempty"`
+	InputData []byte `json:"inputData,omitempty"`
+	// overrides the matrix of the task
+	Matrix *task.Matrix `json:"matrix,omitempty"`
 }
 
 // ShortRunningTaskResponse is returned after issuing a request
 // for a short-running task.
 type ShortRunningTaskResponse struct {
 	Command string `json:"command"`
-	Output  string `json:"output,omitempty"`
-	Error   string `json:"error,omitempty"`
+	// the ID of the run, for its logs and its artifacts
+	RunID  string `json:"runID,omitempty"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// the When condition of the task was false
+	Skipped bool `json:"skipped,omitempty"`
+	// exit code, signal, times and resources
+	Run *task.RunResult `json:"run,omitempty"`
+	// the output is not complete, the full
+	// one may be available from /logs
+	Truncated bool `json:"truncated,omitempty"`
+	// every attempt, the last one included,
+	// if the task has a retry policy
+	Attempts []task.Attempt `json:"attempts,omitempty"`
+	// the output parsed as the OutputFormat
+	// of the task says
+	Structured json.RawMessage `json:"result,omitempty"`
+	// the runs of a matrix, one per combination
+	Matrix []MatrixChild `json:"matrix,omitempty"`
+}
+
+// MatrixChild describes the run of a combination
+// of a matrix.
+type MatrixChild struct {
+	ID   string            `json:"ID"`
+	Vars map[string]string `json:"vars"`
+	// a PollStatus
+	Status string `json:"status"`
+	Failed bool   `json:"failed,omitempty"`
+	// only when failed
+	Error      string          `json:"error,omitempty"`
+	Run        *task.RunResult `json:"run,omitempty"`
+	Structured json.RawMessage `json:"result,omitempty"`
 }
 
 // LongRunningTaskResponse is returned after issuing a request
@@ -48,6 +94,12 @@ const (
 	PollStatusInProgress = "In Progress"
 	// PollStatusCompleted defines a completed task.
 	PollStatusCompleted = "Completed"
+	// PollStatusSkipped defines a task not run
+	// because its condition was false.
+	PollStatusSkipped = "Skipped"
+	// PollStatusQueued defines a task waiting
+	// for its turn to run.
+	PollStatusQueued = "Queued"
 )
 
 // PollStatusInProgressResponse is returned when you poll
@@ -55,6 +107,9 @@ const (
 type PollStatusInProgressResponse struct {
 	ID     string `json:"ID"`
 	Status string `json:"status"`
+	// the position in the queue, from 1,
+	// if the task is queued
+	Position int `json:"position,omitempty"`
 }
 
 // PollStatusCompletedResponse is returned when you poll
@@ -81,3 +136,146 @@ type ListMessageResponse struct {
 type AddTaskRequest struct {
 	Task task.Task `json:"task"`
 }
+
+// SetSecretRequest is used to add or rotate a secret.
+type SetSecretRequest struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// SecretInfo describes a stored secret, its value
+// is never returned.
+type SecretInfo struct {
+	Name      string    `json:"name"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ListSecretsResponse is returned upon a GET /secrets request.
+type ListSecretsResponse struct {
+	Secrets []SecretInfo `json:"secrets"`
+}
+
+// ValidateRequest asks to check a task without running it.
+// Either TaskName, for a known task, or Task must be given.
+type ValidateRequest struct {
+	TaskName string            `json:"taskName,omitempty"`
+	Task     *task.Task        `json:"task,omitempty"`
+	Params   map[string]string `json:"params,omitempty"`
+}
+
+// ValidateResponse is returned upon a /validate request.
+type ValidateResponse struct {
+	Valid bool `json:"valid"`
+	// the command that would be run
+	Command []string `json:"command,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// JobInfo describes a run of a task in the queue.
+type JobInfo struct {
+	ID       string `json:"ID"`
+	TaskName string `json:"taskName"`
+	// PollStatusQueued or PollStatusInProgress
+	Status   string `json:"status"`
+	Priority int    `json:"priority"`
+	// empty if anonymous
+	Caller    string     `json:"caller,omitempty"`
+	QueuedAt  time.Time  `json:"queuedAt"`
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+}
+
+// QueueResponse is returned upon a /queue request,
+// the jobs are in their order.
+type QueueResponse struct {
+	Waiting []JobInfo `json:"waiting"`
+	Running []JobInfo `json:"running"`
+}
+
+// AttachResize is the Type of an AttachControl
+// changing the size of the terminal.
+const AttachResize = "resize"
+
+// AttachControl is sent by the client as a text message
+// on the /attach WebSocket, the binary messages are the
+// input of the terminal.
+type AttachControl struct {
+	Type string `json:"type"`
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+}
+
+// RegisterAgentRequest is sent by an agent to join the server.
+type RegisterAgentRequest struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// the most jobs the agent runs at the same time
+	Capacity int `json:"capacity"`
+}
+
+// RegisterAgentResponse gives the agent its ID.
+type RegisterAgentResponse struct {
+	ID string `json:"ID"`
+	// how often the agent has to send a heartbeat
+	HeartbeatInterval task.Duration `json:"heartbeatInterval"`
+}
+
+// HeartbeatResponse is returned upon a heartbeat of an agent.
+type HeartbeatResponse struct {
+	// the jobs to kill, with the reason
+	Kill map[string]string `json:"kill,omitempty"`
+}
+
+// AgentJob is an attempt of a run given to an agent.
+type AgentJob struct {
+	ID      string            `json:"ID"`
+	Attempt int               `json:"attempt"`
+	Task    task.Task         `json:"task"`
+	Params  map[string]string `json:"params,omitempty"`
+	Input   []byte            `json:"input,omitempty"`
+	// the vars of the run, like the ones of a matrix
+	Vars []task.Var `json:"vars,omitempty"`
+	// the limit to the output kept in memory
+	MaxOutput int64 `json:"maxOutput"`
+}
+
+// NextJobResponse is returned upon a long poll of an
+// agent, Job is nil if none came in time.
+type NextJobResponse struct {
+	Job *AgentJob `json:"job,omitempty"`
+}
+
+// AgentResult is sent by an agent at the end of a job.
+type AgentResult struct {
+	Output    string          `json:"output,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Skipped   bool            `json:"skipped,omitempty"`
+	Run       *task.RunResult `json:"run,omitempty"`
+	Truncated bool            `json:"truncated,omitempty"`
+	// with an OutputFormat
+	Structured json.RawMessage `json:"result,omitempty"`
+	// the run failed
+	Failed bool `json:"failed,omitempty"`
+}
+
+// AgentInfo describes an agent registered to the server.
+type AgentInfo struct {
+	ID       string            `json:"ID"`
+	Name     string            `json:"name"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Capacity int               `json:"capacity"`
+	// the IDs of the jobs it's running
+	Jobs     []string  `json:"jobs"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// ListAgentsResponse is returned upon a GET /agents request.
+type ListAgentsResponse struct {
+	Agents []AgentInfo `json:"agents"`
+}
+
+// ListArtifactsResponse is returned upon a GET /runs/{id}/artifacts
+// request.
+type ListArtifactsResponse struct {
+	ID        string          `json:"ID"`
+	Artifacts []task.Artifact `json:"artifacts"`
+}
@@ -0,0 +1,654 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbena/gotask/pkg/req"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+// agent is a process on another host
+// running the tasks with Labels.
+type agent struct {
+	id       string
+	name     string
+	labels   map[string]string
+	capacity int
+	lastSeen time.Time
+
+	// the attempts it's running, by job
+	running map[string]*agentJob
+	// closed when there may be a job for it
+	wake chan struct{}
+}
+
+// agentJob is an attempt of a job
+// run by an agent.
+type agentJob struct {
+	job     *job
+	attempt int
+	// nil while waiting
+	agent *agent
+	// receives the end of the attempt
+	done chan *req.AgentResult
+	// sent by the agent, under the lock of the pool
+	artifacts    []task.Artifact
+	artifactSize int64
+}
+
+// agentPool keeps the agents and gives them the attempts
+// that match their labels, in FIFO order. The queue has
+// already ordered the jobs.
+type agentPool struct {
+	// an agent not heard from for timeout is dead
+	timeout time.Duration
+	// where the output sent by the agents goes
+	logDir string
+
+	agents  map[string]*agent
+	waiting []*agentJob
+
+	*sync.Mutex
+}
+
+func newAgentPool(timeout time.Duration, logDir string) *agentPool {
+	return &agentPool{
+		timeout: timeout,
+		logDir:  logDir,
+		agents:  make(map[string]*agent),
+		Mutex:   &sync.Mutex{},
+	}
+}
+
+// remote tells if the job is run by an agent.
+func (j *job) remote() bool {
+	return len(j.definition.Labels) > 0
+}
+
+// remoteRuntimeTask is the run of a task on an agent as
+// kept by the server, the agent prepares the real one.
+func remoteRuntimeTask(toRun *task.Task) *task.RuntimeTaskInfo {
+	return &task.RuntimeTaskInfo{
+		Cmd:        &exec.Cmd{Args: toRun.Command},
+		ShowOutput: toRun.ShowOutput,
+	}
+}
+
+// matchLabels tells if labels has all the ones of selector.
+func matchLabels(selector, labels map[string]string) bool {
+	for key, value := range selector {
+		if found, ok := labels[key]; !ok || found != value {
+			return false
+		}
+	}
+	return true
+}
+
+// wakeAll wakes the long polls, the lock must be held.
+func (p *agentPool) wakeAll() {
+	for _, a := range p.agents {
+		close(a.wake)
+		a.wake = make(chan struct{})
+	}
+}
+
+// register adds an agent, returning its ID.
+func (p *agentPool) register(msg *req.RegisterAgentRequest) string {
+	a := &agent{
+		id:       uniqueID2(),
+		name:     msg.Name,
+		labels:   msg.Labels,
+		capacity: msg.Capacity,
+		lastSeen: time.Now(),
+		running:  make(map[string]*agentJob),
+		wake:     make(chan struct{}),
+	}
+	if a.capacity <= 0 {
+		a.capacity = 1
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.agents[a.id] = a
+	log.Printf("Agent %s registered as %s\n", a.name, a.id)
+	return a.id
+}
+
+// seen records the agent id is alive, it
+// returns nil if it's unknown. The lock must be held.
+func (p *agentPool) seen(id string) *agent {
+	a := p.agents[id]
+	if a != nil {
+		a.lastSeen = time.Now()
+	}
+	return a
+}
+
+// heartbeat records the agent id is alive, it returns the
+// jobs it has to kill, false if the agent is unknown.
+func (p *agentPool) heartbeat(id string) (map[string]string, bool) {
+	p.Lock()
+	defer p.Unlock()
+	a := p.seen(id)
+	if a == nil {
+		return nil, false
+	}
+
+	kill := make(map[string]string)
+	for jobID, assigned := range a.running {
+		select {
+		case <-assigned.job.stopped:
+			assigned.job.mutex.Lock()
+			kill[jobID] = assigned.job.killReason
+			assigned.job.mutex.Unlock()
+		default:
+		}
+	}
+	return kill, true
+}
+
+// take gives the first waiting attempt matching a to it, if
+// it has room. The lock must be held.
+func (p *agentPool) take(a *agent) *agentJob {
+	if len(a.running) >= a.capacity {
+		return nil
+	}
+	for i, assigned := range p.waiting {
+		if !matchLabels(assigned.job.definition.Labels, a.labels) {
+			continue
+		}
+		p.waiting = append(p.waiting[:i], p.waiting[i+1:]...)
+		assigned.agent = a
+		a.running[assigned.job.id] = assigned
+		return assigned
+	}
+	return nil
+}
+
+// next waits at most timeout for an attempt for the agent id,
+// it returns nil if none came, false if the agent is unknown.
+func (p *agentPool) next(id string, timeout time.Duration,
+	gone <-chan struct{}) (*agentJob, bool) {
+
+	deadline := time.After(timeout)
+	for {
+		p.Lock()
+		a := p.seen(id)
+		if a == nil {
+			p.Unlock()
+			return nil, false
+		}
+		if assigned := p.take(a); assigned != nil {
+			p.Unlock()
+			return assigned, true
+		}
+		wake := a.wake
+		p.Unlock()
+
+		select {
+		case <-wake:
+		case <-deadline:
+			return nil, true
+		case <-gone:
+			return nil, true
+		}
+	}
+}
+
+// requeue gives back the attempt taken by the agent id that
+// never got it, it's the first to be taken again.
+func (p *agentPool) requeue(id string, assigned *agentJob) {
+	p.Lock()
+	defer p.Unlock()
+	a := p.agents[id]
+	if a == nil || a.running[assigned.job.id] != assigned {
+		// dead, reap has done it
+		return
+	}
+	delete(a.running, assigned.job.id)
+	assigned.agent = nil
+	assigned.artifacts = nil
+	assigned.artifactSize = 0
+
+	select {
+	case <-assigned.job.stopped:
+		assigned.done <- &req.AgentResult{
+			Error:  "Cancelled while waiting for an agent",
+			Failed: true,
+		}
+		return
+	default:
+	}
+	p.waiting = append([]*agentJob{assigned}, p.waiting...)
+	p.wakeAll()
+}
+
+// assigned returns the attempt of the job run
+// by the agent id, nil if there's none.
+func (p *agentPool) assigned(id, jobID string) *agentJob {
+	p.Lock()
+	defer p.Unlock()
+	a := p.seen(id)
+	if a == nil {
+		return nil
+	}
+	return a.running[jobID]
+}
+
+// finish ends the attempt of the job run by the agent
+// id with res, it returns false if there's none.
+func (p *agentPool) finish(id, jobID string, res *req.AgentResult) bool {
+	p.Lock()
+	defer p.Unlock()
+	a := p.seen(id)
+	if a == nil {
+		return false
+	}
+	assigned, ok := a.running[jobID]
+	if !ok {
+		return false
+	}
+	delete(a.running, jobID)
+	if res.Run != nil {
+		// only the ones the server has
+		res.Run.Artifacts = assigned.artifacts
+	}
+	assigned.done <- res
+	// it has room now
+	close(a.wake)
+	a.wake = make(chan struct{})
+	return true
+}
+
+// run gives the attempt of toRun to an agent and waits for
+// its end, it returns the result and if it failed. An attempt
+// cancelled before an agent takes it is never run.
+func (p *agentPool) run(toRun *job, attempt int) (*task.CmdDoneChan, bool) {
+	assigned := &agentJob{
+		job:     toRun,
+		attempt: attempt,
+		done:    make(chan *req.AgentResult, 1),
+	}
+	p.Lock()
+	p.waiting = append(p.waiting, assigned)
+	p.wakeAll()
+	p.Unlock()
+
+	var res *req.AgentResult
+	select {
+	case res = <-assigned.done:
+	case <-toRun.stopped:
+		p.Lock()
+		for i, waiting := range p.waiting {
+			if waiting == assigned {
+				p.waiting = append(p.waiting[:i], p.waiting[i+1:]...)
+				assigned.done <- &req.AgentResult{
+					Error:  "Cancelled while waiting for an agent",
+					Failed: true,
+				}
+				break
+			}
+		}
+		p.Unlock()
+		// otherwise the agent kills it
+		res = <-assigned.done
+	}
+
+	return &task.CmdDoneChan{
+		ID:         toRun.id,
+		Output:     res.Output,
+		Error:      res.Error,
+		Skipped:    res.Skipped,
+		Result:     res.Run,
+		Truncated:  res.Truncated,
+		Structured: res.Structured,
+	}, res.Failed
+}
+
+// watch removes the dead agents till stop is closed.
+func (p *agentPool) watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.reap()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reap removes the agents not heard from for the timeout,
+// their attempts are given to the others.
+func (p *agentPool) reap() {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	requeued := false
+	for id, a := range p.agents {
+		if now.Sub(a.lastSeen) < p.timeout {
+			continue
+		}
+		log.Printf("Agent %s (%s) is dead\n", a.name, id)
+		delete(p.agents, id)
+		close(a.wake)
+
+		for _, assigned := range a.running {
+			select {
+			case <-assigned.job.stopped:
+				// no need to run it again
+				assigned.done <- &req.AgentResult{
+					Error:  "Agent dead while killing",
+					Failed: true,
+				}
+				continue
+			default:
+			}
+			// the output starts again
+			for _, stream := range []string{task.StreamStdout, task.StreamStderr, task.StreamMerged} {
+				os.Remove(p.agentLogPath(assigned, stream))
+			}
+			assigned.agent = nil
+			assigned.artifacts = nil
+			assigned.artifactSize = 0
+			p.waiting = append([]*agentJob{assigned}, p.waiting...)
+			requeued = true
+		}
+	}
+	if requeued {
+		p.wakeAll()
+	}
+}
+
+// artifactSize returns the bytes of the artifacts
+// of the attempt sent so far.
+func (p *agentPool) artifactSize(assigned *agentJob) int64 {
+	p.Lock()
+	defer p.Unlock()
+	return assigned.artifactSize
+}
+
+// addArtifact records an artifact of the attempt.
+func (p *agentPool) addArtifact(assigned *agentJob, artifact *task.Artifact) {
+	p.Lock()
+	defer p.Unlock()
+	assigned.artifacts = append(assigned.artifacts, *artifact)
+	assigned.artifactSize += artifact.Size
+}
+
+// agentLogPath is the log of a stream of an attempt.
+func (p *agentPool) agentLogPath(assigned *agentJob, stream string) string {
+	return task.LogPath(p.logDir, task.AttemptID(assigned.job.id, assigned.attempt), stream)
+}
+
+// list describes the agents.
+func (p *agentPool) list() []req.AgentInfo {
+	p.Lock()
+	defer p.Unlock()
+
+	agents := make([]req.AgentInfo, 0, len(p.agents))
+	for _, a := range p.agents {
+		info := req.AgentInfo{
+			ID:       a.id,
+			Name:     a.name,
+			Labels:   a.labels,
+			Capacity: a.capacity,
+			Jobs:     make([]string, 0, len(a.running)),
+			LastSeen: a.lastSeen,
+		}
+		for jobID := range a.running {
+			info.Jobs = append(info.Jobs, jobID)
+		}
+		sort.Strings(info.Jobs)
+		agents = append(agents, info)
+	}
+	sort.Slice(agents, func(i, k int) bool {
+		if agents[i].Name != agents[k].Name {
+			return agents[i].Name < agents[k].Name
+		}
+		return agents[i].ID < agents[k].ID
+	})
+	return agents
+}
+
+// checkAgent checks the request carries the agent token.
+func (t *TaskServer) checkAgent(w http.ResponseWriter, r *http.Request) bool {
+	if t.config.agentToken == "" {
+		writeError(w, "Agents not enabled", true, http.StatusNotFound)
+		return false
+	}
+	token := r.Header.Get(AuthHeader)
+	ok := strings.HasPrefix(token, AuthPrefix) &&
+		subtle.ConstantTimeCompare([]byte(token[len(AuthPrefix):]),
+			[]byte(t.config.agentToken)) == 1
+	if !ok {
+		writeError(w, "Agent token required", true, http.StatusForbidden)
+	}
+	return ok
+}
+
+// jobMessage is the attempt as given to the agent.
+func (t *TaskServer) jobMessage(assigned *agentJob) (*req.AgentJob, error) {
+	toRun := assigned.job
+	msg := &req.AgentJob{
+		ID:        toRun.id,
+		Attempt:   assigned.attempt,
+		Task:      toRun.definition,
+		Params:    toRun.opts.Params,
+		Input:     toRun.opts.Input,
+		Vars:      toRun.opts.Vars,
+		MaxOutput: t.config.maxOutput,
+	}
+	if t.artifacts == nil {
+		// nowhere to keep them
+		msg.Task.Artifacts = nil
+	}
+	if toRun.opts.InputFile != "" {
+		var err error
+		if msg.Input, err = ioutil.ReadFile(toRun.opts.InputFile); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// agents
+func (t *TaskServer) listAgents(w http.ResponseWriter, r *http.Request) {
+
+	if ok := checkMethod(MethodAgents, w, r); !ok {
+		return
+	}
+
+	encodeWithError(w, StatusAgents, req.ListAgentsResponse{
+		Agents: t.agents.list(),
+	})
+}
+
+// agents/register
+func (t *TaskServer) registerAgent(w http.ResponseWriter, r *http.Request) {
+
+	if ok := checkMethod(MethodAgentRegister, w, r); !ok || !t.checkAgent(w, r) {
+		return
+	}
+
+	var msg req.RegisterAgentRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err := decoder.Decode(&msg); err != nil {
+		writeError(w, err.Error(), true, http.StatusBadRequest)
+		return
+	}
+
+	encodeWithError(w, StatusAgentRegister, req.RegisterAgentResponse{
+		ID:                t.agents.register(&msg),
+		HeartbeatInterval: task.Duration(t.agents.timeout / 3),
+	})
+}
+
+// agents/heartbeat
+func (t *TaskServer) agentHeartbeat(w http.ResponseWriter, r *http.Request) {
+
+	if ok := checkMethod(MethodAgentHeartbeat, w, r); !ok || !t.checkAgent(w, r) {
+		return
+	}
+
+	kill, ok := t.agents.heartbeat(r.URL.Query().Get("agent"))
+	if !ok {
+		writeError(w, "Agent not registered", true, http.StatusNotFound)
+		return
+	}
+	encodeWithError(w, StatusAgentHeartbeat, req.HeartbeatResponse{
+		Kill: kill,
+	})
+}
+
+// agents/jobs, a long poll
+func (t *TaskServer) agentJobs(w http.ResponseWriter, r *http.Request) {
+
+	if ok := checkMethod(MethodAgentJobs, w, r); !ok || !t.checkAgent(w, r) {
+		return
+	}
+
+	agentID := r.URL.Query().Get("agent")
+	assigned, ok := t.agents.next(agentID, t.agents.timeout/2, r.Context().Done())
+	if !ok {
+		writeError(w, "Agent not registered", true, http.StatusNotFound)
+		return
+	}
+
+	msg := req.NextJobResponse{}
+	if assigned != nil {
+		var err error
+		if t.artifacts != nil && len(assigned.job.definition.Artifacts) > 0 {
+			err = t.artifacts.reset(assigned.job.id)
+		}
+		if err == nil {
+			msg.Job, err = t.jobMessage(assigned)
+		}
+		if err != nil {
+			t.agents.finish(agentID, assigned.job.id, &req.AgentResult{
+				Error:  err.Error(),
+				Failed: true,
+			})
+			writeError(w, err.Error(), true, http.StatusInternalServerError)
+			return
+		}
+	}
+	if !writeJob(w, r, &msg) && assigned != nil {
+		// the agent has not got it
+		t.agents.requeue(agentID, assigned)
+	}
+}
+
+// writeJob writes the response to a long poll,
+// it tells if the agent may have got it.
+func writeJob(w http.ResponseWriter, r *http.Request, msg *req.NextJobResponse) bool {
+	if r.Context().Err() != nil {
+		// gone while the job was being taken
+		return false
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		writeError(w, err.Error(), true, http.StatusInternalServerError)
+		return false
+	}
+	w.Header().Add("Content-type", "application/json, charset=utf-8")
+	w.WriteHeader(StatusAgentJobs)
+	if _, err = w.Write(data); err != nil {
+		log.Printf("Write error: %s\n", err.Error())
+		return false
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return r.Context().Err() == nil
+}
+
+// agents/output, appended to the log of the attempt
+func (t *TaskServer) agentOutput(w http.ResponseWriter, r *http.Request) {
+
+	if ok := checkMethod(MethodAgentOutput, w, r); !ok || !t.checkAgent(w, r) {
+		return
+	}
+
+	q := r.URL.Query()
+	stream := q.Get("stream")
+	switch stream {
+	case task.StreamStdout, task.StreamStderr, task.StreamMerged:
+	default:
+		writeError(w, "Invalid stream", true, http.StatusBadRequest)
+		return
+	}
+
+	assigned := t.agents.assigned(q.Get("agent"), q.Get("job"))
+	if assigned == nil {
+		writeError(w, "Job not assigned", true, http.StatusNotFound)
+		return
+	}
+	if t.config.logDir == "" {
+		w.WriteHeader(StatusAgentOutput)
+		return
+	}
+
+	file, err := os.OpenFile(t.agents.agentLogPath(assigned, stream),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		writeError(w, err.Error(), true, http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(file, http.MaxBytesReader(w, r.Body, maxRequestSize)); err != nil {
+		writeError(w, err.Error(), true, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(StatusAgentOutput)
+}
+
+// agents/result
+func (t *TaskServer) agentResult(w http.ResponseWriter, r *http.Request) {
+
+	if ok := checkMethod(MethodAgentResult, w, r); !ok || !t.checkAgent(w, r) {
+		return
+	}
+
+	var res req.AgentResult
+	// room for stdout and stderr
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*t.config.maxOutput+maxRequestSize))
+	if err := decoder.Decode(&res); err != nil {
+		writeError(w, err.Error(), true, http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+	if !t.agents.finish(q.Get("agent"), q.Get("job"), &res) {
+		writeError(w, "Job not assigned", true, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(StatusAgentResult)
+}
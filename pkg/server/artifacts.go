@@ -0,0 +1,394 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbena/gotask/pkg/req"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+const (
+	// in the directory of a run
+	artifactFilesDir = "files"
+	artifactManifest = "manifest.json"
+)
+
+// artifactStore keeps the artifacts of the runs, each run has
+// a directory with the files and their manifest, written once
+// the run has ended.
+type artifactStore struct {
+	dir string
+	// for each run
+	maxSize int64
+	// 0 means no limit
+	retention time.Duration
+	maxRuns   int
+
+	// the prune vs. the runs being written
+	*sync.Mutex
+}
+
+func newArtifactStore(dir string, maxSize int64, retention time.Duration,
+	maxRuns int) (*artifactStore, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &artifactStore{
+		dir:       dir,
+		maxSize:   maxSize,
+		retention: retention,
+		maxRuns:   maxRuns,
+		Mutex:     &sync.Mutex{},
+	}
+	if s.maxSize == 0 {
+		s.maxSize = DefaultMaxArtifactSize
+	}
+	// nothing is being written yet
+	s.prune(true)
+	return s, nil
+}
+
+func (s *artifactStore) runDir(id string) string {
+	return path.Join(s.dir, id)
+}
+
+func (s *artifactStore) filesDir(id string) string {
+	return path.Join(s.dir, id, artifactFilesDir)
+}
+
+// reset removes what an earlier attempt of the run id has left.
+func (s *artifactStore) reset(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := os.RemoveAll(s.runDir(id)); err != nil {
+		return err
+	}
+	return os.MkdirAll(s.filesDir(id), 0700)
+}
+
+// collect keeps the artifacts of the ended attempt of the run
+// id, the ones kept are returned even with an error.
+func (s *artifactStore) collect(id string, runtimeTask *task.RuntimeTaskInfo) ([]task.Artifact, error) {
+	if err := s.reset(id); err != nil {
+		return nil, err
+	}
+	artifacts, err := runtimeTask.CollectArtifacts(s.filesDir(id), s.maxSize)
+	if recordErr := s.record(id, artifacts); err == nil {
+		err = recordErr
+	}
+	return artifacts, err
+}
+
+// save writes an artifact of the run id sent by an agent.
+func (s *artifactStore) save(id, name string, body io.Reader, limit int64) (*task.Artifact, error) {
+	return task.SaveArtifact(s.filesDir(id), name, body, limit)
+}
+
+// record writes the manifest of the ended run id,
+// then the old runs are removed.
+func (s *artifactStore) record(id string, artifacts []task.Artifact) error {
+	if artifacts == nil {
+		artifacts = []task.Artifact{}
+	}
+	data, err := json.Marshal(artifacts)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(s.runDir(id), 0700); err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(s.runDir(id), artifactManifest), data, 0600)
+
+	s.prune(false)
+	return err
+}
+
+// manifest returns the artifacts of the run id, an
+// error if there are none or they're too old.
+func (s *artifactStore) manifest(id string) ([]task.Artifact, error) {
+	file := path.Join(s.runDir(id), artifactManifest)
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if s.retention > 0 && time.Since(info.ModTime()) > s.retention {
+		return nil, os.ErrNotExist
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var artifacts []task.Artifact
+	if err = json.Unmarshal(data, &artifacts); err != nil {
+		return nil, err
+	}
+	return artifacts, nil
+}
+
+// prune removes the runs over the retention limits,
+// with leftovers the ones never ended too.
+func (s *artifactStore) prune(leftovers bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("Error in pruning the artifacts: %s\n", err.Error())
+		return
+	}
+
+	type storedRun struct {
+		id    string
+		ended time.Time
+	}
+	var runs []storedRun
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := os.Stat(path.Join(s.dir, entry.Name(), artifactManifest))
+		if err != nil {
+			// still running
+			if leftovers {
+				os.RemoveAll(s.runDir(entry.Name()))
+			}
+			continue
+		}
+		runs = append(runs, storedRun{id: entry.Name(), ended: info.ModTime()})
+	}
+
+	// the newest first
+	sort.Slice(runs, func(i, k int) bool {
+		return runs[i].ended.After(runs[k].ended)
+	})
+	now := time.Now()
+	for i, run := range runs {
+		if (s.maxRuns > 0 && i >= s.maxRuns) ||
+			(s.retention > 0 && now.Sub(run.ended) > s.retention) {
+			if err = os.RemoveAll(s.runDir(run.id)); err != nil {
+				log.Printf("Error in pruning the artifacts: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// collectArtifacts keeps the artifacts of the ended attempt of
+// toRun in its result, a failure is added to its error. It tells
+// if they have been kept.
+func (t *TaskServer) collectArtifacts(toRun *job, runtimeTask *task.RuntimeTaskInfo,
+	res *task.CmdDoneChan) bool {
+
+	if t.artifacts == nil || res.Result == nil || len(toRun.definition.Artifacts) == 0 {
+		return true
+	}
+	artifacts, err := t.artifacts.collect(toRun.id, runtimeTask)
+	res.Result.Artifacts = artifacts
+	if err != nil {
+		res.Error += fmt.Sprintf("Fail to collect the artifacts: %s\n", err.Error())
+		return false
+	}
+	return true
+}
+
+// recordArtifacts keeps the list of the artifacts sent by the
+// agent that has run the attempt of toRun, it tells if it's kept.
+func (t *TaskServer) recordArtifacts(toRun *job, res *task.CmdDoneChan) bool {
+	if t.artifacts == nil || res.Result == nil || len(toRun.definition.Artifacts) == 0 {
+		return true
+	}
+	if err := t.artifacts.record(toRun.id, res.Result.Artifacts); err != nil {
+		res.Error += fmt.Sprintf("Fail to record the artifacts: %s\n", err.Error())
+		return false
+	}
+	return true
+}
+
+// runs/{id}/artifacts: the list, or all of them in a
+// tar.gz, runs/{id}/artifacts/{name}: a single one
+func (t *TaskServer) runs(w http.ResponseWriter, r *http.Request) {
+
+	if ok := checkMethod(MethodArtifacts, w, r); !ok {
+		return
+	}
+
+	if t.artifacts == nil {
+		writeError(w, "Artifacts not enabled", true, http.StatusNotFound)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, APIRuns), "/", 3)
+	if len(parts) < 2 || parts[1] != APIArtifacts || !isValidID(parts[0]) {
+		writeError(w, "URI not valid", true, http.StatusBadRequest)
+		return
+	}
+	runID := parts[0]
+
+	artifacts, err := t.artifacts.manifest(runID)
+	if err != nil {
+		writeError(w, fmt.Sprintf("Artifacts of %s not found", runID), true, http.StatusNotFound)
+		return
+	}
+
+	format := r.URL.Query().Get(QueryFormat)
+	switch {
+	case len(parts) == 3:
+		t.artifacts.serveFile(w, runID, parts[2], artifacts)
+	case format == FormatTarGz:
+		t.artifacts.serveBundle(w, runID, artifacts)
+	case format != "":
+		writeError(w, "Invalid format", true, http.StatusBadRequest)
+	default:
+		encodeWithError(w, StatusArtifacts, req.ListArtifactsResponse{
+			ID:        runID,
+			Artifacts: artifacts,
+		})
+	}
+}
+
+// serveFile writes the artifact name of the run id.
+func (s *artifactStore) serveFile(w http.ResponseWriter, id, name string,
+	artifacts []task.Artifact) {
+
+	found := false
+	for _, artifact := range artifacts {
+		if artifact.Name == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		writeError(w, fmt.Sprintf("Artifact %s not found", name), true, http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(path.Join(s.filesDir(id), name))
+	if err != nil {
+		writeError(w, fmt.Sprintf("Artifact %s not found", name), true, http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		writeError(w, err.Error(), true, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", path.Base(name)))
+	w.WriteHeader(StatusArtifacts)
+	if _, err = io.Copy(w, file); err != nil {
+		log.Printf("Write error: %s\n", err.Error())
+	}
+}
+
+// serveBundle writes all the artifacts of the run id in a tar.gz.
+func (s *artifactStore) serveBundle(w http.ResponseWriter, id string,
+	artifacts []task.Artifact) {
+
+	w.Header().Set("Content-type", "application/gzip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", id+".tar.gz"))
+	w.WriteHeader(StatusArtifacts)
+
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+	err := func() error {
+		for _, artifact := range artifacts {
+			file, err := os.Open(path.Join(s.filesDir(id), artifact.Name))
+			if err != nil {
+				return err
+			}
+			info, err := file.Stat()
+			if err == nil {
+				err = archive.WriteHeader(&tar.Header{
+					Name:    artifact.Name,
+					Mode:    0644,
+					Size:    info.Size(),
+					ModTime: info.ModTime(),
+				})
+			}
+			if err == nil {
+				_, err = io.Copy(archive, file)
+			}
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+		if err := archive.Close(); err != nil {
+			return err
+		}
+		return compressed.Close()
+	}()
+	// too late for a status
+	if err != nil {
+		log.Printf("Write error: %s\n", err.Error())
+	}
+}
+
+// agents/artifact, an artifact of the attempt
+func (t *TaskServer) agentArtifact(w http.ResponseWriter, r *http.Request) {
+
+	if ok := checkMethod(MethodAgentArtifact, w, r); !ok || !t.checkAgent(w, r) {
+		return
+	}
+
+	q := r.URL.Query()
+	assigned := t.agents.assigned(q.Get("agent"), q.Get("job"))
+	if assigned == nil {
+		writeError(w, "Job not assigned", true, http.StatusNotFound)
+		return
+	}
+	if t.artifacts == nil {
+		w.WriteHeader(StatusAgentArtifact)
+		return
+	}
+
+	left := t.artifacts.maxSize - t.agents.artifactSize(assigned)
+	if left <= 0 {
+		writeError(w, task.ErrArtifactsTooLarge.Error(), true, http.StatusRequestEntityTooLarge)
+		return
+	}
+	artifact, err := t.artifacts.save(assigned.job.id, q.Get("name"), r.Body, left)
+	switch {
+	case err == task.ErrArtifactsTooLarge:
+		writeError(w, err.Error(), true, http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		writeError(w, err.Error(), true, http.StatusBadRequest)
+		return
+	}
+	t.agents.addArtifact(assigned, artifact)
+	w.WriteHeader(StatusAgentArtifact)
+}
@@ -0,0 +1,99 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/nbena/gotask/pkg/req"
+)
+
+var upgrader = websocket.Upgrader{}
+
+// attach connects a WebSocket to the terminal of a running
+// long task: the binary messages are its input and output,
+// the text messages are req.AttachControl.
+func (t *TaskServer) attach(w http.ResponseWriter, r *http.Request) {
+
+	if ok := checkMethod(MethodAttach, w, r); !ok {
+		return
+	}
+
+	taskID := r.URL.Query().Get("id")
+	if taskID == "" {
+		writeError(w, "URI not valid", true, http.StatusBadRequest)
+		return
+	}
+
+	t.pendingTasks.RLock()
+	taskInfo, ok := t.pendingTasks.taskMap[taskID]
+	t.pendingTasks.RUnlock()
+	if !ok {
+		writeError(w, fmt.Sprintf("Task %s not running", taskID), true, http.StatusNotFound)
+		return
+	}
+	if taskInfo.Terminal == nil {
+		writeError(w, fmt.Sprintf("Task %s has no terminal", taskID), true, http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied
+		log.Printf("Error in attach: %s\n", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	terminal := taskInfo.Terminal
+	output, detach := terminal.Attach()
+	defer detach()
+
+	// input
+	go func() {
+		for {
+			kind, data, err := conn.ReadMessage()
+			if err != nil {
+				detach()
+				return
+			}
+			switch kind {
+			case websocket.BinaryMessage:
+				err = terminal.Input(data)
+			case websocket.TextMessage:
+				var control req.AttachControl
+				if err = json.Unmarshal(data, &control); err == nil &&
+					control.Type == req.AttachResize {
+					err = terminal.Resize(control.Rows, control.Cols)
+				}
+			}
+			if err != nil {
+				log.Printf("Error in attach input: %s\n", err.Error())
+			}
+		}
+	}()
+
+	// output, till the process ends or the client goes
+	for data := range output {
+		if err = conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			return
+		}
+	}
+	conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
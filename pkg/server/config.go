@@ -16,6 +16,9 @@ package server
 import (
 	"encoding/json"
 	"os"
+	"time"
+
+	"github.com/nbena/gotask/pkg/task"
 )
 
 const (
@@ -23,6 +26,24 @@ const (
 	DefaultAddr = "127.0.0.1"
 	// DefaultPort is the default listening port of the server.
 	DefaultPort = 7667
+	// DefaultMaxOutputSize is the default limit to the bytes
+	// of stdout and of stderr kept in memory for a run.
+	DefaultMaxOutputSize = 1024 * 1024
+	// DefaultMaxInputSize is the default limit to
+	// the input of a run.
+	DefaultMaxInputSize = 10 * 1024 * 1024
+	// DefaultPriorityAging is the default time after which
+	// the priority of a queued task grows by 1.
+	DefaultPriorityAging = task.Duration(time.Minute)
+	// DefaultDrainTimeout is the default time the shutdown
+	// waits for the running tasks before killing them.
+	DefaultDrainTimeout = task.Duration(30 * time.Second)
+	// DefaultAgentTimeout is the default time after which
+	// an agent not heard from is dead.
+	DefaultAgentTimeout = task.Duration(30 * time.Second)
+	// DefaultMaxArtifactSize is the default limit to
+	// the bytes of the artifacts of a run.
+	DefaultMaxArtifactSize = 100 * 1024 * 1024
 )
 
 // Config is the configuration used by the server.
@@ -38,6 +59,85 @@ type Config struct {
 
 	LogRequests bool `json:"logRequests"`
 
+	// the token required by the admin-only endpoints,
+	// if empty these endpoints are disabled
+	AdminToken string `json:"adminToken"`
+
+	// the encrypted secrets store, the key is read
+	// from SecretsKeyFile or derived from SecretsPassphrase
+	SecretsFile       string `json:"secretsFile"`
+	SecretsKeyFile    string `json:"secretsKeyFile"`
+	SecretsPassphrase string `json:"secretsPassphrase"`
+
+	// the bytes of stdout and of stderr kept in memory
+	// for a run, if 0 DefaultMaxOutputSize is used
+	MaxOutputSize int64 `json:"maxOutputSize"`
+	// if not empty, the full output of every run
+	// is written here and available from /logs
+	LogDir string `json:"logDir"`
+	// the bytes of the input of a run, if 0
+	// DefaultMaxInputSize is used
+	MaxInputSize int64 `json:"maxInputSize"`
+
+	// the most tasks running at the same time,
+	// the others are queued, 0 means no limit
+	MaxConcurrent int `json:"maxConcurrent"`
+	// the most queued tasks, then the server
+	// replies 429, 0 means no limit
+	MaxQueued int `json:"maxQueued"`
+	// the priority of a queued task grows by 1 every
+	// PriorityAging, if 0 DefaultPriorityAging is used,
+	// if negative it never grows
+	PriorityAging task.Duration `json:"priorityAging"`
+
+	// the tokens of the callers, by name: the queued tasks of
+	// different callers take turns, the admin is a caller too
+	Callers map[string]string `json:"callers"`
+
+	// how long the shutdown waits for the running tasks
+	// before killing them, if 0 DefaultDrainTimeout is
+	// used, if negative they're killed at once
+	DrainTimeout task.Duration `json:"drainTimeout"`
+	// if not empty, the final state of the runs not yet
+	// polled is written here on shutdown and read on start
+	StateFile string `json:"stateFile"`
+
+	// a cgroup v2 delegated to the server, needed by the
+	// tasks with cgroup limits: every run of theirs has a
+	// cgroup in it
+	CgroupDir string `json:"cgroupDir"`
+
+	// the users and the groups, by name or id, the tasks
+	// may run as, a task with another User or Group is
+	// refused
+	AllowedUsers  []string `json:"allowedUsers"`
+	AllowedGroups []string `json:"allowedGroups"`
+
+	// which vars of the server env the tasks have, before
+	// their own policy, if nil they have all of them
+	EnvPolicy *task.EnvPolicy `json:"envPolicy"`
+
+	// the token of the agents, the tasks with Labels are run by
+	// them, if empty no agent can register and these tasks are
+	// refused. The runs on the agents count for MaxConcurrent.
+	AgentToken string `json:"agentToken"`
+	// an agent not heard from for AgentTimeout is dead, its runs
+	// go back to the queue, if 0 DefaultAgentTimeout is used
+	AgentTimeout task.Duration `json:"agentTimeout"`
+
+	// if not empty, the Artifacts of every run are kept
+	// here and available from /runs/{id}/artifacts
+	ArtifactDir string `json:"artifactDir"`
+	// the bytes of the artifacts of a run, if 0
+	// DefaultMaxArtifactSize is used
+	MaxArtifactSize int64 `json:"maxArtifactSize"`
+	// the artifacts are removed after ArtifactRetention,
+	// if 0 they're kept
+	ArtifactRetention task.Duration `json:"artifactRetention"`
+	// only the artifacts of the last MaxArtifactRuns
+	// runs are kept, 0 means no limit
+	MaxArtifactRuns int `json:"maxArtifactRuns"`
+
 	InternalChanSize int `json:"internalChanSize"`
 }
 
@@ -46,6 +146,18 @@ type Config struct {
 type RuntimeConfig struct {
 	taskFilePath string
 	logRequests  bool
+	adminToken   string
+	maxOutput    int64
+	logDir       string
+	maxInput     int64
+	callers      map[string]string
+	drainTimeout time.Duration
+	stateFile    string
+	cgroupDir    string
+	users        []string
+	groups       []string
+	envPolicy    *task.EnvPolicy
+	agentToken   string
 }
 
 // ReadConfig tries to read config from a json file.
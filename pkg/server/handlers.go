@@ -16,8 +16,11 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 
 	"github.com/nbena/gotask/pkg/req"
 	"github.com/nbena/gotask/pkg/task"
@@ -63,13 +66,31 @@ func (t *TaskServer) execute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	var req req.ExecuteMessageRequest
-	if err := decoder.Decode(&req); err != nil {
-		writeError(w, err.Error(), false, http.StatusInternalServerError)
+	caller, ok := t.caller(r)
+	if !ok {
+		writeError(w, "Unknown token", true, http.StatusForbidden)
 		return
 	}
 
+	// with ?task=NAME the body is the input
+	// of the run, otherwise the request
+	var req req.ExecuteMessageRequest
+	streamed := r.URL.Query().Get(QueryTask)
+	if streamed != "" {
+		req.TaskName = streamed
+	} else {
+		// room for the base64 of the input
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*t.config.maxInput+maxRequestSize))
+		if err := decoder.Decode(&req); err != nil {
+			writeError(w, err.Error(), false, http.StatusInternalServerError)
+			return
+		}
+		if int64(len(req.Input)+len(req.InputData)) > t.config.maxInput {
+			writeError(w, "Input too large", true, http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
 	// now looking for the task in the map
 	toRun, ok := t.taskMap.Load(req.TaskName)
 	if !ok {
@@ -80,25 +101,127 @@ func (t *TaskServer) execute(w http.ResponseWriter, r *http.Request) {
 
 	taskToRun := toRun.(task.Task)
 
-	// now run the fucking task.
-	runtimeTask, err := taskToRun.Run()
+	matrix := taskToRun.Matrix
+	if req.Matrix != nil {
+		matrix = req.Matrix
+	}
+	if matrix != nil && streamed != "" {
+		// every run would read it
+		writeError(w, "A matrix run can't stream its input", true, http.StatusBadRequest)
+		return
+	}
+
+	// the ID is given before running, so that
+	// the templates can use it
+	id := uniqueID2()
+
+	opts := t.runOptions(id, req.Params)
+	switch {
+	case streamed != "":
+		// the run may wait in the queue or be tried
+		// again, the request is not there anymore
+		var err error
+		if opts.InputFile, err = spoolInput(r.Body, t.config.maxInput); err != nil {
+			status := http.StatusInternalServerError
+			if err == errInputTooLarge {
+				status = http.StatusRequestEntityTooLarge
+			}
+			writeError(w, err.Error(), true, status)
+			return
+		}
+	case req.InputData != nil:
+		opts.Input = req.InputData
+	case req.Input != "":
+		opts.Input = []byte(req.Input)
+	}
+
+	if matrix != nil {
+		t.executeMatrix(w, taskToRun, matrix, opts, caller, req.Priority)
+		return
+	}
+
+	// now prepare the fucking task, it's
+	// started when there's room in the queue
+	runtimeTask, err := t.prepareRun(&taskToRun, opts)
 	if err != nil {
+		removeInput(opts)
 		writeError(w, fmt.Sprintf("Running error: %s", err.Error()),
-			false, http.StatusInternalServerError)
+			false, runErrorStatus(err))
 		return
 	}
 
+	queued := newJob(id, taskToRun, opts, runtimeTask)
+	queued.caller = caller
+	if req.Priority != nil {
+		queued.priority = *req.Priority
+	}
+
 	var msg interface{}
 
 	if taskToRun.Long {
-		// THE WAITING GOROUTINE is not started till
-		// you poll for it
-		msg = t.handleExecuteLongTask(*runtimeTask)
+		msg, err = t.handleExecuteLongTask(queued)
+	} else {
+		msg, err = t.handleExecuteShortTask(queued, r.Context())
+	}
+	t.writeExecute(w, msg, err)
+}
+
+// writeExecute writes the response to /exec.
+func (t *TaskServer) writeExecute(w http.ResponseWriter, msg interface{}, err error) {
+	switch {
+	case err == errQueueFull:
+		writeError(w, err.Error(), true, http.StatusTooManyRequests)
+	case err == errShuttingDown:
+		writeError(w, err.Error(), true, http.StatusServiceUnavailable)
+	case err != nil:
+		writeError(w, fmt.Sprintf("Running error: %s", err.Error()),
+			false, http.StatusInternalServerError)
+	default:
+		encodeWithError(w, StatusExecute, msg)
+	}
+}
+
+// validate
+func (t *TaskServer) validate(w http.ResponseWriter, r *http.Request) {
+
+	if ok := checkMethod(MethodValidate, w, r); !ok {
+		return
+	}
+
+	var validateReq req.ValidateRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&validateReq); err != nil {
+		writeError(w, err.Error(), true, http.StatusBadRequest)
+		return
+	}
+
+	var toValidate task.Task
+	if validateReq.Task != nil {
+		toValidate = *validateReq.Task
+	} else {
+		stored, ok := t.taskMap.Load(validateReq.TaskName)
+		if !ok {
+			writeError(w, fmt.Sprintf("Task %s not found", validateReq.TaskName),
+				true, http.StatusNotFound)
+			return
+		}
+		toValidate = stored.(task.Task)
+	}
+
+	msg := req.ValidateResponse{}
+	err := t.checkIdentity(&toValidate)
+	var command []string
+	if err == nil {
+		command, err = toValidate.Validate(t.runOptions(uniqueID2(), validateReq.Params))
+	}
+	if err != nil {
+		msg.Error = err.Error()
 	} else {
-		msg = t.handleExecuteShortTask(*runtimeTask)
+		msg.Valid = true
+		msg.Command = command
 	}
 
-	encodeWithError(w, StatusExecute, msg)
+	encodeWithError(w, StatusValidate, msg)
 }
 
 // poll
@@ -115,6 +238,28 @@ func (t *TaskServer) poll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the parent of the runs of a matrix, forgotten
+	// once polled after the end of its runs
+	if parent := t.matrices.get(taskID); parent != nil {
+		msg, done := t.matrixStatus(parent)
+		if done {
+			t.matrices.remove(taskID)
+		}
+		encodeWithError(w, StatusPoll, msg)
+		return
+	}
+
+	// waiting for its turn, or just started
+	// and not yet in the pending ones
+	if status, position := t.queue.state(taskID); status != "" {
+		encodeWithError(w, StatusPoll, &req.PollStatusInProgressResponse{
+			ID:       taskID,
+			Status:   status,
+			Position: position,
+		})
+		return
+	}
+
 	var taskInfo task.RuntimeTaskInfo
 	var ok, inPending bool
 
@@ -153,6 +298,148 @@ func (t *TaskServer) poll(w http.ResponseWriter, r *http.Request) {
 	encodeWithError(w, StatusPoll, msg)
 }
 
+// cancel
+func (t *TaskServer) cancel(w http.ResponseWriter, r *http.Request) {
+
+	if ok := checkMethod(MethodCancel, w, r); !ok {
+		return
+	}
+
+	taskID := r.URL.Query().Get("id")
+	if taskID == "" {
+		writeError(w, "URI not valid", true, http.StatusBadRequest)
+		return
+	}
+
+	// every run of a matrix
+	if parent := t.matrices.get(taskID); parent != nil {
+		t.stopMatrix(parent, task.KillCancel, "Cancelled while queued")
+		w.WriteHeader(StatusCancel)
+		return
+	}
+
+	// a queued task is never started
+	if queued := t.queue.remove(taskID); queued != nil {
+		t.completeJob(queued, "Cancelled while queued")
+		w.WriteHeader(StatusCancel)
+		return
+	}
+
+	// no more attempts, the processes of the
+	// current one are killed
+	if running := t.queue.runningJob(taskID); running != nil {
+		if err := running.kill(task.KillCancel); err != nil {
+			log.Printf("Error in kill %s: %s\n", taskID, err.Error())
+		}
+		w.WriteHeader(StatusCancel)
+		return
+	}
+
+	t.pendingTasks.RLock()
+	taskInfo, ok := t.pendingTasks.taskMap[taskID]
+	t.pendingTasks.RUnlock()
+	if !ok {
+		writeError(w, fmt.Sprintf("Task %s not running", taskID), true, http.StatusNotFound)
+		return
+	}
+
+	// the task manager will move it to the
+	// completed ones as usual
+	if err := taskInfo.Kill(task.KillCancel); err != nil {
+		log.Printf("Error in kill %s: %s\n", taskID, err.Error())
+	}
+
+	w.WriteHeader(StatusCancel)
+}
+
+// queue
+func (t *TaskServer) listQueue(w http.ResponseWriter, r *http.Request) {
+
+	if ok := checkMethod(MethodQueue, w, r); !ok {
+		return
+	}
+
+	encodeWithError(w, StatusQueue, t.queue.list())
+}
+
+// logs
+func (t *TaskServer) logs(w http.ResponseWriter, r *http.Request) {
+
+	if ok := checkMethod(MethodLogs, w, r); !ok {
+		return
+	}
+
+	if t.config.logDir == "" {
+		writeError(w, "Logs not enabled", true, http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	taskID := q.Get("id")
+	stream := q.Get("stream")
+	if stream == "" {
+		stream = task.StreamStdout
+	}
+	switch stream {
+	case task.StreamStdout, task.StreamStderr, task.StreamMerged:
+	default:
+		writeError(w, "Invalid stream", true, http.StatusBadRequest)
+		return
+	}
+	if !isValidID(taskID) {
+		writeError(w, "URI not valid", true, http.StatusBadRequest)
+		return
+	}
+
+	var offset, limit int64
+	var err error
+	attempt := 1
+	if str := q.Get("attempt"); str != "" {
+		if attempt, err = strconv.Atoi(str); err != nil || attempt < 1 {
+			writeError(w, "Invalid attempt", true, http.StatusBadRequest)
+			return
+		}
+	}
+	if str := q.Get("offset"); str != "" {
+		if offset, err = strconv.ParseInt(str, 10, 64); err != nil || offset < 0 {
+			writeError(w, "Invalid offset", true, http.StatusBadRequest)
+			return
+		}
+	}
+	limit = DefaultMaxOutputSize
+	if str := q.Get("limit"); str != "" {
+		if limit, err = strconv.ParseInt(str, 10, 64); err != nil || limit <= 0 {
+			writeError(w, "Invalid limit", true, http.StatusBadRequest)
+			return
+		}
+	}
+
+	file, err := os.Open(task.LogPath(t.config.logDir, task.AttemptID(taskID, attempt), stream))
+	if err != nil {
+		writeError(w, fmt.Sprintf("Log of %s not found", taskID), true, http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		writeError(w, err.Error(), true, http.StatusInternalServerError)
+		return
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		writeError(w, err.Error(), true, http.StatusInternalServerError)
+		return
+	}
+
+	// the size lets the client know if there's more
+	w.Header().Set(HeaderLogSize, strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Content-type", "text/plain; charset=utf-8")
+	w.WriteHeader(StatusLogs)
+	if _, err = io.CopyN(w, file, limit); err != nil && err != io.EOF {
+		log.Printf("Write error: %s\n", err.Error())
+	}
+}
+
 // update
 func (t *TaskServer) addOrModify(w http.ResponseWriter, r *http.Request) {
 	if ok := checkMethod(MethodAddModify, w, r); !ok {
@@ -181,3 +468,55 @@ func (t *TaskServer) addOrModify(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(StatusAddModify)
 }
+
+// secrets, admin only
+func (t *TaskServer) manageSecrets(w http.ResponseWriter, r *http.Request) {
+	if ok := t.checkAdmin(w, r); !ok {
+		return
+	}
+
+	if t.secrets == nil {
+		writeError(w, "Secrets store not configured", true, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case MethodSecretList:
+		encodeWithError(w, StatusSecretList, req.ListSecretsResponse{
+			Secrets: t.secrets.List(),
+		})
+
+	case MethodSecretSet:
+		var setReq req.SetSecretRequest
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&setReq); err != nil {
+			writeError(w, err.Error(), true, http.StatusBadRequest)
+			return
+		}
+		if !task.IsValidSecretName(setReq.Name) {
+			writeError(w, fmt.Sprintf("Invalid secret name: %s", setReq.Name),
+				true, http.StatusBadRequest)
+			return
+		}
+		if err := t.secrets.Set(setReq.Name, setReq.Value); err != nil {
+			writeError(w, err.Error(), true, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(StatusSecretSet)
+
+	case MethodSecretDelete:
+		name := r.URL.Query().Get("name")
+		found, err := t.secrets.Delete(name)
+		if err != nil {
+			writeError(w, err.Error(), true, http.StatusInternalServerError)
+		} else if !found {
+			writeError(w, fmt.Sprintf("Secret %s not found", name), true, http.StatusNotFound)
+		} else {
+			w.WriteHeader(StatusSecretDelete)
+		}
+
+	default:
+		writeError(w, fmt.Sprintf("Method %s not implemented", r.Method),
+			true, http.StatusNotImplemented)
+	}
+}
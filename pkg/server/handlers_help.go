@@ -14,53 +14,134 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/nbena/gotask/pkg/req"
 	"github.com/nbena/gotask/pkg/task"
 )
 
-func (t *TaskServer) handleExecuteLongTask(runtimeTask task.RuntimeTaskInfo) *req.LongRunningTaskResponse {
-	// grabbing a new ID for this runtime task
-	// t.pendingTasks.Lock()
-	// log.Printf("Wait for lock")
-	// id := uniqueID(t.pendingTasks.taskMap)
-	id := uniqueID2()
-	t.pendingTasks.Lock()
-	t.pendingTasks.taskMap[id] = runtimeTask
-	t.pendingTasks.Unlock()
+func (t *TaskServer) handleExecuteLongTask(toRun *job) (*req.LongRunningTaskResponse, error) {
+	toRun.start = t.startLongJob
+	if _, err := t.queue.submit(toRun); err != nil {
+		removeInput(toRun.opts)
+		return nil, err
+	}
 
 	return &req.LongRunningTaskResponse{
-		Command: strings.Join(runtimeTask.Args, ""),
-		ID:      id,
-	}
+		Command: toRun.runtimeTask.Mask(strings.Join(toRun.runtimeTask.Args, "")),
+		ID:      toRun.id,
+	}, nil
 }
 
-func (t *TaskServer) handleExecuteShortTask(runtimeTask task.RuntimeTaskInfo) *req.ShortRunningTaskResponse {
-	// wait for command to finish
-	id := "not random ID"
-	done := make(chan *task.CmdDoneChan)
-	errChan := make(chan *task.CmdDoneChan)
-	runtimeTask.WaitPoll(id, done, errChan)
+// startLongJob is called by the queue when it's
+// the turn of a long task.
+func (t *TaskServer) startLongJob(toRun *job) {
+	go func() {
+		defer removeInput(toRun.opts)
 
-	msg := &req.ShortRunningTaskResponse{
-		Command: strings.Join(runtimeTask.Args, ""),
+		res, failed, err := t.runJob(toRun, func(runtimeTask task.RuntimeTaskInfo) {
+			t.pendingTasks.Lock()
+			t.pendingTasks.taskMap[toRun.id] = runtimeTask
+			t.pendingTasks.Unlock()
+		})
+		if err != nil {
+			t.completeJob(toRun, fmt.Sprintf("Running error: %s", err.Error()))
+			t.queue.done(toRun.id)
+			return
+		}
+
+		toRun.end(res, failed)
+		// the task manager moves it to the completed
+		// ones when done
+		if failed {
+			t.taskErrChan <- res
+		} else {
+			t.taskDoneChan <- res
+		}
+	}()
+}
+
+// completeJob stores a long task that has not been
+// run as completed with the given error.
+func (t *TaskServer) completeJob(toRun *job, errStr string) {
+	removeInput(toRun.opts)
+
+	runtimeTask := *toRun.runtimeTask
+	runtimeTask.Error = errStr
+
+	t.completedTasks.Lock()
+	t.completedTasks.taskMap[toRun.id] = runtimeTask
+	t.completedTasks.Unlock()
+
+	toRun.end(&task.CmdDoneChan{ID: toRun.id, Error: errStr}, true)
+}
+
+func (t *TaskServer) handleExecuteShortTask(toRun *job,
+	ctx context.Context) (*req.ShortRunningTaskResponse, error) {
+
+	defer removeInput(toRun.opts)
+
+	// wait for our turn
+	ready := make(chan struct{})
+	toRun.start = func(*job) {
+		close(ready)
+	}
+	if _, err := t.queue.submit(toRun); err != nil {
+		return nil, err
 	}
 
 	select {
-	case res := <-done:
-		if runtimeTask.ShowOutput {
-			msg.Output = res.Output
+	case <-ready:
+	case <-toRun.dropped:
+		// the server is shutting down
+		return nil, errShuttingDown
+	case <-ctx.Done():
+		// the client is gone
+		if t.queue.remove(toRun.id) != nil {
+			return nil, ctx.Err()
 		}
-	case res := <-errChan:
+		// too late, it has just been started
+		<-ready
+	}
+	defer t.queue.done(toRun.id)
+
+	// wait for command to finish
+	res, failed, err := t.runJob(toRun, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	runtimeTask := toRun.runtimeTask
+	msg := &req.ShortRunningTaskResponse{
+		Command: runtimeTask.Mask(strings.Join(runtimeTask.Args, "")),
+		RunID:   toRun.id,
+	}
+
+	if failed {
 		msg.Error = res.Error
+	} else {
+		msg.Skipped = res.Skipped
+	}
+
+	// the structured result is the output too
+	if runtimeTask.ShowOutput {
+		msg.Output = res.Output
+		msg.Structured = res.Structured
 	}
+	msg.Run = visibleResult(res.Result, runtimeTask.ShowOutput)
+	msg.Truncated = res.Truncated
+	msg.Attempts = visibleAttempts(res.Attempts, runtimeTask.ShowOutput)
 
-	return msg
+	return msg, nil
 }
 
 func (t *TaskServer) handleCompletedPoll(
@@ -68,30 +149,120 @@ func (t *TaskServer) handleCompletedPoll(
 	taskInfo task.RuntimeTaskInfo) *req.PollStatusCompletedResponse {
 	outStr := ""
 	errStr := ""
+	var structured json.RawMessage
 	if taskInfo.ShowOutput {
 		// if outStr, err = taskInfo.StdoutStr(); err != nil {
 		// 	errStr = fmt.Sprintf("Fail to get STOUT: %s", err.Error())
 		// 	log.Printf("Error in get STDOUT: %s", err.Error())
 		// }
 		outStr = taskInfo.Output
+		structured = taskInfo.Structured
 	}
 	errStr = taskInfo.Error
 
 	delete(t.completedTasks.taskMap, taskID)
 
+	status := req.PollStatusCompleted
+	if taskInfo.Skipped {
+		status = req.PollStatusSkipped
+	}
+
 	return &req.PollStatusCompletedResponse{
 		PollStatusInProgressResponse: req.PollStatusInProgressResponse{
 			ID:     taskID,
-			Status: req.PollStatusCompleted,
+			Status: status,
 		},
 		ShortRunningTaskResponse: req.ShortRunningTaskResponse{
-			Command: strings.Join(taskInfo.Args, ""),
-			Output:  outStr,
-			Error:   errStr,
+			Command:    taskInfo.Mask(strings.Join(taskInfo.Args, "")),
+			RunID:      taskID,
+			Output:     outStr,
+			Error:      errStr,
+			Skipped:    taskInfo.Skipped,
+			Run:        visibleResult(taskInfo.Result, taskInfo.ShowOutput),
+			Truncated:  taskInfo.Truncated,
+			Structured: structured,
+			Attempts:   visibleAttempts(taskInfo.Attempts, taskInfo.ShowOutput),
 		},
 	}
 }
 
+// errIdentity is returned when a task runs
+// as a user or a group not allowed.
+var errIdentity = errors.New("Identity not allowed")
+
+// errNoAgents is returned when a task with
+// Labels is run and agents are not enabled.
+var errNoAgents = errors.New("Agents not enabled")
+
+// prepareRun prepares a run of toRun with opts,
+// a task with labels is prepared by the agent.
+func (t *TaskServer) prepareRun(toRun *task.Task,
+	opts *task.RunOptions) (*task.RuntimeTaskInfo, error) {
+
+	switch {
+	case len(toRun.Labels) > 0 && t.config.agentToken == "":
+		return nil, errNoAgents
+	case len(toRun.Labels) > 0:
+		return remoteRuntimeTask(toRun), nil
+	}
+	if err := t.checkIdentity(toRun); err != nil {
+		return nil, err
+	}
+	return toRun.Prepare(opts)
+}
+
+// checkIdentity tells if toCheck may run as its
+// User and Group.
+func (t *TaskServer) checkIdentity(toCheck *task.Task) error {
+	identity, err := toCheck.Identity()
+	if err != nil || identity == nil {
+		return err
+	}
+	if toCheck.User != "" && !allowedID(t.config.users, identity.User, identity.UID) {
+		return errIdentity
+	}
+	if toCheck.Group != "" && !allowedID(t.config.groups, identity.Group, identity.GID) {
+		return errIdentity
+	}
+	return nil
+}
+
+// allowedID tells if the name or the id is in allowed.
+func allowedID(allowed []string, name string, id uint32) bool {
+	for _, item := range allowed {
+		if item == name || item == strconv.FormatUint(uint64(id), 10) {
+			return true
+		}
+	}
+	return false
+}
+
+// runErrorStatus returns the status for an error of Run:
+// a bad request if it's caused by the task definition.
+func runErrorStatus(err error) int {
+	switch err {
+	case errIdentity:
+		return http.StatusForbidden
+	case errNoAgents:
+		return http.StatusBadRequest
+	}
+	switch err.(type) {
+	case task.TemplateError, task.ExprError, task.VarReadingError:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// isValidID tells if id may have been generated by
+// uniqueID2, so that it's safe to use it in a path.
+func isValidID(id string) bool {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return false
+	}
+	return true
+}
+
 func encodeWithError(w http.ResponseWriter, okStatus int, input interface{}) {
 
 	data, err := json.Marshal(input)
@@ -131,3 +302,43 @@ func checkMethod(method string, w http.ResponseWriter, r *http.Request) bool {
 	}
 	return ok
 }
+
+// caller returns the name of the caller of r, empty
+// if anonymous, false if the token is unknown.
+func (t *TaskServer) caller(r *http.Request) (string, bool) {
+	header := r.Header.Get(AuthHeader)
+	if header == "" {
+		return "", true
+	}
+	if !strings.HasPrefix(header, AuthPrefix) {
+		return "", false
+	}
+
+	// compare all of them, in constant time
+	token := []byte(header[len(AuthPrefix):])
+	name, found := "", false
+	if t.config.adminToken != "" &&
+		subtle.ConstantTimeCompare(token, []byte(t.config.adminToken)) == 1 {
+		name, found = AdminCaller, true
+	}
+	for callerName, callerToken := range t.config.callers {
+		if callerToken != "" &&
+			subtle.ConstantTimeCompare(token, []byte(callerToken)) == 1 {
+			name, found = callerName, true
+		}
+	}
+	return name, found
+}
+
+// checkAdmin checks the request carries the admin token.
+func (t *TaskServer) checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := r.Header.Get(AuthHeader)
+	ok := t.config.adminToken != "" &&
+		strings.HasPrefix(token, AuthPrefix) &&
+		subtle.ConstantTimeCompare([]byte(token[len(AuthPrefix):]),
+			[]byte(t.config.adminToken)) == 1
+	if !ok {
+		writeError(w, "Admin token required", true, http.StatusForbidden)
+	}
+	return ok
+}
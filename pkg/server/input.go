@@ -0,0 +1,59 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/nbena/gotask/pkg/task"
+)
+
+// maxRequestSize is the limit to a request
+// without the input of the run.
+const maxRequestSize = 1024 * 1024
+
+// errInputTooLarge is returned when the input
+// of a run is over the limit.
+var errInputTooLarge = errors.New("Input too large")
+
+// spoolInput writes the input of a run to a temporary
+// file, that is removed by removeInput.
+func spoolInput(body io.Reader, limit int64) (string, error) {
+	file, err := ioutil.TempFile("", "gotask-input-")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// one more to know if it's over the limit
+	n, err := io.Copy(file, io.LimitReader(body, limit+1))
+	if err == nil && n > limit {
+		err = errInputTooLarge
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// removeInput removes the file written by spoolInput, if any.
+func removeInput(opts *task.RunOptions) {
+	if opts.InputFile != "" {
+		os.Remove(opts.InputFile)
+	}
+}
@@ -0,0 +1,242 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/nbena/gotask/pkg/req"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+// matrixRun is the parent of the runs of a matrix, one
+// per combination. It's polled and cancelled like a run.
+type matrixRun struct {
+	id       string
+	command  string
+	failFast bool
+
+	jobs []*job
+
+	// the status of the runs, by index,
+	// and how many have not ended yet
+	children []req.MatrixChild
+	left     int
+	failed   int
+	// the runs left are being stopped
+	stopping bool
+
+	mutex *sync.Mutex
+}
+
+// matrixRuns are the parents not polled
+// since the end of their runs.
+type matrixRuns struct {
+	runs map[string]*matrixRun
+	*sync.Mutex
+}
+
+func newMatrixRuns() *matrixRuns {
+	return &matrixRuns{
+		runs:  make(map[string]*matrixRun),
+		Mutex: &sync.Mutex{},
+	}
+}
+
+func (m *matrixRuns) add(parent *matrixRun) {
+	m.Lock()
+	m.runs[parent.id] = parent
+	m.Unlock()
+}
+
+func (m *matrixRuns) get(id string) *matrixRun {
+	m.Lock()
+	defer m.Unlock()
+	return m.runs[id]
+}
+
+func (m *matrixRuns) remove(id string) {
+	m.Lock()
+	delete(m.runs, id)
+	m.Unlock()
+}
+
+// executeMatrix runs definition once for each combination of
+// matrix, opts are the ones of the parent. The runs are long
+// ones, each with its own ID and its own queue turn.
+func (t *TaskServer) executeMatrix(w http.ResponseWriter, definition task.Task,
+	matrix *task.Matrix, opts *task.RunOptions, caller string, priority *int) {
+
+	combinations, err := matrix.Combinations()
+	if err != nil {
+		writeError(w, fmt.Sprintf("Running error: %s", err.Error()),
+			true, http.StatusBadRequest)
+		return
+	}
+
+	// the parent is polled, not the runs
+	definition.Long = true
+	definition.Matrix = nil
+
+	// every combination is prepared before any run is made,
+	// so that an invalid one leaves nothing behind
+	childOpts := make([]*task.RunOptions, len(combinations))
+	runtimeTasks := make([]*task.RuntimeTaskInfo, len(combinations))
+	for i, combination := range combinations {
+		childOpts[i] = t.runOptions(uniqueID2(), opts.Params)
+		childOpts[i].Input = opts.Input
+		childOpts[i].Vars = task.MatrixVars(combination)
+
+		if runtimeTasks[i], err = t.prepareRun(&definition, childOpts[i]); err != nil {
+			removeInput(opts)
+			writeError(w, fmt.Sprintf("Running error: %s", err.Error()),
+				false, runErrorStatus(err))
+			return
+		}
+	}
+
+	parent := &matrixRun{
+		id:       opts.ID,
+		command:  strings.Join(definition.Command, ""),
+		failFast: matrix.FailFast,
+		jobs:     make([]*job, len(combinations)),
+		children: make([]req.MatrixChild, len(combinations)),
+		left:     len(combinations),
+		mutex:    &sync.Mutex{},
+	}
+
+	for i, combination := range combinations {
+		id := childOpts[i].ID
+		child := newJob(id, definition, childOpts[i], runtimeTasks[i])
+		child.caller = caller
+		if priority != nil {
+			child.priority = *priority
+		}
+		child.start = t.startLongJob
+		index := i
+		child.ended = func(res *task.CmdDoneChan, failed bool) {
+			t.matrixRunEnded(parent, index, res, failed)
+		}
+
+		parent.jobs[i] = child
+		parent.children[i] = req.MatrixChild{
+			ID:     id,
+			Vars:   combination,
+			Status: req.PollStatusQueued,
+		}
+	}
+
+	// before submitting, a run may end at once
+	t.matrices.add(parent)
+	if err = t.queue.submitAll(parent.jobs); err != nil {
+		t.matrices.remove(parent.id)
+	}
+	t.writeExecute(w, &req.LongRunningTaskResponse{
+		Command: parent.command,
+		ID:      parent.id,
+	}, err)
+}
+
+// matrixRunEnded records the end of the run index of parent,
+// with fail-fast the first failed one stops the others.
+func (t *TaskServer) matrixRunEnded(parent *matrixRun, index int,
+	res *task.CmdDoneChan, failed bool) {
+
+	parent.mutex.Lock()
+	child := &parent.children[index]
+	child.Status = req.PollStatusCompleted
+	if res.Skipped {
+		child.Status = req.PollStatusSkipped
+	}
+	if failed {
+		child.Failed = true
+		child.Error = res.Error
+		parent.failed++
+	}
+	showOutput := parent.jobs[index].definition.ShowOutput
+	child.Run = visibleResult(res.Result, showOutput)
+	if showOutput {
+		child.Structured = res.Structured
+	}
+	parent.left--
+
+	stop := failed && parent.failFast && !parent.stopping
+	if stop {
+		parent.stopping = true
+	}
+	parent.mutex.Unlock()
+
+	if stop {
+		t.stopMatrix(parent, task.KillFailFast, "Cancelled by fail-fast")
+	}
+}
+
+// stopMatrix stops the runs of parent not ended yet: the queued
+// ones are never started, the running ones are killed for reason.
+func (t *TaskServer) stopMatrix(parent *matrixRun, reason, queuedReason string) {
+	for _, child := range parent.jobs {
+		if queued := t.queue.remove(child.id); queued != nil {
+			t.completeJob(queued, queuedReason)
+		} else if running := t.queue.runningJob(child.id); running != nil {
+			if err := running.kill(reason); err != nil {
+				log.Printf("Error in kill %s: %s\n", child.id, err.Error())
+			}
+		}
+	}
+}
+
+// matrixStatus returns the status of parent, it tells
+// if every run has ended.
+func (t *TaskServer) matrixStatus(parent *matrixRun) (*req.PollStatusCompletedResponse, bool) {
+	parent.mutex.Lock()
+	children := make([]req.MatrixChild, len(parent.children))
+	copy(children, parent.children)
+	left, failed := parent.left, parent.failed
+	parent.mutex.Unlock()
+
+	for i := range children {
+		if children[i].Status != req.PollStatusQueued {
+			continue
+		}
+		// not ended yet, started or just ending
+		children[i].Status = req.PollStatusInProgress
+		if status, _ := t.queue.state(children[i].ID); status != "" {
+			children[i].Status = status
+		}
+	}
+
+	msg := &req.PollStatusCompletedResponse{
+		PollStatusInProgressResponse: req.PollStatusInProgressResponse{
+			ID:     parent.id,
+			Status: req.PollStatusInProgress,
+		},
+		ShortRunningTaskResponse: req.ShortRunningTaskResponse{
+			Command: parent.command,
+			Matrix:  children,
+		},
+	}
+	if left > 0 {
+		return msg, false
+	}
+
+	msg.Status = req.PollStatusCompleted
+	if failed > 0 {
+		msg.Error = fmt.Sprintf("%d of %d runs failed", failed, len(children))
+	}
+	return msg, true
+}
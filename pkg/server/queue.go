@@ -0,0 +1,489 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nbena/gotask/pkg/req"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+var (
+	// errQueueFull is returned when a job can't be queued.
+	errQueueFull = errors.New("Too many queued jobs")
+	// errShuttingDown is returned when a job is
+	// submitted after the queue is closed.
+	errShuttingDown = errors.New("Server shutting down")
+)
+
+// job is a run of a task, waiting for its turn
+// or running.
+type job struct {
+	id   string
+	task string
+	// the most running jobs of the same task, 0 no limit
+	limit int
+
+	// higher goes first
+	priority int
+	// who asked for the run, empty if anonymous
+	caller string
+
+	// order of submission
+	seq       uint64
+	queuedAt  time.Time
+	startedAt time.Time
+
+	// the first attempt, prepared
+	runtimeTask *task.RuntimeTaskInfo
+	// to prepare the next attempts
+	definition task.Task
+	opts       *task.RunOptions
+
+	// called, without holding the lock of the queue,
+	// when it's the turn of the job
+	start func(*job)
+	// optional, called once a long job is over, with
+	// its result and if it failed
+	ended func(*task.CmdDoneChan, bool)
+
+	// closed when the job is cancelled
+	stopped  chan struct{}
+	stopOnce *sync.Once
+	// closed when the job is dropped by the
+	// queue, it's never started then
+	dropped chan struct{}
+
+	// the attempt running now, and why the job
+	// has been killed, under mutex
+	current    *task.RuntimeTaskInfo
+	killReason string
+	mutex      *sync.Mutex
+}
+
+func newJob(id string, definition task.Task, opts *task.RunOptions,
+	runtimeTask *task.RuntimeTaskInfo) *job {
+	return &job{
+		id:          id,
+		task:        definition.Name,
+		limit:       definition.MaxConcurrent,
+		priority:    definition.Priority,
+		runtimeTask: runtimeTask,
+		definition:  definition,
+		opts:        opts,
+		stopped:     make(chan struct{}),
+		stopOnce:    &sync.Once{},
+		dropped:     make(chan struct{}),
+		mutex:       &sync.Mutex{},
+	}
+}
+
+// stop tells the job it has been cancelled.
+func (j *job) stop() {
+	j.stopOnce.Do(func() {
+		close(j.stopped)
+	})
+}
+
+// end calls ended, if any.
+func (j *job) end(res *task.CmdDoneChan, failed bool) {
+	if j.ended != nil {
+		j.ended(res, failed)
+	}
+}
+
+// launched records the attempt just started, it's
+// killed at once if the job has been killed meanwhile.
+func (j *job) launched(runtimeTask *task.RuntimeTaskInfo) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.current = runtimeTask
+	if j.killReason != "" {
+		runtimeTask.Kill(j.killReason)
+	}
+}
+
+// kill stops the job and kills the processes
+// of its current attempt.
+func (j *job) kill(reason string) error {
+	j.stop()
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.killReason == "" {
+		j.killReason = reason
+	}
+	if j.current == nil {
+		return nil
+	}
+	return j.current.Kill(reason)
+}
+
+func (j *job) info(status string) req.JobInfo {
+	info := req.JobInfo{
+		ID:       j.id,
+		TaskName: j.task,
+		Status:   status,
+		Priority: j.priority,
+		Caller:   j.caller,
+		QueuedAt: j.queuedAt,
+	}
+	if !j.startedAt.IsZero() {
+		startedAt := j.startedAt
+		info.StartedAt = &startedAt
+	}
+	return info
+}
+
+// jobQueue limits the jobs running at the same time.
+// The others wait: the one with the highest priority goes
+// first, among the same priority the callers take turns
+// and the jobs of a caller are in FIFO order. The priority
+// of a waiting job grows by 1 every aging interval, so that
+// it's never starved.
+type jobQueue struct {
+	// 0 means no limit
+	maxRunning int
+	maxWaiting int
+	aging      time.Duration
+
+	waiting []*job
+	running map[string]*job
+	// running jobs by task
+	perTask map[string]int
+
+	seq uint64
+	// the turn in which a caller has been served last
+	served map[string]uint64
+	turn   uint64
+
+	// no more jobs are started, drained is
+	// closed once none is running
+	closed  bool
+	drained chan struct{}
+
+	*sync.Mutex
+}
+
+func newJobQueue(maxRunning, maxWaiting int, aging time.Duration) *jobQueue {
+	return &jobQueue{
+		maxRunning: maxRunning,
+		maxWaiting: maxWaiting,
+		aging:      aging,
+		running:    make(map[string]*job),
+		perTask:    make(map[string]int),
+		served:     make(map[string]uint64),
+		Mutex:      &sync.Mutex{},
+	}
+}
+
+// canRun tells if j may start now, the lock must be held.
+func (q *jobQueue) canRun(j *job) bool {
+	if q.maxRunning > 0 && len(q.running) >= q.maxRunning {
+		return false
+	}
+	return j.limit <= 0 || q.perTask[j.task] < j.limit
+}
+
+// take marks j as running, the lock must be held.
+func (q *jobQueue) take(j *job) {
+	j.startedAt = time.Now()
+	q.running[j.id] = j
+	q.perTask[j.task]++
+	q.turn++
+	q.served[j.caller] = q.turn
+}
+
+// effectivePriority is the priority of j grown by aging.
+func (q *jobQueue) effectivePriority(j *job, now time.Time) int {
+	if q.aging <= 0 {
+		return j.priority
+	}
+	return j.priority + int(now.Sub(j.queuedAt)/q.aging)
+}
+
+// before tells if a goes before b.
+func (q *jobQueue) before(a, b *job, now time.Time, served map[string]uint64) bool {
+	if pa, pb := q.effectivePriority(a, now), q.effectivePriority(b, now); pa != pb {
+		return pa > pb
+	}
+	// the caller waiting for more turns
+	if sa, sb := served[a.caller], served[b.caller]; sa != sb {
+		return sa < sb
+	}
+	return a.seq < b.seq
+}
+
+// next returns the index of the job of jobs that goes first
+// among the ones accepted by ok, -1 if none.
+func (q *jobQueue) next(jobs []*job, now time.Time,
+	served map[string]uint64, ok func(*job) bool) int {
+	best := -1
+	for i, j := range jobs {
+		if j == nil || !ok(j) {
+			continue
+		}
+		if best == -1 || q.before(j, jobs[best], now, served) {
+			best = i
+		}
+	}
+	return best
+}
+
+// submit starts j if there's room, otherwise it's queued.
+// It returns true if j has been queued.
+func (q *jobQueue) submit(j *job) (bool, error) {
+	j.queuedAt = time.Now()
+
+	q.Lock()
+	if q.closed {
+		q.Unlock()
+		return false, errShuttingDown
+	}
+	q.seq++
+	j.seq = q.seq
+	q.waiting = append(q.waiting, j)
+	toStart := q.schedule()
+
+	queued := true
+	for _, started := range toStart {
+		if started == j {
+			queued = false
+		}
+	}
+	if queued && q.maxWaiting > 0 && len(q.waiting) > q.maxWaiting {
+		q.waiting = q.waiting[:len(q.waiting)-1]
+		q.Unlock()
+		return false, errQueueFull
+	}
+	q.Unlock()
+
+	for _, started := range toStart {
+		started.start(started)
+	}
+	return queued, nil
+}
+
+// submitAll is submit for jobs that go together, either all of
+// them are accepted or none is. Only the ones that can't start
+// count for maxWaiting, the limits of their tasks aside.
+func (q *jobQueue) submitAll(jobs []*job) error {
+	now := time.Now()
+
+	q.Lock()
+	if q.closed {
+		q.Unlock()
+		return errShuttingDown
+	}
+	if q.maxWaiting > 0 {
+		free := len(jobs)
+		if q.maxRunning > 0 {
+			free = q.maxRunning - len(q.running)
+		}
+		if len(q.waiting)+len(jobs)-free > q.maxWaiting {
+			q.Unlock()
+			return errQueueFull
+		}
+	}
+	for _, j := range jobs {
+		j.queuedAt = now
+		q.seq++
+		j.seq = q.seq
+		q.waiting = append(q.waiting, j)
+	}
+	toStart := q.schedule()
+	q.Unlock()
+
+	for _, started := range toStart {
+		started.start(started)
+	}
+	return nil
+}
+
+// done tells the queue the job id is over,
+// the waiting jobs that now can run are started.
+func (q *jobQueue) done(id string) {
+	q.Lock()
+	j, ok := q.running[id]
+	if ok {
+		delete(q.running, id)
+		if q.perTask[j.task]--; q.perTask[j.task] <= 0 {
+			delete(q.perTask, j.task)
+		}
+	}
+	q.checkDrained()
+	toStart := q.schedule()
+	q.Unlock()
+
+	for _, j := range toStart {
+		j.start(j)
+	}
+}
+
+// schedule takes the waiting jobs that can run, in their
+// order: a job over the limit of its task doesn't stop
+// the others. The lock must be held.
+func (q *jobQueue) schedule() []*job {
+	var toStart []*job
+	if q.closed {
+		return nil
+	}
+	now := time.Now()
+	for {
+		i := q.next(q.waiting, now, q.served, q.canRun)
+		if i == -1 {
+			break
+		}
+		q.take(q.waiting[i])
+		toStart = append(toStart, q.waiting[i])
+		q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+	}
+	return toStart
+}
+
+// ordered returns the waiting jobs in the order they would
+// go if there were no limits. The lock must be held.
+func (q *jobQueue) ordered() []*job {
+	served := make(map[string]uint64, len(q.served))
+	for caller, turn := range q.served {
+		served[caller] = turn
+	}
+	turn := q.turn
+
+	now := time.Now()
+	waiting := append([]*job(nil), q.waiting...)
+	ordered := make([]*job, 0, len(waiting))
+	all := func(*job) bool {
+		return true
+	}
+	for len(ordered) < len(waiting) {
+		i := q.next(waiting, now, served, all)
+		ordered = append(ordered, waiting[i])
+		turn++
+		served[waiting[i].caller] = turn
+		waiting[i] = nil
+	}
+	return ordered
+}
+
+// close stops starting jobs: the waiting ones are dropped
+// and returned, with a channel closed once no job is running.
+func (q *jobQueue) close() ([]*job, <-chan struct{}) {
+	q.Lock()
+	defer q.Unlock()
+	if !q.closed {
+		q.closed = true
+		q.drained = make(chan struct{})
+		q.checkDrained()
+	}
+	waiting := q.waiting
+	q.waiting = nil
+	for _, j := range waiting {
+		close(j.dropped)
+	}
+	return waiting, q.drained
+}
+
+// checkDrained closes drained when the queue is closed
+// and no job is running. The lock must be held.
+func (q *jobQueue) checkDrained() {
+	if !q.closed || len(q.running) > 0 {
+		return
+	}
+	select {
+	case <-q.drained:
+	default:
+		close(q.drained)
+	}
+}
+
+// killRunning kills the running jobs with reason.
+func (q *jobQueue) killRunning(reason string) {
+	q.Lock()
+	running := make([]*job, 0, len(q.running))
+	for _, j := range q.running {
+		running = append(running, j)
+	}
+	q.Unlock()
+
+	for _, j := range running {
+		if err := j.kill(reason); err != nil {
+			log.Printf("Error in kill %s: %s\n", j.id, err.Error())
+		}
+	}
+}
+
+// runningJob returns the job id if it's running.
+func (q *jobQueue) runningJob(id string) *job {
+	q.Lock()
+	defer q.Unlock()
+	return q.running[id]
+}
+
+// remove takes the job id out of the waiting ones,
+// it returns nil if the job is not waiting.
+func (q *jobQueue) remove(id string) *job {
+	q.Lock()
+	defer q.Unlock()
+	for i, j := range q.waiting {
+		if j.id == id {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return j
+		}
+	}
+	return nil
+}
+
+// state returns PollStatusQueued and the position, from 1,
+// if the job id is waiting, PollStatusInProgress if it's
+// running, otherwise an empty string.
+func (q *jobQueue) state(id string) (string, int) {
+	q.Lock()
+	defer q.Unlock()
+	if _, ok := q.running[id]; ok {
+		return req.PollStatusInProgress, 0
+	}
+	for i, j := range q.ordered() {
+		if j.id == id {
+			return req.PollStatusQueued, i + 1
+		}
+	}
+	return "", 0
+}
+
+// list describes the waiting and the running jobs.
+func (q *jobQueue) list() req.QueueResponse {
+	q.Lock()
+	defer q.Unlock()
+
+	msg := req.QueueResponse{
+		Waiting: make([]req.JobInfo, len(q.waiting)),
+		Running: make([]req.JobInfo, 0, len(q.running)),
+	}
+	for i, j := range q.ordered() {
+		msg.Waiting[i] = j.info(req.PollStatusQueued)
+	}
+	for _, j := range q.running {
+		msg.Running = append(msg.Running, j.info(req.PollStatusInProgress))
+	}
+	sort.Slice(msg.Running, func(i, k int) bool {
+		return msg.Running[i].StartedAt.Before(*msg.Running[k].StartedAt)
+	})
+	return msg
+}
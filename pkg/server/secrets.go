@@ -0,0 +1,251 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/nbena/gotask/pkg/req"
+)
+
+const (
+	secretKeySize  = 32
+	secretSaltSize = 16
+)
+
+// storedSecret is a secret as written on disk.
+type storedSecret struct {
+	// nonce and ciphertext
+	Data      []byte    `json:"data"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// secretFile is the on-disk format of the store.
+type secretFile struct {
+	// used to derive the key from a passphrase
+	Salt    []byte                  `json:"salt"`
+	Secrets map[string]storedSecret `json:"secrets"`
+}
+
+// secretStore keeps the secrets encrypted with AES-GCM,
+// they are decrypted only when a task needs them.
+type secretStore struct {
+	path string
+	aead cipher.AEAD
+	file secretFile
+	*sync.RWMutex
+}
+
+// readSecretKey reads a key file that contains either
+// the raw 32 bytes or their hex encoding.
+func readSecretKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == secretKeySize {
+		return data, nil
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != secretKeySize {
+		return nil, fmt.Errorf("Secret key file %s must contain %d bytes, raw or hex encoded",
+			path, secretKeySize)
+	}
+	return key, nil
+}
+
+// newSecretStore opens the store at path, creating it if needed.
+// The key is read from keyFile if not empty, otherwise it's
+// derived from passphrase.
+func newSecretStore(path, keyFile, passphrase string) (*secretStore, error) {
+	store := &secretStore{
+		path: path,
+		file: secretFile{
+			Secrets: make(map[string]storedSecret),
+		},
+		RWMutex: &sync.RWMutex{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err = json.Unmarshal(data, &store.file); err != nil {
+			return nil, err
+		}
+		if store.file.Secrets == nil {
+			store.file.Secrets = make(map[string]storedSecret)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if len(store.file.Salt) == 0 {
+		store.file.Salt = make([]byte, secretSaltSize)
+		if _, err = rand.Read(store.file.Salt); err != nil {
+			return nil, err
+		}
+	}
+
+	var key []byte
+	switch {
+	case keyFile != "":
+		key, err = readSecretKey(keyFile)
+	case passphrase != "":
+		key, err = scrypt.Key([]byte(passphrase), store.file.Salt,
+			1<<15, 8, 1, secretKeySize)
+	default:
+		err = errors.New("Secrets file given without key file or passphrase")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if store.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+
+	// check the key is the right one
+	for name, secret := range store.file.Secrets {
+		if _, err = store.decrypt(name, secret); err != nil {
+			return nil, fmt.Errorf("Cannot decrypt secret %s, wrong key?", name)
+		}
+	}
+
+	return store, nil
+}
+
+func (s *secretStore) encrypt(name, value string) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// the name is authenticated too, so a value
+	// can't be moved under another name
+	return s.aead.Seal(nonce, nonce, []byte(value), []byte(name)), nil
+}
+
+func (s *secretStore) decrypt(name string, secret storedSecret) (string, error) {
+	size := s.aead.NonceSize()
+	if len(secret.Data) < size {
+		return "", fmt.Errorf("Secret %s is corrupted", name)
+	}
+	plain, err := s.aead.Open(nil, secret.Data[:size], secret.Data[size:], []byte(name))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// update writes the secrets as changed by change, they are
+// served only once written: a failed write changes nothing.
+// It must be called with the lock held.
+func (s *secretStore) update(change func(secrets map[string]storedSecret)) error {
+	file := secretFile{
+		Salt:    s.file.Salt,
+		Secrets: make(map[string]storedSecret, len(s.file.Secrets)+1),
+	}
+	for name, secret := range s.file.Secrets {
+		file.Secrets[name] = secret
+	}
+	change(file.Secrets)
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.file = file
+	return nil
+}
+
+// Secret implements task.SecretSource.
+func (s *secretStore) Secret(name string) (string, error) {
+	s.RLock()
+	secret, ok := s.file.Secrets[name]
+	s.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("Secret %s not found", name)
+	}
+	return s.decrypt(name, secret)
+}
+
+// Set adds or rotates a secret.
+func (s *secretStore) Set(name, value string) error {
+	data, err := s.encrypt(name, value)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	return s.update(func(secrets map[string]storedSecret) {
+		secrets[name] = storedSecret{
+			Data:      data,
+			UpdatedAt: time.Now(),
+		}
+	})
+}
+
+// Delete removes a secret, returning false if it's not there.
+func (s *secretStore) Delete(name string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.file.Secrets[name]; !ok {
+		return false, nil
+	}
+	return true, s.update(func(secrets map[string]storedSecret) {
+		delete(secrets, name)
+	})
+}
+
+// List returns the secrets without their value.
+func (s *secretStore) List() []req.SecretInfo {
+	s.RLock()
+	defer s.RUnlock()
+	infos := make([]req.SecretInfo, 0, len(s.file.Secrets))
+	for name, secret := range s.file.Secrets {
+		infos = append(infos, req.SecretInfo{
+			Name:      name,
+			UpdatedAt: secret.UpdatedAt,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
@@ -0,0 +1,133 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/nbena/gotask/pkg/task"
+)
+
+// runRecord is the final state of a run, as saved in the
+// state file. Output and command are already masked.
+type runRecord struct {
+	ID         string          `json:"id"`
+	Command    string          `json:"command"`
+	ShowOutput bool            `json:"showOutput"`
+	Output     string          `json:"output"`
+	Error      string          `json:"error"`
+	Skipped    bool            `json:"skipped,omitempty"`
+	Result     *task.RunResult `json:"run,omitempty"`
+	Truncated  bool            `json:"truncated,omitempty"`
+	Attempts   []task.Attempt  `json:"attempts,omitempty"`
+	Structured json.RawMessage `json:"result,omitempty"`
+}
+
+func newRunRecord(id string, info task.RuntimeTaskInfo) runRecord {
+	record := runRecord{
+		ID:         id,
+		ShowOutput: info.ShowOutput,
+		Output:     info.Output,
+		Error:      info.Error,
+		Skipped:    info.Skipped,
+		Result:     info.Result,
+		Truncated:  info.Truncated,
+		Attempts:   info.Attempts,
+		Structured: info.Structured,
+	}
+	// what's never shown is not kept
+	if !info.ShowOutput {
+		record.Structured = nil
+		record.Attempts = visibleAttempts(info.Attempts, false)
+	}
+	if info.Cmd != nil {
+		record.Command = info.Mask(strings.Join(info.Args, ""))
+	}
+	return record
+}
+
+// runtimeTask returns the completed run of the record.
+func (r runRecord) runtimeTask() task.RuntimeTaskInfo {
+	return task.RuntimeTaskInfo{
+		Cmd:        &exec.Cmd{Args: []string{r.Command}},
+		ShowOutput: r.ShowOutput,
+		Output:     r.Output,
+		Error:      r.Error,
+		Skipped:    r.Skipped,
+		Result:     r.Result,
+		Truncated:  r.Truncated,
+		Attempts:   r.Attempts,
+		Structured: r.Structured,
+	}
+}
+
+// saveState writes the completed runs to the state file,
+// the runs still pending are saved with errStr.
+func (t *TaskServer) saveState(errStr string) error {
+	var records []runRecord
+
+	t.completedTasks.RLock()
+	for id, info := range t.completedTasks.taskMap {
+		records = append(records, newRunRecord(id, info))
+	}
+	t.completedTasks.RUnlock()
+
+	t.pendingTasks.RLock()
+	for id, info := range t.pendingTasks.taskMap {
+		record := newRunRecord(id, info)
+		record.Error = errStr
+		records = append(records, record)
+	}
+	t.pendingTasks.RUnlock()
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// never leave half a file
+	tmp := t.config.stateFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.config.stateFile)
+}
+
+// loadState reads the runs saved by saveState
+// as completed, a missing file is fine.
+func (t *TaskServer) loadState() error {
+	data, err := ioutil.ReadFile(t.config.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var records []runRecord
+	if err = json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+
+	t.completedTasks.Lock()
+	for _, record := range records {
+		t.completedTasks.taskMap[record.ID] = record.runtimeTask()
+	}
+	t.completedTasks.Unlock()
+	return nil
+}
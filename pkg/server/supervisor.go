@@ -0,0 +1,139 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nbena/gotask/pkg/task"
+)
+
+// runJob supervises a run: it starts the attempts of toRun till
+// one succeeds, one fails in a way that can't be retried or the
+// attempts are over. started is called with every attempt just
+// started. It returns the last attempt, if it failed, and the
+// error starting the first one.
+func (t *TaskServer) runJob(toRun *job,
+	started func(task.RuntimeTaskInfo)) (*task.CmdDoneChan, bool, error) {
+
+	policy := toRun.definition.Retry
+	runtimeTask := toRun.runtimeTask
+	var attempts []task.Attempt
+
+	for attempt := 1; ; attempt++ {
+		var res *task.CmdDoneChan
+		failed := true
+		if toRun.remote() {
+			// in progress while an agent runs it
+			if started != nil {
+				started(*runtimeTask)
+			}
+			res, failed = t.agents.run(toRun, attempt)
+			// missing artifacts fail the attempt
+			failed = !t.recordArtifacts(toRun, res) || failed
+		} else {
+			var err error
+			if attempt > 1 {
+				// vars, secrets and templates are read again
+				opts := *toRun.opts
+				opts.Attempt = attempt
+				runtimeTask, err = toRun.definition.Prepare(&opts)
+			}
+			if err == nil {
+				err = runtimeTask.Launch()
+			}
+
+			if err != nil {
+				if attempt == 1 {
+					return nil, true, err
+				}
+				res = &task.CmdDoneChan{
+					ID:    toRun.id,
+					Error: fmt.Sprintf("Running error: %s", err.Error()),
+				}
+			} else {
+				toRun.launched(runtimeTask)
+				if started != nil {
+					started(*runtimeTask)
+				}
+				res, failed = waitAttempt(toRun.id, runtimeTask)
+				// before the directory of the run is removed
+				failed = !t.collectArtifacts(toRun, runtimeTask, res) || failed
+				if err = runtimeTask.Cleanup(failed); err != nil {
+					log.Printf("Error in cleanup of %s: %s\n", toRun.id, err.Error())
+				}
+			}
+		}
+
+		if policy == nil {
+			return res, failed, nil
+		}
+		attempts = append(attempts, task.NewAttempt(res))
+		res.Attempts = attempts
+		if !policy.Retry(attempt, res, failed) {
+			return res, failed, nil
+		}
+
+		select {
+		case <-time.After(policy.Wait(attempt)):
+		case <-toRun.stopped:
+			// cancelled while waiting
+			return res, failed, nil
+		}
+	}
+}
+
+// waitAttempt waits for a started attempt, it
+// returns its result and if it failed.
+func waitAttempt(id string, runtimeTask *task.RuntimeTaskInfo) (*task.CmdDoneChan, bool) {
+	done := make(chan *task.CmdDoneChan)
+	errChan := make(chan *task.CmdDoneChan)
+	runtimeTask.WaitPoll(id, done, errChan)
+
+	select {
+	case res := <-done:
+		return res, false
+	case res := <-errChan:
+		return res, true
+	}
+}
+
+// visibleAttempts returns the attempts as shown
+// to the client.
+func visibleAttempts(attempts []task.Attempt, showOutput bool) []task.Attempt {
+	if showOutput || len(attempts) == 0 {
+		return attempts
+	}
+	visible := make([]task.Attempt, len(attempts))
+	for i, attempt := range attempts {
+		attempt.Output = ""
+		attempt.Structured = nil
+		attempt.Result = visibleResult(attempt.Result, showOutput)
+		visible[i] = attempt
+	}
+	return visible
+}
+
+// visibleResult returns result as it's shown to the
+// clients, without the env if the output is hidden.
+func visibleResult(result *task.RunResult, showOutput bool) *task.RunResult {
+	if showOutput || result == nil {
+		return result
+	}
+	visible := *result
+	visible.Env = nil
+	return &visible
+}
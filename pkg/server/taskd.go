@@ -14,6 +14,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -22,6 +23,7 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/nbena/gotask/pkg/task"
 )
@@ -32,19 +34,100 @@ const (
 	MethodExecute   = http.MethodPut
 	MethodPoll      = http.MethodGet
 	MethodAddModify = http.MethodPut
+	MethodValidate  = http.MethodPost
+	MethodCancel    = http.MethodPost
+	MethodLogs      = http.MethodGet
+	MethodQueue     = http.MethodGet
+	MethodAttach    = http.MethodGet
+
+	MethodSecretList   = http.MethodGet
+	MethodSecretSet    = http.MethodPut
+	MethodSecretDelete = http.MethodDelete
+
+	MethodAgents         = http.MethodGet
+	MethodAgentRegister  = http.MethodPost
+	MethodAgentHeartbeat = http.MethodPost
+	MethodAgentJobs      = http.MethodGet
+	MethodAgentOutput    = http.MethodPost
+	MethodAgentResult    = http.MethodPost
+	MethodAgentArtifact  = http.MethodPost
+
+	MethodArtifacts = http.MethodGet
 
 	StatusList      = http.StatusOK
 	StatusRefresh   = http.StatusNoContent
 	StatusExecute   = http.StatusOK
 	StatusPoll      = http.StatusOK
 	StatusAddModify = http.StatusNoContent
+	StatusValidate  = http.StatusOK
+	StatusCancel    = http.StatusNoContent
+	StatusLogs      = http.StatusOK
+	StatusQueue     = http.StatusOK
 	// StatusNotFound    = http.StatusNotFound
 
+	StatusSecretList   = http.StatusOK
+	StatusSecretSet    = http.StatusNoContent
+	StatusSecretDelete = http.StatusNoContent
+
+	StatusAgents         = http.StatusOK
+	StatusAgentRegister  = http.StatusOK
+	StatusAgentHeartbeat = http.StatusOK
+	StatusAgentJobs      = http.StatusOK
+	StatusAgentOutput    = http.StatusNoContent
+	StatusAgentResult    = http.StatusNoContent
+	StatusAgentArtifact  = http.StatusNoContent
+
+	StatusArtifacts = http.StatusOK
+
 	APIList      = "/list"
 	APIRefresh   = "/refresh"
 	APIExecute   = "/exec"
 	APIPoll      = "/poll"
 	APIAddModify = "/update"
+	APIValidate  = "/validate"
+	APICancel    = "/cancel"
+	APILogs      = "/logs"
+	APIQueue     = "/queue"
+	APIAttach    = "/attach"
+	APISecrets   = "/secrets"
+
+	APIAgents         = "/agents"
+	APIAgentRegister  = "/agents/register"
+	APIAgentHeartbeat = "/agents/heartbeat"
+	APIAgentJobs      = "/agents/jobs"
+	APIAgentOutput    = "/agents/output"
+	APIAgentResult    = "/agents/result"
+	APIAgentArtifact  = "/agents/artifact"
+
+	// APIRuns is followed by the ID of a run and
+	// by APIArtifacts: /runs/{id}/artifacts
+	APIRuns      = "/runs/"
+	APIArtifacts = "artifacts"
+
+	// AuthHeader is the header carrying the token,
+	// in the form 'Bearer <token>'.
+	AuthHeader = "Authorization"
+	// AuthPrefix is the prefix of the token in AuthHeader.
+	AuthPrefix = "Bearer "
+	// AdminCaller is the name of the caller
+	// using the admin token.
+	AdminCaller = "admin"
+
+	// HeaderLogSize is the header carrying the full
+	// size of a log returned by /logs.
+	HeaderLogSize = "X-Log-Size"
+
+	// QueryTask is the query parameter of /exec naming
+	// the task when the body is the input of the run.
+	QueryTask = "task"
+	// QueryFormat is the query parameter of the artifacts
+	// of a run: with FormatTarGz they're all in a tar.gz.
+	QueryFormat = "format"
+	FormatTarGz = "tar.gz"
+
+	// shutdownTimeout is how long the shutdown waits for
+	// the killed tasks and for the requests being served.
+	shutdownTimeout = 5 * time.Second
 )
 
 // TaskServer is the HTTP server
@@ -59,7 +142,23 @@ type TaskServer struct {
 
 	config *RuntimeConfig
 
+	// nil if not configured
+	secrets *secretStore
+
+	// limits the running tasks
+	queue *jobQueue
+
+	// the agents and the runs waiting for them
+	agents *agentPool
+
+	// nil if not configured
+	artifacts *artifactStore
+
+	// the parents of the matrix runs
+	matrices *matrixRuns
+
 	taskManagerCloseChan chan os.Signal
+	agentsCloseChan      chan struct{}
 	ServerCloseChan      chan os.Signal
 
 	listener net.Listener
@@ -104,13 +203,91 @@ func NewServer(config *Config) (*TaskServer, error) {
 		config: &RuntimeConfig{
 			taskFilePath: config.TaskFile,
 			logRequests:  config.LogRequests,
+			adminToken:   config.AdminToken,
+			maxOutput:    config.MaxOutputSize,
+			logDir:       config.LogDir,
+			maxInput:     config.MaxInputSize,
+			callers:      config.Callers,
+			drainTimeout: time.Duration(config.DrainTimeout),
+			stateFile:    config.StateFile,
+			cgroupDir:    config.CgroupDir,
+			users:        config.AllowedUsers,
+			groups:       config.AllowedGroups,
+			envPolicy:    config.EnvPolicy,
+			agentToken:   config.AgentToken,
 		},
+		queue: newJobQueue(config.MaxConcurrent, config.MaxQueued,
+			time.Duration(config.PriorityAging)),
+		agents:               newAgentPool(time.Duration(config.AgentTimeout), config.LogDir),
+		matrices:             newMatrixRuns(),
 		taskManagerCloseChan: make(chan os.Signal),
+		agentsCloseChan:      make(chan struct{}),
 		ServerCloseChan:      make(chan os.Signal),
 		listener:             listener,
 		// mux:                  http.NewServeMux(),
 	}
 
+	if config.PriorityAging == 0 {
+		server.queue.aging = time.Duration(DefaultPriorityAging)
+	}
+
+	if server.config.maxOutput == 0 {
+		server.config.maxOutput = DefaultMaxOutputSize
+	}
+	if server.config.maxInput == 0 {
+		server.config.maxInput = DefaultMaxInputSize
+	}
+	if server.config.drainTimeout == 0 {
+		server.config.drainTimeout = time.Duration(DefaultDrainTimeout)
+	}
+	if server.agents.timeout <= 0 {
+		server.agents.timeout = time.Duration(DefaultAgentTimeout)
+	}
+
+	if config.LogDir != "" {
+		if err = os.MkdirAll(config.LogDir, 0700); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	if err = config.EnvPolicy.Validate(); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	if config.CgroupDir != "" {
+		if err = task.EnableCgroup(config.CgroupDir); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	if config.StateFile != "" {
+		if err = server.loadState(); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	if config.ArtifactDir != "" {
+		server.artifacts, err = newArtifactStore(config.ArtifactDir, config.MaxArtifactSize,
+			time.Duration(config.ArtifactRetention), config.MaxArtifactRuns)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	if config.SecretsFile != "" {
+		server.secrets, err = newSecretStore(config.SecretsFile,
+			config.SecretsKeyFile, config.SecretsPassphrase)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc(APIRefresh, server.refresh)
 	mux.HandleFunc(APIList, server.list)
@@ -118,37 +295,128 @@ func NewServer(config *Config) (*TaskServer, error) {
 	mux.HandleFunc(APIPoll, server.poll)
 	// mux.HandleFunc("/add", server.add)
 	mux.HandleFunc(APIAddModify, server.addOrModify)
+	mux.HandleFunc(APIValidate, server.validate)
+	mux.HandleFunc(APICancel, server.cancel)
+	mux.HandleFunc(APILogs, server.logs)
+	mux.HandleFunc(APIQueue, server.listQueue)
+	mux.HandleFunc(APIAttach, server.attach)
+	mux.HandleFunc(APISecrets, server.manageSecrets)
+	mux.HandleFunc(APIAgents, server.listAgents)
+	mux.HandleFunc(APIAgentRegister, server.registerAgent)
+	mux.HandleFunc(APIAgentHeartbeat, server.agentHeartbeat)
+	mux.HandleFunc(APIAgentJobs, server.agentJobs)
+	mux.HandleFunc(APIAgentOutput, server.agentOutput)
+	mux.HandleFunc(APIAgentResult, server.agentResult)
+	mux.HandleFunc(APIAgentArtifact, server.agentArtifact)
+	mux.HandleFunc(APIRuns, server.runs)
 
 	server.httpServer = &http.Server{
 		Handler: mux,
 	}
 
-	signal.Notify(server.taskManagerCloseChan, syscall.SIGTERM, syscall.SIGSTOP, syscall.SIGINT)
-	signal.Notify(server.ServerCloseChan, syscall.SIGTERM, syscall.SIGSTOP, syscall.SIGINT)
+	// the task manager is stopped by the shutdown
+	signal.Notify(server.ServerCloseChan, syscall.SIGTERM, syscall.SIGINT)
 
 	return server, nil
 }
 
 // Run starts the server.
-// it's a blocking call.
+// it's a blocking call, it returns once the
+// server has been shut down.
 func (t *TaskServer) Run() {
 	go func() {
-		if err := t.httpServer.Serve(t.listener); err != nil {
+		err := t.httpServer.Serve(t.listener)
+		if err != nil && err != http.ErrServerClosed {
 			log.Printf("Error in listen: %s\n", err.Error())
-			t.taskManagerCloseChan <- syscall.SIGTERM
 			t.ServerCloseChan <- syscall.SIGTERM
 		}
 	}()
 	go func() {
 		t.taskManager()
 	}()
+	go func() {
+		t.agents.watch(t.agentsCloseChan)
+	}()
 
 	<-t.ServerCloseChan
+	t.shutdown()
+}
+
+// shutdown stops the server: the queued runs are dropped, the
+// running ones have the drain timeout to end, then they're
+// killed. The final states are saved and the requests being
+// served are completed.
+func (t *TaskServer) shutdown() {
+	// no more /exec
+	waiting, drained := t.queue.close()
+	for _, dropped := range waiting {
+		if dropped.definition.Long {
+			t.completeJob(dropped, "Cancelled by shutdown")
+		}
+	}
+
+	if !waitClosed(drained, t.config.drainTimeout) {
+		log.Printf("Killing the running tasks\n")
+		t.queue.killRunning(task.KillShutdown)
+		if !waitClosed(drained, shutdownTimeout) {
+			log.Printf("Some tasks are still running\n")
+		}
+	}
+
+	// every finished run has been moved by now
 	t.taskManagerCloseChan <- syscall.SIGTERM
-	t.httpServer.Close()
+	close(t.agentsCloseChan)
+
+	if t.config.stateFile != "" {
+		if err := t.saveState("Still running at shutdown"); err != nil {
+			log.Printf("Error in saving state: %s\n", err.Error())
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := t.httpServer.Shutdown(ctx); err != nil {
+		log.Printf("Error in shutdown: %s\n", err.Error())
+	}
 	t.listener.Close()
 }
 
+// waitClosed waits at most timeout for ch to be closed,
+// it tells if it has been.
+func waitClosed(ch <-chan struct{}, timeout time.Duration) bool {
+	if timeout <= 0 {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case <-ch:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// runOptions returns the options used to run a task.
+func (t *TaskServer) runOptions(id string, params map[string]string) *task.RunOptions {
+	opts := &task.RunOptions{
+		ID:        id,
+		Params:    params,
+		MaxOutput: t.config.maxOutput,
+		LogDir:    t.config.logDir,
+		CgroupDir: t.config.cgroupDir,
+		EnvPolicy: t.config.envPolicy,
+	}
+	// avoid a non-nil interface holding a nil pointer
+	if t.secrets != nil {
+		opts.Secrets = t.secrets
+	}
+	return opts
+}
+
 // type taskID struct {
 // 	task.Task
 // 	ID string
@@ -164,6 +432,10 @@ func (t *TaskServer) moveTasks(res *task.CmdDoneChan, unlockCompleted bool) task
 	// passing the results
 	old.Output = res.Output
 	old.Error = res.Error
+	old.Result = res.Result
+	old.Truncated = res.Truncated
+	old.Structured = res.Structured
+	old.Attempts = res.Attempts
 
 	// the move to the complete map
 	t.completedTasks.Lock()
@@ -179,7 +451,6 @@ func (t *TaskServer) moveTasks(res *task.CmdDoneChan, unlockCompleted bool) task
 
 // this manages the different running processes
 func (t *TaskServer) taskManager() {
-	// TODO shutdown
 	loop := true
 	for loop {
 		select {
@@ -187,10 +458,12 @@ func (t *TaskServer) taskManager() {
 			// ok the task is finished, we move it
 			// to the completed tasks map
 			t.moveTasks(res, true)
+			t.queue.done(res.ID)
 
 		case res := <-t.taskErrChan:
 
 			t.moveTasks(res, true)
+			t.queue.done(res.ID)
 			// we write the error to stderr
 			// old.Cmd.Stderr.Write([]byte("ERROR IN WAIT: " + errDesc[1]))
 		// exit
@@ -0,0 +1,184 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrArtifactsTooLarge is returned when the artifacts
+// of a run are over their limit.
+var ErrArtifactsTooLarge = errors.New("Artifacts too large")
+
+// Artifact is a file kept after a run.
+type Artifact struct {
+	// relative to the directory of the run
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// validArtifactName tells if name is a path
+// that stays in the directory it's relative to.
+func validArtifactName(name string) bool {
+	return name != "" && !path.IsAbs(name) && path.Clean(name) == name &&
+		name != ".." && !strings.HasPrefix(name, "../")
+}
+
+// validArtifactPattern tells if pattern is a glob
+// matching only in the directory of the run.
+func validArtifactPattern(pattern string) bool {
+	if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" {
+		return false
+	}
+	return validArtifactName(path.Clean(pattern))
+}
+
+// SaveArtifact writes src as the artifact name in dir, at most
+// limit bytes (<= 0 no limit), returning its description.
+func SaveArtifact(dir, name string, src io.Reader, limit int64) (*Artifact, error) {
+	if !validArtifactName(name) {
+		return nil, fmt.Errorf("Invalid artifact name: %s", name)
+	}
+	file := path.Join(dir, name)
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	out, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	if limit > 0 {
+		// one more to know it's over
+		src = io.LimitReader(src, limit+1)
+	}
+	size, err := io.Copy(io.MultiWriter(out, hash), src)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && limit > 0 && size > limit {
+		err = ErrArtifactsTooLarge
+	}
+	if err != nil {
+		os.Remove(file)
+		return nil, err
+	}
+
+	return &Artifact{
+		Name:   name,
+		Size:   size,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// artifactFiles returns the regular files matching the
+// patterns in dir, the matching directories are walked.
+// Nothing out of dir is taken, symlinks are not followed.
+func artifactFiles(dir string, patterns []string) ([]string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool)
+	for _, pattern := range patterns {
+		if !validArtifactPattern(pattern) {
+			return nil, fmt.Errorf("Invalid artifact pattern: %s", pattern)
+		}
+		matches, err := filepath.Glob(path.Join(root, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			// a symlinked directory on the way
+			real, err := filepath.EvalSymlinks(path.Dir(match))
+			if err != nil || (real != root && !strings.HasPrefix(real, root+"/")) {
+				continue
+			}
+			err = filepath.Walk(match, func(file string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.Mode().IsRegular() {
+					found[file[len(root)+1:]] = true
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	files := make([]string, 0, len(found))
+	for file := range found {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// CollectArtifacts copies the files of the ended run matching
+// the Artifacts of its task to dst, keeping their path relative
+// to the directory of the run. They are at most maxSize bytes
+// (<= 0 no limit), the ones copied are returned anyway.
+func (r *RuntimeTaskInfo) CollectArtifacts(dst string, maxSize int64) ([]Artifact, error) {
+	if len(r.artifacts) == 0 {
+		return nil, nil
+	}
+	files, err := artifactFiles(r.Dir, r.artifacts)
+	if err != nil {
+		return nil, err
+	}
+
+	var artifacts []Artifact
+	left := maxSize
+	for _, name := range files {
+		src, err := os.Open(path.Join(r.Dir, name))
+		if err != nil {
+			return artifacts, err
+		}
+		artifact, err := SaveArtifact(dst, name, src, left)
+		src.Close()
+		if err != nil {
+			return artifacts, err
+		}
+		artifacts = append(artifacts, *artifact)
+
+		if maxSize > 0 {
+			if left -= artifact.Size; left <= 0 && len(artifacts) < len(files) {
+				return artifacts, ErrArtifactsTooLarge
+			}
+		}
+	}
+	return artifacts, nil
+}
@@ -0,0 +1,145 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type artifactTestCase struct {
+	name      string
+	artifacts []string
+	maxSize   int64
+	// the names of the ones kept
+	expected []string
+	tooLarge bool
+}
+
+func (test *artifactTestCase) doTest(dir string, t *testing.T) {
+	toRun := Task{
+		Name:      test.name,
+		Command:   []string{"true"},
+		Dir:       dir,
+		Artifacts: test.artifacts,
+	}
+	runtimeTask, err := toRun.Prepare(nil)
+	if err != nil {
+		t.Fatalf("Fail to prepare %s: %s\n", test.name, err.Error())
+	}
+
+	dst, err := ioutil.TempDir("", "gotask-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	artifacts, err := runtimeTask.CollectArtifacts(dst, test.maxSize)
+	if (err == ErrArtifactsTooLarge) != test.tooLarge || (err != nil && !test.tooLarge) {
+		t.Errorf("Wrong error of %s: %v\n", test.name, err)
+	}
+
+	names := []string{}
+	for _, artifact := range artifacts {
+		names = append(names, artifact.Name)
+		data, err := ioutil.ReadFile(path.Join(dst, artifact.Name))
+		if err != nil || int64(len(data)) != artifact.Size {
+			t.Errorf("Wrong copy of %s in %s: %v\n", artifact.Name, test.name, err)
+		}
+	}
+	if !reflect.DeepEqual(names, test.expected) {
+		t.Errorf("Wrong artifacts of %s: %v, expected %v\n", test.name, names, test.expected)
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotask-artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = os.MkdirAll(path.Join(dir, "out/sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"out/a.txt":     "a\n",
+		"out/sub/b.txt": "bb\n",
+		"log.txt":       "hello\n",
+		"other.bin":     "binary",
+		VarFileName:     "",
+	} {
+		if err = ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// never followed
+	if err = os.Symlink("/etc/passwd", path.Join(dir, "out/passwd")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("/etc", path.Join(dir, "etc")); err != nil {
+		t.Fatal(err)
+	}
+
+	allArtifactTests := []artifactTestCase{
+		{
+			name:      "glob",
+			artifacts: []string{"*.txt"},
+			expected:  []string{"log.txt"},
+		}, {
+			name:      "directory",
+			artifacts: []string{"out", "log.txt"},
+			expected:  []string{"log.txt", "out/a.txt", "out/sub/b.txt"},
+		}, {
+			name:      "nested",
+			artifacts: []string{"out/*/*.txt", "out/sub/b.txt"},
+			expected:  []string{"out/sub/b.txt"},
+		}, {
+			name:      "symlink",
+			artifacts: []string{"etc/passwd", "out/passwd"},
+			expected:  []string{},
+		}, {
+			name:      "none",
+			artifacts: []string{"missing*"},
+			expected:  []string{},
+		}, {
+			name:      "tooLarge",
+			artifacts: []string{"*.txt", "*.bin"},
+			maxSize:   8,
+			expected:  []string{"log.txt"},
+			tooLarge:  true,
+		},
+	}
+	for _, test := range allArtifactTests {
+		test.doTest(dir, t)
+	}
+
+	artifact, err := SaveArtifact(dir, "saved", strings.NewReader("abc"), 0)
+	if err != nil || artifact.Size != 3 || artifact.SHA256 !=
+		"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Errorf("Wrong saved artifact: %+v, %v\n", artifact, err)
+	}
+
+	for _, pattern := range []string{"../up", "/etc/passwd", "out/../../up", "[", ""} {
+		toRun := Task{Name: "invalid", Command: []string{"true"}, Dir: dir,
+			Artifacts: []string{pattern}}
+		if _, err := toRun.Prepare(nil); err == nil {
+			t.Errorf("Pattern accepted: %q\n", pattern)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// RunDirVar is the var, and the env var, with the
+// temporary directory of a run.
+const RunDirVar = "RUN_DIR"
+
+// When the temporary directory of a run is removed.
+const (
+	// after every run, the default
+	CleanupAlways = "always"
+	// after a run that didn't fail, the others
+	// are kept to look into them
+	CleanupOnSuccess = "on-success"
+	CleanupNever     = "never"
+)
+
+// DirPolicy tells how the directory of a run is made.
+type DirPolicy struct {
+	// Dir is created with its parents if missing, then
+	// the var file is not needed
+	Create bool `json:"create,omitempty"`
+	// the mode of the created directories, in octal, if
+	// empty 0755 for Dir and 0700 for the temporary one
+	Mode string `json:"mode,omitempty"`
+
+	// every run has a new directory, the process runs
+	// in it and ${RUN_DIR} is its path
+	Temp bool `json:"temp,omitempty"`
+	// where the temporary directories are made, if
+	// empty in the temporary directory of the system
+	TempRoot string `json:"tempRoot,omitempty"`
+	// optional, its content is copied in the
+	// temporary directory, relative to Dir
+	Template string `json:"template,omitempty"`
+	// when the temporary directory is removed by the
+	// supervisor of the run, if empty CleanupAlways
+	Cleanup string `json:"cleanup,omitempty"`
+}
+
+// creates tells if Dir is created when missing.
+func (p *DirPolicy) creates() bool {
+	return p != nil && p.Create
+}
+
+// workspace is the directory of a run, made by Launch.
+type workspace struct {
+	// created if not empty
+	dir     string
+	dirMode os.FileMode
+
+	// the temporary directory, if any
+	runDir   string
+	runMode  os.FileMode
+	template string
+	cleanup  string
+
+	// the owner of the temporary directory,
+	// -1 if it's the server
+	uid, gid int
+}
+
+// workspace returns the workspace of a run in dir,
+// nil if the policy is nil.
+func (p *DirPolicy) workspace(dir string) (*workspace, error) {
+	if p == nil {
+		return nil, nil
+	}
+
+	space := &workspace{
+		dirMode: 0755,
+		runMode: 0700,
+		cleanup: p.Cleanup,
+		uid:     -1,
+		gid:     -1,
+	}
+	if p.Mode != "" {
+		mode, err := strconv.ParseUint(p.Mode, 8, 32)
+		if err != nil || mode&^0777 != 0 {
+			return nil, fmt.Errorf("Invalid directory mode: %s", p.Mode)
+		}
+		space.dirMode = os.FileMode(mode)
+		space.runMode = os.FileMode(mode)
+	}
+	switch p.Cleanup {
+	case "":
+		space.cleanup = CleanupAlways
+	case CleanupAlways, CleanupOnSuccess, CleanupNever:
+	default:
+		return nil, fmt.Errorf("Unknown cleanup: %s", p.Cleanup)
+	}
+
+	if p.Create {
+		if dir == "" {
+			return nil, fmt.Errorf("No directory to create")
+		}
+		space.dir = dir
+	}
+	if !p.Temp {
+		if p.Template != "" {
+			return nil, fmt.Errorf("Template directory with no temporary one")
+		}
+		return space, nil
+	}
+
+	root := p.TempRoot
+	if root == "" {
+		root = os.TempDir()
+	} else if !path.IsAbs(root) {
+		return nil, fmt.Errorf("Temporary root not absolute: %s", root)
+	}
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	space.runDir = path.Join(root, "gotask-run-"+hex.EncodeToString(random))
+
+	if p.Template != "" {
+		space.template = p.Template
+		if !path.IsAbs(space.template) {
+			space.template = path.Join(dir, space.template)
+		}
+	}
+	return space, nil
+}
+
+// make creates the directories, the temporary
+// one is removed if something goes wrong.
+func (w *workspace) make() error {
+	if w.dir != "" {
+		if err := os.MkdirAll(w.dir, w.dirMode); err != nil {
+			return err
+		}
+	}
+	if w.runDir == "" {
+		return nil
+	}
+
+	// never an existing one
+	if err := os.Mkdir(w.runDir, w.runMode); err != nil {
+		return err
+	}
+	err := os.Chmod(w.runDir, w.runMode)
+	if err == nil && w.template != "" {
+		err = copyTree(w.template, w.runDir)
+	}
+	if err == nil && w.uid != -1 {
+		err = filepath.Walk(w.runDir, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(file, w.uid, w.gid)
+		})
+	}
+	if err != nil {
+		os.RemoveAll(w.runDir)
+	}
+	return err
+}
+
+// copyTree copies the content of the directory src in
+// dst, keeping the modes and the symlinks.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(src, file)
+		if err != nil || relative == "." {
+			return err
+		}
+		target := filepath.Join(dst, relative)
+
+		switch {
+		case info.IsDir():
+			return os.Mkdir(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(file, target, info.Mode().Perm())
+		default:
+			// no devices or pipes
+			return nil
+		}
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// removeRunDir removes the temporary directory
+// of a run that has not started.
+func (r *RuntimeTaskInfo) removeRunDir() {
+	if r.workspace != nil && r.workspace.runDir != "" {
+		os.RemoveAll(r.workspace.runDir)
+	}
+}
+
+// Cleanup removes the temporary directory of the run as
+// its policy says, failed tells how the run ended. It's
+// up to the supervisor of the run, after WaitPoll.
+func (r *RuntimeTaskInfo) Cleanup(failed bool) error {
+	space := r.workspace
+	if space == nil || space.runDir == "" {
+		return nil
+	}
+	switch {
+	case space.cleanup == CleanupNever:
+	case space.cleanup == CleanupOnSuccess && failed:
+	default:
+		return os.RemoveAll(space.runDir)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type dirTestCase struct {
+	task Task
+	// RUN_DIR is replaced by the temporary directory
+	output string
+	failed bool
+	// the temporary directory is there after the cleanup
+	kept bool
+}
+
+func (test *dirTestCase) doTest(root string, t *testing.T) {
+	runtimeTask, err := test.task.RunWith(nil)
+	if err != nil {
+		t.Fatalf("Fail to run %s: %s\n", test.task.Name, err.Error())
+	}
+	done := make(chan *CmdDoneChan)
+	errChan := make(chan *CmdDoneChan)
+	runtimeTask.WaitPoll(test.task.Name, done, errChan)
+
+	var ret *CmdDoneChan
+	failed := false
+	select {
+	case ret = <-done:
+	case ret = <-errChan:
+		failed = true
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Task %s blocked", test.task.Name)
+	}
+	if err = runtimeTask.Cleanup(failed); err != nil {
+		t.Errorf("Cleanup error of %s: %s\n", test.task.Name, err.Error())
+	}
+
+	runDir := ret.Result.RunDir
+	if test.task.DirPolicy.Temp && path.Dir(runDir) != root {
+		t.Errorf("Wrong directory of %s: %q\n", test.task.Name, runDir)
+	}
+	if output := strings.Replace(test.output, RunDirVar, runDir, -1); ret.Output != output {
+		t.Errorf("Wrong output of %s: %q, expected %q, error %q\n",
+			test.task.Name, ret.Output, output, ret.Error)
+	}
+	if failed != test.failed {
+		t.Errorf("Wrong end of %s: failed %v\n", test.task.Name, failed)
+	}
+	if _, err = os.Stat(runDir); runDir != "" && (err == nil) != test.kept {
+		t.Errorf("Directory of %s kept: %v\n", test.task.Name, err == nil)
+	}
+	os.RemoveAll(runDir)
+}
+
+func TestDirPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotask-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := path.Join(dir, "runs")
+	template := path.Join(dir, "template")
+	for _, made := range []string{root, path.Join(template, "sub")} {
+		if err = os.MkdirAll(made, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(path.Join(template, "input"), []byte("data\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path.Join(template, "sub/file"), []byte("more\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path.Join(dir, VarFileName), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	created := path.Join(dir, "new/nested")
+
+	allDirTests := []dirTestCase{
+		{
+			task: Task{
+				Name:      "create",
+				Command:   []string{"pwd"},
+				Dir:       created,
+				DirPolicy: &DirPolicy{Create: true, Mode: "0750"},
+			},
+			output: created + "\n",
+		}, {
+			task: Task{
+				Name:      "temp",
+				Command:   []string{"cat input sub/file; echo ${RUN_DIR} $RUN_DIR; pwd"},
+				Shell:     "bash",
+				Dir:       dir,
+				DirPolicy: &DirPolicy{Temp: true, TempRoot: root, Template: "template"},
+			},
+			output: "data\nmore\nRUN_DIR RUN_DIR\nRUN_DIR\n",
+		}, {
+			task: Task{
+				Name:      "template",
+				Command:   []string{"echo", "{{.Run.Dir}}"},
+				Template:  true,
+				Dir:       dir,
+				DirPolicy: &DirPolicy{Temp: true, TempRoot: root},
+			},
+			output: "RUN_DIR\n",
+		}, {
+			task: Task{
+				Name:      "onSuccessFailed",
+				Command:   []string{"exit 1"},
+				Shell:     "bash",
+				Dir:       dir,
+				DirPolicy: &DirPolicy{Temp: true, TempRoot: root, Cleanup: CleanupOnSuccess},
+			},
+			failed: true,
+			kept:   true,
+		}, {
+			task: Task{
+				Name:      "onSuccess",
+				Command:   []string{"true"},
+				Dir:       dir,
+				DirPolicy: &DirPolicy{Temp: true, TempRoot: root, Cleanup: CleanupOnSuccess},
+			},
+		}, {
+			task: Task{
+				Name:      "never",
+				Command:   []string{"true"},
+				Dir:       dir,
+				DirPolicy: &DirPolicy{Temp: true, TempRoot: root, Cleanup: CleanupNever},
+			},
+			kept: true,
+		},
+	}
+	for _, test := range allDirTests {
+		test.doTest(root, t)
+	}
+
+	if info, err := os.Stat(created); err != nil || info.Mode().Perm() != 0750 {
+		t.Errorf("Wrong created directory: %v, %v\n", info, err)
+	}
+	if info, err := os.Stat(path.Join(dir, "new")); err != nil || !info.IsDir() {
+		t.Errorf("Parent not created: %v\n", err)
+	}
+
+	for _, policy := range []*DirPolicy{
+		{Create: true, Mode: "9"},
+		{Temp: true, Cleanup: "sometimes"},
+		{Template: "template"},
+		{Temp: true, TempRoot: "runs"},
+	} {
+		toRun := Task{Name: "invalid", Command: []string{"true"}, Dir: dir, DirPolicy: policy}
+		if _, err := toRun.Prepare(nil); err == nil {
+			t.Errorf("Policy accepted: %+v\n", policy)
+		}
+	}
+}
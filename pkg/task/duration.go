@@ -0,0 +1,49 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Duration is a time.Duration written in JSON
+// as a string, such as "1m30s".
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler, a number
+// is taken as nanoseconds.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		var ns int64
+		if err = json.Unmarshal(data, &ns); err != nil {
+			return err
+		}
+		*d = Duration(ns)
+		return nil
+	}
+
+	parsed, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
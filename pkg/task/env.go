@@ -0,0 +1,164 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// The modes of an EnvPolicy, what a run
+// inherits from the env of the server.
+const (
+	// all of it, the default
+	EnvInheritAll = "inherit-all"
+	// only the vars in Allow
+	EnvInheritAllowlist = "inherit-allowlist"
+	// nothing
+	EnvClean = "clean"
+)
+
+// EnvPolicy tells which vars of the server env a run has.
+// Allow and Remove have names, or prefixes ending with '*'.
+type EnvPolicy struct {
+	// if empty EnvInheritAll
+	Mode string `json:"mode,omitempty"`
+	// the vars kept with EnvInheritAllowlist
+	Allow []string `json:"allow,omitempty"`
+	// the vars never inherited, whatever the mode
+	Remove []string `json:"remove,omitempty"`
+}
+
+// Validate checks the mode of the policy.
+func (p *EnvPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	switch p.Mode {
+	case "", EnvInheritAll, EnvInheritAllowlist, EnvClean:
+		return nil
+	default:
+		return fmt.Errorf("Unknown env mode: %s", p.Mode)
+	}
+}
+
+// filter returns the vars of env, a list of NAME=value,
+// the policy lets through. A nil policy keeps all.
+func (p *EnvPolicy) filter(env []string) []string {
+	if p == nil {
+		return env
+	}
+
+	filtered := make([]string, 0, len(env))
+	for _, item := range env {
+		name := item
+		if index := strings.Index(item, "="); index != -1 {
+			name = item[:index]
+		}
+
+		switch {
+		case p.Mode == EnvClean:
+		case p.Mode == EnvInheritAllowlist && !matchEnv(p.Allow, name):
+		case matchEnv(p.Remove, name):
+		default:
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
+
+// matchEnv tells if name is one of patterns.
+func matchEnv(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, pattern[:len(pattern)-1]) {
+				return true
+			}
+		} else if pattern == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readEnvFiles reads the EnvFiles of the task,
+// relative to Dir, in order.
+func (t *Task) readEnvFiles() ([]Var, error) {
+	var vars []Var
+	for _, file := range t.EnvFiles {
+		if !path.IsAbs(file) {
+			file = path.Join(t.Dir, file)
+		}
+		envFile, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		fileVars, err := readDotenvFrom(bufio.NewReader(envFile))
+		envFile.Close()
+		if err != nil {
+			return nil, err
+		}
+		vars = append(vars, fileVars...)
+	}
+	return vars, nil
+}
+
+// lookupEnv returns the value of name in env, empty if
+// missing. The last one is the one the process sees.
+func lookupEnv(env []string, name string) string {
+	prefix := name + "="
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], prefix) {
+			return env[i][len(prefix):]
+		}
+	}
+	return ""
+}
+
+// recordEnv returns env as it's kept in the history of the
+// run: only the vars in set, the ones given by the task, are
+// kept. The secret vars are left out and the secret values
+// are masked, what's inherited is never kept.
+func recordEnv(env, set []string, secrets []Var, masker *masker) []string {
+	recorded := make([]string, 0, len(set))
+	for _, item := range env {
+		name := strings.SplitN(item, "=", 2)[0]
+		if !containsName(set, name) {
+			continue
+		}
+		secret := false
+		for _, variable := range secrets {
+			if variable.Name == name {
+				secret = true
+				break
+			}
+		}
+		if !secret {
+			recorded = append(recorded, masker.mask(item))
+		}
+	}
+	return recorded
+}
+
+func containsName(names []string, name string) bool {
+	for _, item := range names {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
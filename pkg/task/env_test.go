@@ -0,0 +1,148 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mapSecretSource is a SecretSource in memory.
+type mapSecretSource map[string]string
+
+func (m mapSecretSource) Secret(name string) (string, error) {
+	value, ok := m[name]
+	if !ok {
+		return "", fmt.Errorf("No secret %s", name)
+	}
+	return value, nil
+}
+
+type envTestCase struct {
+	name     string
+	dir      string
+	env      []EnvVar
+	envFiles []string
+	policy   *EnvPolicy
+	opts     *RunOptions
+	output   string
+	recorded []string
+}
+
+func (test *envTestCase) doTest(t *testing.T) {
+	toRun := Task{
+		Name:      test.name,
+		Command:   []string{"env"},
+		Dir:       test.dir,
+		Env:       test.env,
+		EnvFiles:  test.envFiles,
+		EnvPolicy: test.policy,
+	}
+	ret := waitTask(toRun, test.opts, t)
+	if ret.Output != test.output {
+		t.Errorf("Wrong env of %s: %q, expected %q, error %q\n",
+			test.name, ret.Output, test.output, ret.Error)
+	}
+	if !reflect.DeepEqual(ret.Result.Env, test.recorded) {
+		t.Errorf("Wrong recorded env of %s: %q, expected %q\n",
+			test.name, ret.Result.Env, test.recorded)
+	}
+}
+
+func TestEnvPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotask")
+	if err != nil {
+		t.Fatalf("Cannot create dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		VarFileName: "",
+		"a.env":     "A=file\nexport B='b c' # comment\n",
+		"d.env":     "D=d\n",
+	} {
+		if err = ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Cannot write %s: %s", name, err.Error())
+		}
+	}
+	if err = ioutil.WriteFile(path.Join(dir, SecretFileName),
+		[]byte("TOKEN: s3cr3t\n"), 0600); err != nil {
+		t.Fatalf("Cannot write secret file: %s", err.Error())
+	}
+
+	os.Setenv("GOTASK_ENV_KEEP", "keep")
+	os.Setenv("GOTASK_ENV_DROP", "drop")
+	defer os.Unsetenv("GOTASK_ENV_KEEP")
+	defer os.Unsetenv("GOTASK_ENV_DROP")
+
+	allEnvTests := []envTestCase{
+		{
+			name:     "clean",
+			env:      []EnvVar{{Name: "A", Value: "1"}},
+			policy:   &EnvPolicy{Mode: EnvClean},
+			output:   "A=1\n",
+			recorded: []string{"A=1"},
+		}, {
+			// what's inherited is not recorded
+			name:     "allowlist",
+			policy:   &EnvPolicy{Mode: EnvInheritAllowlist, Allow: []string{"GOTASK_ENV_*"}},
+			opts:     &RunOptions{EnvPolicy: &EnvPolicy{Remove: []string{"GOTASK_ENV_DROP"}}},
+			output:   "GOTASK_ENV_KEEP=keep\n",
+			recorded: []string{},
+		}, {
+			// the task can't have what the server removes
+			name:     "server",
+			policy:   &EnvPolicy{Mode: EnvInheritAllowlist, Allow: []string{"GOTASK_ENV_KEEP"}},
+			opts:     &RunOptions{EnvPolicy: &EnvPolicy{Mode: EnvClean}},
+			output:   "",
+			recorded: []string{},
+		}, {
+			name:     "files",
+			dir:      dir,
+			env:      []EnvVar{{Name: "A", Value: "env"}, {Name: "KEY", Value: "${secret:KEY}"}},
+			envFiles: []string{"a.env", path.Join(dir, "d.env")},
+			policy:   &EnvPolicy{Mode: EnvClean},
+			opts: &RunOptions{Secrets: mapSecretSource{
+				"KEY": "k3y",
+			}},
+			output:   "A=env\nB=b c\nD=d\nKEY=" + SecretMask + "\nTOKEN=" + SecretMask + "\n",
+			recorded: []string{"A=env", "B=b c", "D=d", "KEY=" + SecretMask},
+		},
+	}
+	for _, test := range allEnvTests {
+		test.doTest(t)
+	}
+
+	inherited := Task{
+		Name:     "inherit",
+		Command:  []string{"true"},
+		EnvFiles: []string{"/nonexistent/gotask.env"},
+	}
+	if _, err := inherited.Prepare(nil); err == nil {
+		t.Errorf("Missing env file accepted\n")
+	}
+	unknown := Task{
+		Name:      "unknown",
+		Command:   []string{"true"},
+		EnvPolicy: &EnvPolicy{Mode: "none"},
+	}
+	if _, err := unknown.Prepare(nil); err == nil || !strings.Contains(err.Error(), "none") {
+		t.Errorf("Unknown env mode accepted: %v\n", err)
+	}
+}
@@ -0,0 +1,239 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The types of an ExecutorConfig.
+const (
+	ExecutorLocal  = "local"
+	ExecutorChroot = "chroot"
+	ExecutorSSH    = "ssh"
+)
+
+// Executor starts the processes of the runs, on
+// the server host or somewhere else.
+type Executor interface {
+	// LookPath finds an executable as exec.LookPath
+	// does, on the host of the executor
+	LookPath(file string) (string, error)
+	// Environ is the env a run starts from,
+	// before the EnvPolicy
+	Environ() []string
+	// Start starts the process described by Path, Args,
+	// Env, Dir and Stdin of cmd
+	Start(cmd *exec.Cmd) (Execution, error)
+}
+
+// Execution is a process started by an Executor.
+type Execution interface {
+	// the output, read till the end before Wait
+	Stdout() io.Reader
+	Stderr() io.Reader
+	// Wait waits for the end of the process, the
+	// status is nil if it's not known
+	Wait() (*ExitStatus, error)
+	// Signal sends sig to the process and its children
+	Signal(sig syscall.Signal) error
+}
+
+// ExitStatus is how the process of an Execution ended.
+type ExitStatus struct {
+	// -1 if terminated by a signal
+	ExitCode int
+	// the signal that terminated the process, if any
+	Signal syscall.Signal
+
+	// the resources used, if known
+	UserCPU time.Duration
+	SysCPU  time.Duration
+	// in kilobytes
+	MaxRSS int64
+}
+
+// ExecutorConfig tells where the process of a task runs.
+type ExecutorConfig struct {
+	// if empty ExecutorLocal
+	Type string `json:"type,omitempty"`
+	// the directory of the process on the executor host, the
+	// Dir of the task is the one of the var files on the server
+	Dir string `json:"dir,omitempty"`
+
+	// the root of the process, with ExecutorChroot
+	Root string `json:"root,omitempty"`
+	// the remote host, with ExecutorSSH
+	SSH *SSHConfig `json:"ssh,omitempty"`
+}
+
+// NewExecutor returns the executor described by the config.
+func (c *ExecutorConfig) NewExecutor() (Executor, error) {
+	switch c.Type {
+	case "", ExecutorLocal:
+		return LocalExecutor{Dir: c.Dir}, nil
+	case ExecutorChroot:
+		if !path.IsAbs(c.Root) {
+			return nil, fmt.Errorf("Chroot root not absolute: %s", c.Root)
+		}
+		return LocalExecutor{Root: c.Root, Dir: c.Dir}, nil
+	case ExecutorSSH:
+		if c.SSH == nil {
+			return nil, fmt.Errorf("SSH executor with no host")
+		}
+		return NewSSHExecutor(c.SSH, c.Dir)
+	default:
+		return nil, fmt.Errorf("Unknown executor: %s", c.Type)
+	}
+}
+
+// executor returns the executor of a run of the task.
+func (t *Task) executor(opts *RunOptions) (Executor, error) {
+	switch {
+	case t.Executor != nil:
+		return t.Executor.NewExecutor()
+	case opts.Executor != nil:
+		return opts.Executor, nil
+	default:
+		return LocalExecutor{}, nil
+	}
+}
+
+// LocalExecutor runs the processes on the server host,
+// chrooted in Root if not empty.
+type LocalExecutor struct {
+	Root string
+	// if not empty, the Dir of the process, in Root
+	Dir string
+}
+
+// onHost tells if executor runs the processes on the server
+// host as they are, so that it can change them before start.
+func onHost(executor Executor) bool {
+	local, ok := executor.(LocalExecutor)
+	return ok && local.Root == ""
+}
+
+// LookPath looks for file in Root, if set.
+func (e LocalExecutor) LookPath(file string) (string, error) {
+	if e.Root == "" {
+		return exec.LookPath(file)
+	}
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	for _, dir := range strings.Split(os.Getenv("PATH"), ":") {
+		if !path.IsAbs(dir) {
+			continue
+		}
+		found := path.Join(dir, file)
+		info, err := os.Stat(path.Join(e.Root, found))
+		if err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return found, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in %s", file, e.Root)
+}
+
+// Environ is the env of the server.
+func (e LocalExecutor) Environ() []string {
+	return os.Environ()
+}
+
+// Start starts cmd with a pipe for stdout and one for stderr.
+func (e LocalExecutor) Start(cmd *exec.Cmd) (Execution, error) {
+	if e.Dir != "" {
+		cmd.Dir = e.Dir
+	}
+	if e.Root != "" {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Chroot = e.Root
+		// never out of the root
+		if e.Dir == "" {
+			cmd.Dir = "/"
+		}
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &localExecution{
+		cmd:    cmd,
+		stdout: stdout,
+		stderr: stderr,
+	}, nil
+}
+
+// localExecution is a process of the server host,
+// in its own process group.
+type localExecution struct {
+	cmd    *exec.Cmd
+	stdout io.Reader
+	stderr io.Reader
+}
+
+func (e *localExecution) Stdout() io.Reader {
+	return e.stdout
+}
+
+func (e *localExecution) Stderr() io.Reader {
+	return e.stderr
+}
+
+func (e *localExecution) Wait() (*ExitStatus, error) {
+	err := e.cmd.Wait()
+	state := e.cmd.ProcessState
+	if state == nil {
+		return nil, err
+	}
+
+	status := &ExitStatus{
+		ExitCode: state.ExitCode(),
+		UserCPU:  state.UserTime(),
+		SysCPU:   state.SystemTime(),
+	}
+	if wait, ok := state.Sys().(syscall.WaitStatus); ok && wait.Signaled() {
+		status.Signal = wait.Signal()
+	}
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		status.MaxRSS = int64(usage.Maxrss)
+	}
+	return status, err
+}
+
+func (e *localExecution) Signal(sig syscall.Signal) error {
+	err := syscall.Kill(-e.cmd.Process.Pid, sig)
+	if err == syscall.ESRCH {
+		// already gone
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,445 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Here a small expression language used by the When condition:
+//
+//	expr    := and ('||' and)*
+//	and     := not ('&&' not)*
+//	not     := '!' not | compare
+//	compare := primary (('=='|'!='|'<'|'<='|'>'|'>='|'in') primary)?
+//	primary := '(' expr ')' | "string" | number | true | false | ${VAR}
+
+// ExprError is returned when an expression can't be
+// parsed or evaluated.
+type ExprError struct {
+	Expr string
+	Pos  int
+	Desc string
+}
+
+func (e ExprError) Error() string {
+	return fmt.Sprintf("Expression error at %d in '%s': %s", e.Pos, e.Expr, e.Desc)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenString
+	tokenNumber
+	tokenIdent
+	tokenVar
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// value is the result of an evaluation.
+type value struct {
+	kind VarType
+	str  string
+	num  int64
+	b    bool
+	list []string
+}
+
+func (v value) String() string {
+	switch v.kind {
+	case VarInt:
+		return strconv.FormatInt(v.num, 10)
+	case VarBool:
+		return strconv.FormatBool(v.b)
+	case VarList:
+		return strings.Join(v.list, " ")
+	default:
+		return v.str
+	}
+}
+
+func valueOf(variable Var) value {
+	switch variable.Type {
+	case VarInt:
+		num, _ := strconv.ParseInt(variable.Value, 10, 64)
+		return value{kind: VarInt, num: num}
+	case VarBool:
+		b, _ := strconv.ParseBool(variable.Value)
+		return value{kind: VarBool, b: b}
+	case VarList:
+		return value{kind: VarList, list: variable.List}
+	default:
+		return value{kind: VarString, str: variable.Value}
+	}
+}
+
+// convert tries to give v the given kind,
+// only strings are converted.
+func (v value) convert(kind VarType) (value, bool) {
+	if v.kind == kind {
+		return v, true
+	}
+	if v.kind != VarString {
+		return v, false
+	}
+	switch kind {
+	case VarInt:
+		num, err := strconv.ParseInt(v.str, 10, 64)
+		return value{kind: VarInt, num: num}, err == nil
+	case VarBool:
+		b, err := strconv.ParseBool(v.str)
+		return value{kind: VarBool, b: b}, err == nil
+	}
+	return v, false
+}
+
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	runes := []rune(expr)
+	i := 0
+	for i < len(runes) {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '"':
+			start := i
+			i++
+			for i < len(runes) && runes[i] != '"' {
+				if runes[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(runes) {
+				return nil, ExprError{Expr: expr, Pos: start, Desc: "unterminated string"}
+			}
+			i++
+			str, err := strconv.Unquote(string(runes[start:i]))
+			if err != nil {
+				return nil, ExprError{Expr: expr, Pos: start, Desc: err.Error()}
+			}
+			tokens = append(tokens, token{kind: tokenString, text: str, pos: start})
+
+		case r == '$':
+			start := i
+			end := i + 2
+			for end < len(runes) && runes[end] != '}' {
+				end++
+			}
+			if i+1 >= len(runes) || runes[i+1] != '{' || end >= len(runes) {
+				return nil, ExprError{Expr: expr, Pos: start, Desc: "bad variable reference"}
+			}
+			tokens = append(tokens, token{kind: tokenVar, text: string(runes[start+2 : end]), pos: start})
+			i = end + 1
+
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			i++
+			for i < len(runes) && unicode.IsDigit(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: string(runes[start:i]), pos: start})
+
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[start:i]), pos: start})
+
+		default:
+			start := i
+			op := string(r)
+			if i+1 < len(runes) {
+				switch two := string(runes[i : i+2]); two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = two
+				}
+			}
+			switch op {
+			case "==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")":
+			default:
+				return nil, ExprError{Expr: expr, Pos: start, Desc: fmt.Sprintf("unexpected '%s'", op)}
+			}
+			i += len(op)
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: start})
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(runes)}), nil
+}
+
+// evaluator is a recursive descent parser that
+// evaluates while parsing.
+type evaluator struct {
+	expr   string
+	tokens []token
+	pos    int
+	vars   map[string]Var
+}
+
+func (e *evaluator) peek() token {
+	return e.tokens[e.pos]
+}
+
+func (e *evaluator) next() token {
+	tok := e.tokens[e.pos]
+	if tok.kind != tokenEOF {
+		e.pos++
+	}
+	return tok
+}
+
+func (e *evaluator) errorf(tok token, format string, args ...interface{}) error {
+	return ExprError{Expr: e.expr, Pos: tok.pos, Desc: fmt.Sprintf(format, args...)}
+}
+
+func (e *evaluator) isOp(text string) bool {
+	tok := e.peek()
+	return (tok.kind == tokenOp || tok.kind == tokenIdent) && tok.text == text
+}
+
+func (e *evaluator) boolean(tok token, v value) (bool, error) {
+	b, ok := v.convert(VarBool)
+	if !ok {
+		return false, e.errorf(tok, "not a boolean: %s", v)
+	}
+	return b.b, nil
+}
+
+func (e *evaluator) parseOr() (value, error) {
+	tok := e.peek()
+	left, err := e.parseAnd()
+	if err != nil {
+		return left, err
+	}
+	for e.isOp("||") {
+		opTok := e.next()
+		right, err := e.parseAnd()
+		if err != nil {
+			return right, err
+		}
+		l, err := e.boolean(tok, left)
+		if err != nil {
+			return left, err
+		}
+		r, err := e.boolean(opTok, right)
+		if err != nil {
+			return right, err
+		}
+		left = value{kind: VarBool, b: l || r}
+	}
+	return left, nil
+}
+
+func (e *evaluator) parseAnd() (value, error) {
+	tok := e.peek()
+	left, err := e.parseNot()
+	if err != nil {
+		return left, err
+	}
+	for e.isOp("&&") {
+		opTok := e.next()
+		right, err := e.parseNot()
+		if err != nil {
+			return right, err
+		}
+		l, err := e.boolean(tok, left)
+		if err != nil {
+			return left, err
+		}
+		r, err := e.boolean(opTok, right)
+		if err != nil {
+			return right, err
+		}
+		left = value{kind: VarBool, b: l && r}
+	}
+	return left, nil
+}
+
+func (e *evaluator) parseNot() (value, error) {
+	if e.isOp("!") {
+		tok := e.next()
+		v, err := e.parseNot()
+		if err != nil {
+			return v, err
+		}
+		b, err := e.boolean(tok, v)
+		return value{kind: VarBool, b: !b}, err
+	}
+	return e.parseCompare()
+}
+
+func (e *evaluator) parseCompare() (value, error) {
+	left, err := e.parsePrimary()
+	if err != nil {
+		return left, err
+	}
+
+	tok := e.peek()
+	if tok.kind != tokenOp && tok.kind != tokenIdent {
+		return left, nil
+	}
+	switch tok.text {
+	case "==", "!=", "<", "<=", ">", ">=", "in":
+	default:
+		return left, nil
+	}
+	e.next()
+
+	right, err := e.parsePrimary()
+	if err != nil {
+		return right, err
+	}
+
+	result, err := e.compare(tok, left, right)
+	return value{kind: VarBool, b: result}, err
+}
+
+func (e *evaluator) compare(tok token, left, right value) (bool, error) {
+	if tok.text == "in" {
+		if right.kind != VarList {
+			return false, e.errorf(tok, "'in' needs a list, got: %s", right)
+		}
+		for _, item := range right.list {
+			if item == left.String() {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	// give both the same type if possible
+	if left.kind != right.kind {
+		if converted, ok := left.convert(right.kind); ok {
+			left = converted
+		} else if converted, ok := right.convert(left.kind); ok {
+			right = converted
+		}
+	}
+
+	switch tok.text {
+	case "==":
+		return left.kind == right.kind && left.String() == right.String(), nil
+	case "!=":
+		return left.kind != right.kind || left.String() != right.String(), nil
+	}
+
+	var cmp int
+	switch {
+	case left.kind == VarInt && right.kind == VarInt:
+		switch {
+		case left.num < right.num:
+			cmp = -1
+		case left.num > right.num:
+			cmp = 1
+		}
+	case left.kind == VarString && right.kind == VarString:
+		cmp = strings.Compare(left.str, right.str)
+	default:
+		return false, e.errorf(tok, "cannot compare %s and %s", left, right)
+	}
+
+	switch tok.text {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+func (e *evaluator) parsePrimary() (value, error) {
+	tok := e.next()
+	switch tok.kind {
+	case tokenString:
+		return value{kind: VarString, str: tok.text}, nil
+
+	case tokenNumber:
+		num, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return value{}, e.errorf(tok, "bad number: %s", tok.text)
+		}
+		return value{kind: VarInt, num: num}, nil
+
+	case tokenIdent:
+		switch tok.text {
+		case "true", "false":
+			return value{kind: VarBool, b: tok.text == "true"}, nil
+		}
+		return value{}, e.errorf(tok, "unknown identifier: %s", tok.text)
+
+	case tokenVar:
+		variable, ok := e.vars[tok.text]
+		if !ok {
+			return value{}, e.errorf(tok, "undefined variable: %s", tok.text)
+		}
+		return valueOf(variable), nil
+
+	case tokenOp:
+		if tok.text == "(" {
+			v, err := e.parseOr()
+			if err != nil {
+				return v, err
+			}
+			if closing := e.next(); closing.text != ")" {
+				return v, e.errorf(closing, "missing ')'")
+			}
+			return v, nil
+		}
+	}
+	return value{}, e.errorf(tok, "unexpected token: '%s'", tok.text)
+}
+
+// EvalCondition evaluates a boolean expression using
+// the given variables.
+func EvalCondition(expr string, vars []Var) (bool, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return false, err
+	}
+
+	e := &evaluator{
+		expr:   expr,
+		tokens: tokens,
+		vars:   make(map[string]Var, len(vars)),
+	}
+	for _, variable := range vars {
+		e.vars[variable.Name] = variable
+	}
+
+	tok := e.peek()
+	result, err := e.parseOr()
+	if err != nil {
+		return false, err
+	}
+	if last := e.peek(); last.kind != tokenEOF {
+		return false, e.errorf(last, "unexpected token: '%s'", last.text)
+	}
+	return e.boolean(tok, result)
+}
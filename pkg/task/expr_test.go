@@ -0,0 +1,72 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"testing"
+)
+
+type exprTestCase struct {
+	expr      string
+	expected  bool
+	withError bool
+}
+
+var exprVars = []Var{
+	{Name: "ENV", Value: "prod"},
+	{Name: "DRY_RUN", Value: "false", Type: VarBool},
+	{Name: "RETRIES", Value: "3", Type: VarInt},
+	{Name: "FLAG", Value: "true"},
+	NewListVar("TARGETS", []string{"linux", "darwin"}),
+}
+
+var allExprTests = []exprTestCase{
+	{expr: `${ENV} == "prod" && ${DRY_RUN} != true`, expected: true},
+	{expr: `${ENV} == "dev" || ${DRY_RUN}`, expected: false},
+	{expr: `!(${RETRIES} > 5)`, expected: true},
+	{expr: `${RETRIES} >= 3 && ${RETRIES} < 4`, expected: true},
+	{expr: `${FLAG} == true`, expected: true},
+	{expr: `${FLAG}`, expected: true},
+	{expr: `"linux" in ${TARGETS}`, expected: true},
+	{expr: `"windows" in ${TARGETS}`, expected: false},
+	{expr: `${MISSING} == "x"`, withError: true},
+	{expr: `${ENV}`, withError: true},
+	{expr: `${ENV} == `, withError: true},
+	{expr: `(${RETRIES} > 1`, withError: true},
+	{expr: `${RETRIES} > "a"`, withError: true},
+	{expr: `${ENV} = "prod"`, withError: true},
+}
+
+func (e *exprTestCase) doTest(t *testing.T) {
+	got, err := EvalCondition(e.expr, exprVars)
+	if e.withError {
+		if err == nil {
+			t.Errorf("Expected error for '%s' but got none", e.expr)
+		}
+		return
+	}
+
+	if err != nil {
+		t.Errorf("Got error for '%s': %s\n", e.expr, err.Error())
+	} else if got != e.expected {
+		t.Errorf("Wrong result for '%s':\ngot: %v\nexpected: %v\n",
+			e.expr, got, e.expected)
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	for _, testCase := range allExprTests {
+		testCase.doTest(t)
+	}
+}
@@ -0,0 +1,184 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// ResultVar is the var, and the env var, with the path
+// of the result file of a run.
+const ResultVar = "GOTASK_RESULT"
+
+// What the output of a task is, all but OutputText
+// are parsed in the Structured result of the run.
+const (
+	// the default, not parsed
+	OutputText = "text"
+	// stdout is a JSON document
+	OutputJSON = "json"
+	// every line of stdout is a JSON document,
+	// the result is an array of them
+	OutputJSONLines = "json-lines"
+	// the process writes a JSON document to
+	// the file in ${GOTASK_RESULT}
+	OutputResultFile = "result-file"
+)
+
+// errTruncated is returned when the output
+// to parse is not complete.
+var errTruncated = errors.New("output truncated")
+
+// checkOutputFormat checks format can be used by t.
+func (t *Task) checkOutputFormat() error {
+	switch t.OutputFormat {
+	case "", OutputText, OutputResultFile:
+	case OutputJSON, OutputJSONLines:
+		if t.MergeOutput || t.Tty {
+			return fmt.Errorf("%s output needs stdout alone", t.OutputFormat)
+		}
+	default:
+		return fmt.Errorf("Unknown output format: %s", t.OutputFormat)
+	}
+	return nil
+}
+
+// newResultFile returns the path of the result file of
+// a run, in its temporary directory if there's one.
+func newResultFile(runDir string) (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	name := "gotask-result-" + hex.EncodeToString(random) + ".json"
+	if runDir != "" {
+		return path.Join(runDir, name), nil
+	}
+	return path.Join(os.TempDir(), name), nil
+}
+
+// parseOutput returns the structured result of the ended
+// run, stdout is output. The result file is removed.
+func (r *RuntimeTaskInfo) parseOutput(output string, truncated bool) (json.RawMessage, error) {
+	switch r.outputFormat {
+	case OutputJSON:
+		if truncated {
+			return nil, errTruncated
+		}
+		return parseJSON([]byte(output))
+
+	case OutputJSONLines:
+		if truncated {
+			return nil, errTruncated
+		}
+		documents := []json.RawMessage{}
+		for i, line := range strings.Split(output, "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			document, err := parseJSON([]byte(line))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err.Error())
+			}
+			documents = append(documents, document)
+		}
+		return json.Marshal(documents)
+
+	case OutputResultFile:
+		defer os.Remove(r.resultFile)
+		file, err := openResultFile(r.resultFile, r.uid())
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		// the same limit of the output
+		var reader io.Reader = file
+		if r.maxOutput > 0 {
+			reader = io.LimitReader(file, r.maxOutput+1)
+		}
+		var buffer bytes.Buffer
+		if _, err = buffer.ReadFrom(reader); err != nil {
+			return nil, err
+		}
+		if r.maxOutput > 0 && int64(buffer.Len()) > r.maxOutput {
+			return nil, errors.New("result file too large")
+		}
+		return parseJSON([]byte(r.Mask(buffer.String())))
+	}
+	return nil, nil
+}
+
+// openResultFile opens the result file at name, written by
+// a process running as uid. It's read with the privileges of
+// the server, so it must be a regular file of uid: not a link
+// to a file the process can't read.
+func openResultFile(name string, uid int) (*os.File, error) {
+	// a FIFO would block the read
+	file, err := os.OpenFile(name, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.Mode().IsRegular() || !ok || int(stat.Uid) != uid {
+		file.Close()
+		return nil, errors.New("result file not a regular file of the run")
+	}
+	return file, nil
+}
+
+// uid returns the user the process runs as.
+func (r *RuntimeTaskInfo) uid() int {
+	if r.Cmd != nil && r.Cmd.SysProcAttr != nil && r.Cmd.SysProcAttr.Credential != nil {
+		return int(r.Cmd.SysProcAttr.Credential.Uid)
+	}
+	return os.Geteuid()
+}
+
+// parseJSON checks data is a single JSON document,
+// returning it compacted.
+func parseJSON(data []byte) (json.RawMessage, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, errors.New("no JSON document")
+	}
+	if !json.Valid(data) {
+		// for the position of the error
+		var document interface{}
+		if err := json.Unmarshal(data, &document); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("invalid JSON document")
+	}
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, data); err != nil {
+		return nil, err
+	}
+	return compacted.Bytes(), nil
+}
@@ -0,0 +1,182 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type formatTestCase struct {
+	task Task
+	// compacted, empty if none
+	structured string
+	failed     bool
+}
+
+func (test *formatTestCase) doTest(t *testing.T) {
+	runtimeTask, err := test.task.RunWith(nil)
+	if err != nil {
+		t.Fatalf("Fail to run %s: %s\n", test.task.Name, err.Error())
+	}
+	done := make(chan *CmdDoneChan)
+	errChan := make(chan *CmdDoneChan)
+	runtimeTask.WaitPoll(test.task.Name, done, errChan)
+
+	var ret *CmdDoneChan
+	failed := false
+	select {
+	case ret = <-done:
+	case ret = <-errChan:
+		failed = true
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Task %s blocked", test.task.Name)
+	}
+
+	if string(ret.Structured) != test.structured {
+		t.Errorf("Wrong result of %s: %q, expected %q, error %q\n",
+			test.task.Name, ret.Structured, test.structured, ret.Error)
+	}
+	if failed != test.failed {
+		t.Errorf("Wrong end of %s: failed %v, error %q\n", test.task.Name, failed, ret.Error)
+	}
+	if runtimeTask.resultFile != "" {
+		if _, err = os.Stat(runtimeTask.resultFile); err == nil {
+			t.Errorf("Result file of %s kept\n", test.task.Name)
+		}
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotask-format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ioutil.WriteFile(path.Join(dir, VarFileName), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path.Join(dir, "input.json"), []byte("[1, 2]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	allFormatTests := []formatTestCase{
+		{
+			task: Task{
+				Name:         "text",
+				Command:      []string{"echo", "{}"},
+				OutputFormat: OutputText,
+			},
+		}, {
+			task: Task{
+				Name:         "json",
+				Command:      []string{`echo '{"a": 1, "b": [1, 2]}'`},
+				Shell:        "bash",
+				OutputFormat: OutputJSON,
+			},
+			structured: `{"a":1,"b":[1,2]}`,
+		}, {
+			task: Task{
+				Name:         "jsonInvalid",
+				Command:      []string{"echo", "not json"},
+				OutputFormat: OutputJSON,
+			},
+			failed: true,
+		}, {
+			task: Task{
+				Name:         "jsonExit",
+				Command:      []string{`echo '{"e": 1}'; exit 2`},
+				Shell:        "bash",
+				OutputFormat: OutputJSON,
+			},
+			structured: `{"e":1}`,
+			failed:     true,
+		}, {
+			task: Task{
+				Name:         "jsonLines",
+				Command:      []string{`printf '{"n": 1}\n\n{"n": 2}\n'`},
+				Shell:        "bash",
+				OutputFormat: OutputJSONLines,
+			},
+			structured: `[{"n":1},{"n":2}]`,
+		}, {
+			task: Task{
+				Name:         "jsonLinesInvalid",
+				Command:      []string{`printf '{"n": 1}\n{"n"\n'`},
+				Shell:        "bash",
+				OutputFormat: OutputJSONLines,
+			},
+			failed: true,
+		}, {
+			task: Task{
+				Name:         "resultFile",
+				Command:      []string{`echo hello; echo '{"ok": true}' > $GOTASK_RESULT`},
+				Shell:        "bash",
+				OutputFormat: OutputResultFile,
+			},
+			structured: `{"ok":true}`,
+		}, {
+			task: Task{
+				Name:         "resultFileVar",
+				Command:      []string{"cp", "input.json", "${GOTASK_RESULT}"},
+				Dir:          dir,
+				OutputFormat: OutputResultFile,
+			},
+			structured: `[1,2]`,
+		}, {
+			// a file the process may not read
+			task: Task{
+				Name:         "resultFileLink",
+				Command:      []string{`ln -s "$PWD/input.json" "$GOTASK_RESULT"`},
+				Shell:        "bash",
+				Dir:          dir,
+				OutputFormat: OutputResultFile,
+			},
+			failed: true,
+		}, {
+			task: Task{
+				Name:         "resultFileTemp",
+				Command:      []string{`echo '"done"' > "$GOTASK_RESULT"`},
+				Shell:        "bash",
+				Dir:          dir,
+				DirPolicy:    &DirPolicy{Temp: true, TempRoot: dir},
+				OutputFormat: OutputResultFile,
+			},
+			structured: `"done"`,
+		}, {
+			task: Task{
+				Name:         "resultFileMissing",
+				Command:      []string{"true"},
+				OutputFormat: OutputResultFile,
+			},
+			failed: true,
+		},
+	}
+	for _, test := range allFormatTests {
+		test.doTest(t)
+	}
+
+	for _, toRun := range []Task{
+		{Name: "unknown", Command: []string{"true"}, OutputFormat: "yaml"},
+		{Name: "merged", Command: []string{"true"}, OutputFormat: OutputJSON, MergeOutput: true},
+	} {
+		if _, err := toRun.Prepare(nil); err == nil {
+			t.Errorf("Task %s accepted\n", toRun.Name)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// groupGrace is how long the processes of the group have
+// to exit after the task, before they're killed.
+const groupGrace = 100 * time.Millisecond
+
+// Signal sends sig to every process of the task: it runs in
+// its own process group, so the children of a shell are
+// signalled too. Nothing is done once the task is over.
+func (r *RuntimeTaskInfo) Signal(sig syscall.Signal) error {
+	if r.state == nil {
+		return nil
+	}
+
+	r.state.Lock()
+	defer r.state.Unlock()
+	if r.state.execution == nil || r.state.exited {
+		return nil
+	}
+	return r.state.execution.Signal(sig)
+}
+
+// reapGroup is called once the process of the task is done:
+// the other processes of its group have groupGrace to exit,
+// then they're killed. It returns the pids of the ones that
+// were still running.
+func (r *RuntimeTaskInfo) reapGroup() []int {
+	r.state.Lock()
+	defer r.state.Unlock()
+	// the pgid may be used again from now on
+	r.state.exited = true
+
+	if r.Pgid <= 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(groupGrace)
+	for {
+		pids := groupProcesses(r.Pgid)
+		if len(pids) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			syscall.Kill(-r.Pgid, syscall.SIGKILL)
+			return pids
+		}
+		time.Sleep(groupGrace / 10)
+	}
+}
+
+// groupProcesses returns the pids of the live processes
+// in the group pgid, looking at /proc.
+func groupProcesses(pgid int) []int {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			// gone in the meantime
+			continue
+		}
+		// pid (comm) state ppid pgrp ..., comm may have spaces
+		stat := string(data)
+		fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+		if len(fields) < 3 || fields[0] == "Z" {
+			continue
+		}
+		if group, err := strconv.Atoi(fields[2]); err == nil && group == pgid {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
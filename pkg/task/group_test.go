@@ -0,0 +1,103 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type groupTestCase struct {
+	task Task
+	// the reason of the kill, if any
+	killReason string
+	leftover   bool
+}
+
+var allGroupTests = []groupTestCase{
+	{
+		// the child keeps the pipes open
+		task: Task{
+			Name:    "timeout",
+			Command: []string{"sleep 30 & echo $!; wait"},
+			Shell:   "bash",
+			Timeout: Duration(200 * time.Millisecond),
+		},
+		killReason: KillTimeout,
+	}, {
+		task: Task{
+			Name:    "tty",
+			Command: []string{"sleep 30 & echo $!; wait"},
+			Shell:   "bash",
+			Timeout: Duration(200 * time.Millisecond),
+			Tty:     true,
+		},
+		killReason: KillTimeout,
+	}, {
+		task: Task{
+			Name:    "leftover",
+			Command: []string{"sleep 30 >/dev/null 2>&1 & echo $!"},
+			Shell:   "bash",
+		},
+		leftover: true,
+	},
+}
+
+func (test *groupTestCase) doTest(t *testing.T) {
+	ret := waitTask(test.task, nil, t)
+
+	pid, err := strconv.Atoi(strings.TrimSpace(ret.Output))
+	if err != nil {
+		t.Fatalf("Wrong output of %s: %q\n", test.task.Name, ret.Output)
+	}
+
+	if ret.Result.KillReason != test.killReason {
+		t.Errorf("Wrong kill reason of %s: %q\n", test.task.Name, ret.Result.KillReason)
+	}
+	if test.leftover && (len(ret.Result.Leftover) != 1 || ret.Result.Leftover[0] != pid) {
+		t.Errorf("Wrong leftover of %s: %v, expected %d\n", test.task.Name, ret.Result.Leftover, pid)
+	}
+	if !test.leftover && len(ret.Result.Leftover) != 0 {
+		t.Errorf("Unexpected leftover of %s: %v\n", test.task.Name, ret.Result.Leftover)
+	}
+
+	// the child is gone
+	for i := 0; i < 20 && processRunning(pid); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if processRunning(pid) {
+		t.Errorf("Child %d of %s still running\n", pid, test.task.Name)
+	}
+}
+
+// processRunning tells if pid is alive, zombies are not.
+func processRunning(pid int) bool {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestProcessGroup(t *testing.T) {
+	for _, test := range allGroupTests {
+		test.doTest(t)
+	}
+}
@@ -0,0 +1,198 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// the capabilities needed to change identity
+const (
+	capSetgid = 6
+	capSetuid = 7
+)
+
+// Identity is the user and the groups a run has.
+type Identity struct {
+	User string
+	UID  uint32
+	Home string
+
+	// the primary group
+	Group string
+	GID   uint32
+	// the supplementary groups
+	Groups []uint32
+}
+
+// lookupUser finds a user by name or by id.
+func lookupUser(name string) (*user.User, error) {
+	found, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		if _, numErr := strconv.ParseUint(name, 10, 32); numErr == nil {
+			return user.LookupId(name)
+		}
+	}
+	return found, err
+}
+
+// lookupGroup finds a group by name or by id.
+func lookupGroup(name string) (*user.Group, error) {
+	found, err := user.LookupGroup(name)
+	if _, ok := err.(user.UnknownGroupError); ok {
+		if _, numErr := strconv.ParseUint(name, 10, 32); numErr == nil {
+			return user.LookupGroupId(name)
+		}
+	}
+	return found, err
+}
+
+func parseID(id string) (uint32, error) {
+	num, err := strconv.ParseUint(id, 10, 32)
+	return uint32(num), err
+}
+
+// Identity resolves User and Group of the task, it
+// returns nil if the task has none of them.
+func (t *Task) Identity() (*Identity, error) {
+	if t.User == "" && t.Group == "" {
+		return nil, nil
+	}
+
+	var runAs *user.User
+	var err error
+	if t.User != "" {
+		runAs, err = lookupUser(t.User)
+	} else {
+		runAs, err = user.Current()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		User: runAs.Username,
+		Home: runAs.HomeDir,
+	}
+	if identity.UID, err = parseID(runAs.Uid); err != nil {
+		return nil, err
+	}
+
+	groupID := runAs.Gid
+	if t.Group != "" {
+		group, err := lookupGroup(t.Group)
+		if err != nil {
+			return nil, err
+		}
+		identity.Group = group.Name
+		groupID = group.Gid
+	} else if group, err := user.LookupGroupId(groupID); err == nil {
+		identity.Group = group.Name
+	}
+	if identity.GID, err = parseID(groupID); err != nil {
+		return nil, err
+	}
+
+	groupIDs, err := runAs.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range groupIDs {
+		gid, err := parseID(id)
+		if err != nil {
+			return nil, err
+		}
+		identity.Groups = append(identity.Groups, gid)
+	}
+	return identity, nil
+}
+
+// credential returns the credential of the process, nil if
+// it's the one of the server. It fails if the server can't
+// change identity.
+func (i *Identity) credential() (*syscall.Credential, error) {
+	if i.UID == uint32(os.Getuid()) && i.GID == uint32(os.Getgid()) {
+		return nil, nil
+	}
+	if !hasCapability(capSetuid) || !hasCapability(capSetgid) {
+		return nil, fmt.Errorf("The server can't run tasks as %s:%s", i.User, i.Group)
+	}
+	return &syscall.Credential{
+		Uid:    i.UID,
+		Gid:    i.GID,
+		Groups: i.Groups,
+	}, nil
+}
+
+// hasCapability tells if the server has the capability
+// number capability in its effective set.
+func hasCapability(capability uint) bool {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return os.Geteuid() == 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(line[len("CapEff:"):]), 16, 64)
+		return err == nil && caps&(1<<capability) != 0
+	}
+	return os.Geteuid() == 0
+}
+
+// setEnv sets name to value in env, a list of NAME=value.
+func setEnv(env []string, name, value string) []string {
+	prefix := name + "="
+	for i, item := range env {
+		if strings.HasPrefix(item, prefix) {
+			env[i] = prefix + value
+			return env
+		}
+	}
+	return append(env, prefix+value)
+}
+
+// applyIdentity makes cmd run as identity, with
+// HOME, USER and LOGNAME of the user.
+func applyIdentity(cmd *exec.Cmd, identity *Identity) error {
+	credential, err := identity.credential()
+	if err != nil {
+		return err
+	}
+	cmd.SysProcAttr.Credential = credential
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	env = setEnv(env, "USER", identity.User)
+	env = setEnv(env, "LOGNAME", identity.User)
+	if identity.Home != "" {
+		env = setEnv(env, "HOME", identity.Home)
+	}
+	cmd.Env = env
+	return nil
+}
@@ -0,0 +1,72 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"testing"
+)
+
+type identityTestCase struct {
+	user   string
+	group  string
+	output string
+}
+
+var allIdentityTests = []identityTestCase{
+	{
+		user:   "nobody",
+		output: "65534 65534 nobody /nonexistent\n",
+	}, {
+		user:   "65534",
+		group:  "daemon",
+		output: "65534 1 nobody /nonexistent\n",
+	}, {
+		group:  "1",
+		output: "0 1 root /root\n",
+	},
+}
+
+func (test *identityTestCase) doTest(t *testing.T) {
+	toRun := Task{
+		Name:    "identity",
+		Command: []string{`echo $(id -u) $(id -g) $USER $HOME`},
+		Shell:   "bash",
+		User:    test.user,
+		Group:   test.group,
+	}
+	ret := waitTask(toRun, nil, t)
+	if ret.Output != test.output {
+		t.Errorf("Wrong identity of %s:%s: %q, expected %q\n",
+			test.user, test.group, ret.Output, test.output)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	if !hasCapability(capSetuid) || !hasCapability(capSetgid) {
+		t.Skip("Can't change identity")
+	}
+
+	for _, test := range allIdentityTests {
+		test.doTest(t)
+	}
+
+	unknown := Task{
+		Name:    "unknown",
+		Command: []string{"true"},
+		User:    "gotask-no-such-user",
+	}
+	if _, err := unknown.Prepare(nil); err == nil {
+		t.Errorf("Unknown user accepted\n")
+	}
+}
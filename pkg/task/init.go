@@ -0,0 +1,103 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// initEnv gives what's to be done before the command
+// to the process started for a run, see Init.
+const initEnv = "GOTASK_INIT"
+
+// initRequest is the value of initEnv.
+type initRequest struct {
+	Path    string          `json:"path"`
+	Rlimits []rlimit        `json:"rlimits,omitempty"`
+	Sandbox *sandboxRequest `json:"sandbox,omitempty"`
+}
+
+// needed tells if the process of the run has
+// to start with Init.
+func (request *initRequest) needed() bool {
+	return len(request.Rlimits) > 0 || request.Sandbox != nil
+}
+
+// wrapCommand makes cmd start the current program in place of
+// the command: Init does what's in request, then it runs the
+// command.
+func wrapCommand(cmd *exec.Cmd, request *initRequest) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	request.Path = cmd.Path
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env[:len(env):len(env)], fmt.Sprintf("%s=%s", initEnv, data))
+	cmd.Path = self
+	return nil
+}
+
+// Init must be called first thing in main by the programs running
+// tasks with Limits or a Sandbox: the process of such a run starts
+// as the program itself, Init sets up the sandbox and the limits and
+// replaces it with the command, so that they're in place before the
+// command starts. In any other case it does nothing.
+func Init() {
+	data, ok := os.LookupEnv(initEnv)
+	if !ok {
+		return
+	}
+	os.Unsetenv(initEnv)
+
+	var request initRequest
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		initFail(err)
+	}
+
+	if request.Sandbox != nil {
+		if err := request.Sandbox.setup(); err != nil {
+			initFail(fmt.Errorf("sandbox: %s", err.Error()))
+		}
+	}
+
+	for _, limit := range request.Rlimits {
+		err := syscall.Setrlimit(limit.Resource, &syscall.Rlimit{
+			Cur: limit.Cur,
+			Max: limit.Max,
+		})
+		if err != nil {
+			initFail(fmt.Errorf("setrlimit %d: %s", limit.Resource, err.Error()))
+		}
+	}
+
+	initFail(syscall.Exec(request.Path, os.Args, os.Environ()))
+}
+
+func initFail(err error) {
+	fmt.Fprintf(os.Stderr, "Fail to start the task: %s\n", err.Error())
+	os.Exit(127)
+}
@@ -0,0 +1,218 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// rlimitNproc is RLIMIT_NPROC on Linux,
+// syscall doesn't have it.
+const rlimitNproc = 0x6
+
+// cgroupControllers are the controllers of the cgroup
+// v2 used by the limits.
+var cgroupControllers = []string{"memory", "cpu", "pids"}
+
+// Limits are the resources a run may use, 0 means no limit.
+type Limits struct {
+	// set with setrlimit on the process: the CPU time, rounded
+	// up to seconds, the bytes of address space, the open files
+	// and the processes of the user running the task
+	CPU          Duration `json:"cpu,omitempty"`
+	AddressSpace int64    `json:"addressSpace,omitempty"`
+	OpenFiles    int64    `json:"openFiles,omitempty"`
+	Processes    int64    `json:"processes,omitempty"`
+
+	// set on a cgroup for the whole run, the server must have
+	// a delegated cgroup v2: the bytes of memory, the cpu.weight
+	// from 1 to 10000 and the processes
+	Memory    int64 `json:"memory,omitempty"`
+	CPUWeight int   `json:"cpuWeight,omitempty"`
+	Pids      int64 `json:"pids,omitempty"`
+}
+
+func (l *Limits) hasRlimits() bool {
+	return l != nil && (l.CPU > 0 || l.AddressSpace > 0 || l.OpenFiles > 0 || l.Processes > 0)
+}
+
+func (l *Limits) hasCgroup() bool {
+	return l != nil && (l.Memory > 0 || l.CPUWeight > 0 || l.Pids > 0)
+}
+
+func (l *Limits) validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.CPU < 0 || l.AddressSpace < 0 || l.OpenFiles < 0 || l.Processes < 0 ||
+		l.Memory < 0 || l.Pids < 0 {
+		return fmt.Errorf("Negative limit")
+	}
+	if l.CPUWeight < 0 || l.CPUWeight > 10000 {
+		return fmt.Errorf("CPU weight not in [1, 10000]: %d", l.CPUWeight)
+	}
+	return nil
+}
+
+// cpuSeconds is the CPU limit rounded up to seconds.
+func (l *Limits) cpuSeconds() uint64 {
+	return uint64((time.Duration(l.CPU) + time.Second - 1) / time.Second)
+}
+
+// rlimit is a limit set by Init.
+type rlimit struct {
+	Resource int    `json:"resource"`
+	Cur      uint64 `json:"cur"`
+	Max      uint64 `json:"max"`
+}
+
+func (l *Limits) rlimits() []rlimit {
+	var limits []rlimit
+	if l.CPU > 0 {
+		// SIGXCPU first, then SIGKILL if ignored
+		seconds := l.cpuSeconds()
+		limits = append(limits, rlimit{Resource: syscall.RLIMIT_CPU, Cur: seconds, Max: seconds + 1})
+	}
+	for _, limit := range []struct {
+		resource int
+		value    int64
+	}{
+		{syscall.RLIMIT_AS, l.AddressSpace},
+		{syscall.RLIMIT_NOFILE, l.OpenFiles},
+		{rlimitNproc, l.Processes},
+	} {
+		if limit.value > 0 {
+			limits = append(limits, rlimit{
+				Resource: limit.resource,
+				Cur:      uint64(limit.value),
+				Max:      uint64(limit.value),
+			})
+		}
+	}
+	return limits
+}
+
+// EnableCgroup enables the controllers used by the limits on
+// the children of the cgroup v2 dir, that must be delegated
+// to the server. The server can't be in dir itself.
+func EnableCgroup(dir string) error {
+	data, err := ioutil.ReadFile(path.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+
+	available := strings.Fields(string(data))
+	var enable []string
+	for _, controller := range cgroupControllers {
+		for _, other := range available {
+			if controller == other {
+				enable = append(enable, "+"+controller)
+			}
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	return ioutil.WriteFile(path.Join(dir, "cgroup.subtree_control"),
+		[]byte(strings.Join(enable, " ")), 0644)
+}
+
+// setupCgroup creates the cgroup of the run, if it has one, and
+// makes the process start in it. The returned dir is to be closed
+// after the start.
+func (r *RuntimeTaskInfo) setupCgroup() (*os.File, error) {
+	if r.cgroupDir == "" {
+		return nil, nil
+	}
+
+	if err := os.Mkdir(r.cgroupDir, 0755); err != nil {
+		return nil, err
+	}
+	for _, limit := range []struct {
+		file  string
+		value int64
+	}{
+		{"memory.max", r.limits.Memory},
+		{"cpu.weight", int64(r.limits.CPUWeight)},
+		{"pids.max", r.limits.Pids},
+	} {
+		if limit.value <= 0 {
+			continue
+		}
+		err := ioutil.WriteFile(path.Join(r.cgroupDir, limit.file),
+			[]byte(strconv.FormatInt(limit.value, 10)), 0644)
+		if err != nil {
+			os.Remove(r.cgroupDir)
+			return nil, err
+		}
+	}
+
+	dir, err := os.Open(r.cgroupDir)
+	if err != nil {
+		os.Remove(r.cgroupDir)
+		return nil, err
+	}
+	r.SysProcAttr.UseCgroupFD = true
+	r.SysProcAttr.CgroupFD = int(dir.Fd())
+	return dir, nil
+}
+
+// removeCgroup removes the cgroup of the run once its processes
+// are gone, it tells if one of them has been killed by the OOM
+// killer.
+func (r *RuntimeTaskInfo) removeCgroup() bool {
+	if r.cgroupDir == "" {
+		return false
+	}
+	defer os.Remove(r.cgroupDir)
+
+	file, err := os.Open(path.Join(r.cgroupDir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return fields[1] != "0"
+		}
+	}
+	return false
+}
+
+// limitKill returns the KillReason if the process has been
+// killed because of a limit, otherwise an empty string.
+func (r *RuntimeTaskInfo) limitKill(sig syscall.Signal, cpu time.Duration) string {
+	if r.limits == nil {
+		return ""
+	}
+	switch {
+	case sig == syscall.SIGKILL && r.oomKilled:
+		return KillMemoryLimit
+	case r.limits.CPU > 0 && (sig == syscall.SIGXCPU ||
+		sig == syscall.SIGKILL && cpu >= time.Duration(r.limits.cpuSeconds())*time.Second):
+		return KillCPULimit
+	}
+	return ""
+}
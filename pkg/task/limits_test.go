@@ -0,0 +1,119 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// the runs with rlimits start the test binary
+	Init()
+	os.Exit(m.Run())
+}
+
+type limitsTestCase struct {
+	task       Task
+	output     string
+	killReason string
+}
+
+var allLimitsTests = []limitsTestCase{
+	{
+		task: Task{
+			Name:    "files",
+			Command: []string{"ulimit -n"},
+			Shell:   "bash",
+			Limits:  &Limits{OpenFiles: 16},
+		},
+		output: "16\n",
+	}, {
+		task: Task{
+			Name:    "address",
+			Command: []string{"ulimit -v; ulimit -u"},
+			Shell:   "bash",
+			Limits:  &Limits{AddressSpace: 512 * 1024 * 1024, Processes: 64},
+		},
+		output: "524288\n64\n",
+	}, {
+		task: Task{
+			Name:    "args",
+			Command: []string{"echo", "-n", "a b"},
+			Limits:  &Limits{OpenFiles: 16},
+		},
+		output: "a b",
+	}, {
+		task: Task{
+			Name:    "cpu",
+			Command: []string{"while :; do :; done"},
+			Shell:   "bash",
+			Limits:  &Limits{CPU: Duration(500 * time.Millisecond)},
+		},
+		killReason: KillCPULimit,
+	},
+}
+
+func (test *limitsTestCase) doTest(t *testing.T) {
+	ret := waitTask(test.task, nil, t)
+	if ret.Output != test.output {
+		t.Errorf("Wrong output of %s: %q, expected %q\n", test.task.Name, ret.Output, test.output)
+	}
+	if ret.Result.KillReason != test.killReason {
+		t.Errorf("Wrong kill reason of %s: %q, expected %q\n",
+			test.task.Name, ret.Result.KillReason, test.killReason)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	for _, test := range allLimitsTests {
+		test.doTest(t)
+	}
+
+	// the server has no cgroup
+	memory := Task{
+		Name:    "memory",
+		Command: []string{"true"},
+		Limits:  &Limits{Memory: 1024 * 1024},
+	}
+	if _, err := memory.Prepare(nil); err == nil {
+		t.Errorf("Cgroup limits without a cgroup\n")
+	}
+}
+
+func TestCgroupLimits(t *testing.T) {
+	// a delegated cgroup v2 with the memory controller
+	dir := os.Getenv("GOTASK_TEST_CGROUP")
+	if dir == "" {
+		t.Skip("GOTASK_TEST_CGROUP not set")
+	}
+	if err := EnableCgroup(dir); err != nil {
+		t.Fatalf("Fail to enable the controllers: %s\n", err.Error())
+	}
+
+	test := Task{
+		Name:    "memory",
+		Command: []string{"x=$(head -c 200000000 /dev/zero | tr '\\0' a)"},
+		Shell:   "bash",
+		Limits:  &Limits{Memory: 32 * 1024 * 1024, Pids: 16},
+	}
+	ret := waitTask(test, &RunOptions{ID: "memory", CgroupDir: dir}, t)
+	if ret.Result.KillReason != KillMemoryLimit {
+		t.Errorf("Wrong kill reason: %+v\n", ret.Result)
+	}
+	if _, err := os.Stat(dir + "/memory"); !os.IsNotExist(err) {
+		t.Errorf("Cgroup of the run not removed\n")
+	}
+}
@@ -0,0 +1,137 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MaxCombinations is the most runs of a matrix.
+const MaxCombinations = 256
+
+// Matrix fans a task out: every combination of the
+// values of its vars is a run with these vars.
+type Matrix struct {
+	// the values of each var
+	Vars map[string][]string `json:"vars"`
+	// optional, a combination with all the values
+	// of one of these is not run
+	Exclude []map[string]string `json:"exclude,omitempty"`
+	// the first failed run cancels the others
+	FailFast bool `json:"failFast,omitempty"`
+}
+
+// Combinations returns the combinations of the values,
+// the ones of the first var by name change slowest.
+func (m *Matrix) Combinations() ([]map[string]string, error) {
+	if len(m.Vars) == 0 {
+		return nil, fmt.Errorf("Matrix with no vars")
+	}
+	names := make([]string, 0, len(m.Vars))
+	for name, values := range m.Vars {
+		if name == "" || strings.ContainsAny(name, " ${}") {
+			return nil, fmt.Errorf("Invalid matrix var: %q", name)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("Matrix var %s has no values", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	combinations := []map[string]string{{}}
+	for _, name := range names {
+		next := make([]map[string]string, 0, len(combinations)*len(m.Vars[name]))
+		for _, combination := range combinations {
+			for _, value := range m.Vars[name] {
+				extended := make(map[string]string, len(combination)+1)
+				for k, v := range combination {
+					extended[k] = v
+				}
+				extended[name] = value
+				next = append(next, extended)
+			}
+		}
+		if len(next) > MaxCombinations {
+			return nil, fmt.Errorf("Matrix with more than %d combinations", MaxCombinations)
+		}
+		combinations = next
+	}
+
+	kept := combinations[:0]
+	for _, combination := range combinations {
+		if !m.excluded(combination) {
+			kept = append(kept, combination)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, fmt.Errorf("Matrix with every combination excluded")
+	}
+	return kept, nil
+}
+
+// excluded tells if combination matches one of Exclude.
+func (m *Matrix) excluded(combination map[string]string) bool {
+	for _, exclude := range m.Exclude {
+		if len(exclude) > 0 && matchCombination(exclude, combination) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCombination(values, combination map[string]string) bool {
+	for name, value := range values {
+		if found, ok := combination[name]; !ok || found != value {
+			return false
+		}
+	}
+	return true
+}
+
+// MatrixVars returns a combination as the vars of a run.
+func MatrixVars(combination map[string]string) []Var {
+	vars := make([]Var, 0, len(combination))
+	for name, value := range combination {
+		vars = append(vars, Var{Name: name, Value: value, Type: VarString})
+	}
+	sort.Slice(vars, func(i, k int) bool {
+		return vars[i].Name < vars[k].Name
+	})
+	return vars
+}
+
+// overrideVars returns vars with the ones of
+// override replacing the ones with their name.
+func overrideVars(vars, override []Var) []Var {
+	if len(override) == 0 {
+		return vars
+	}
+	merged := make([]Var, 0, len(vars)+len(override))
+	for _, variable := range vars {
+		replaced := false
+		for _, other := range override {
+			if other.Name == variable.Name {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, variable)
+		}
+	}
+	return append(merged, override...)
+}
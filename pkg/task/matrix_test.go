@@ -0,0 +1,126 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type matrixTestCase struct {
+	matrix Matrix
+	// every combination as NAME=value,NAME=value
+	combinations []string
+	err          bool
+}
+
+func (test *matrixTestCase) doTest(t *testing.T) {
+	combinations, err := test.matrix.Combinations()
+	if (err != nil) != test.err {
+		t.Fatalf("Wrong error of %+v: %v\n", test.matrix, err)
+	}
+
+	found := make([]string, len(combinations))
+	for i, combination := range combinations {
+		pairs := []string{}
+		for _, variable := range MatrixVars(combination) {
+			pairs = append(pairs, variable.Name+"="+variable.Value)
+		}
+		found[i] = strings.Join(pairs, ",")
+	}
+	if !test.err && !reflect.DeepEqual(found, test.combinations) {
+		t.Errorf("Wrong combinations of %+v: %v, expected %v\n",
+			test.matrix, found, test.combinations)
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	tooMany := make([]string, 17)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprint(i)
+	}
+
+	allMatrixTests := []matrixTestCase{
+		{
+			matrix:       Matrix{Vars: map[string][]string{"OS": {"linux", "bsd"}}},
+			combinations: []string{"OS=linux", "OS=bsd"},
+		}, {
+			matrix: Matrix{Vars: map[string][]string{
+				"OS":   {"linux", "bsd"},
+				"ARCH": {"amd64", "arm64"},
+			}},
+			combinations: []string{
+				"ARCH=amd64,OS=linux", "ARCH=amd64,OS=bsd",
+				"ARCH=arm64,OS=linux", "ARCH=arm64,OS=bsd",
+			},
+		}, {
+			matrix: Matrix{
+				Vars: map[string][]string{
+					"OS":   {"linux", "bsd"},
+					"ARCH": {"amd64", "arm64"},
+				},
+				Exclude: []map[string]string{
+					{"OS": "bsd", "ARCH": "arm64"},
+					// no var, nothing excluded
+					{},
+				},
+			},
+			combinations: []string{
+				"ARCH=amd64,OS=linux", "ARCH=amd64,OS=bsd", "ARCH=arm64,OS=linux",
+			},
+		}, {
+			matrix: Matrix{},
+			err:    true,
+		}, {
+			matrix: Matrix{Vars: map[string][]string{"OS": {}}},
+			err:    true,
+		}, {
+			matrix: Matrix{Vars: map[string][]string{"${OS}": {"linux"}}},
+			err:    true,
+		}, {
+			matrix: Matrix{
+				Vars:    map[string][]string{"OS": {"linux"}},
+				Exclude: []map[string]string{{"OS": "linux"}},
+			},
+			err: true,
+		}, {
+			matrix: Matrix{Vars: map[string][]string{
+				"A": tooMany, "B": tooMany,
+			}},
+			err: true,
+		},
+	}
+
+	for _, test := range allMatrixTests {
+		test.doTest(t)
+	}
+}
+
+func TestRunVars(t *testing.T) {
+	runtimeTask, err := (&Task{
+		Name:    "vars",
+		Command: []string{"echo", "${OS}-${ARCH}"},
+	}).Prepare(&RunOptions{Vars: []Var{
+		{Name: "OS", Value: "linux"},
+		{Name: "ARCH", Value: "arm64"},
+	}})
+	if err != nil {
+		t.Fatalf("Fail to prepare: %s\n", err.Error())
+	}
+	if !reflect.DeepEqual(runtimeTask.Args, []string{"echo", "linux-arm64"}) {
+		t.Errorf("Wrong command: %v\n", runtimeTask.Args)
+	}
+}
@@ -0,0 +1,351 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// StreamStdout is the name of the stdout log.
+	StreamStdout = "stdout"
+	// StreamStderr is the name of the stderr log.
+	StreamStderr = "stderr"
+	// StreamMerged is the name of the interleaved log
+	// of a task with MergeOutput.
+	StreamMerged = "merged"
+
+	// mergedTimeFormat is the UTC time of a line of
+	// the merged log, with a fixed width.
+	mergedTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+	// maskLineLimit is the longest line kept in memory
+	// while masking a log, longer lines are split where
+	// no secret may be across.
+	maskLineLimit = 64 * 1024
+)
+
+// LogPath returns the path of the full log of a stream of a run.
+func LogPath(logDir, id, stream string) string {
+	return path.Join(logDir, fmt.Sprintf("%s.%s.log", id, stream))
+}
+
+// outputBuffer keeps at most limit bytes of the output:
+// the first half and the last half, the middle is dropped.
+// A limit <= 0 means no limit.
+type outputBuffer struct {
+	limit int64
+	total int64
+
+	head bytes.Buffer
+	// ring buffer for the tail
+	tail    []byte
+	tailPos int
+	wrapped bool
+}
+
+func newOutputBuffer(limit int64) *outputBuffer {
+	return &outputBuffer{
+		limit: limit,
+	}
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	b.total += int64(n)
+
+	if b.limit <= 0 {
+		return b.head.Write(p)
+	}
+
+	headLimit := b.limit - b.limit/2
+	if room := headLimit - int64(b.head.Len()); room > 0 {
+		if int64(len(p)) <= room {
+			return b.head.Write(p)
+		}
+		b.head.Write(p[:room])
+		p = p[room:]
+	}
+
+	tailLimit := int(b.limit / 2)
+	if tailLimit == 0 {
+		return n, nil
+	}
+	if b.tail == nil {
+		b.tail = make([]byte, tailLimit)
+	}
+	// only the last bytes matter
+	if len(p) > tailLimit {
+		p = p[len(p)-tailLimit:]
+	}
+	for len(p) > 0 {
+		copied := copy(b.tail[b.tailPos:], p)
+		p = p[copied:]
+		b.tailPos += copied
+		if b.tailPos == tailLimit {
+			b.tailPos = 0
+			b.wrapped = true
+		}
+	}
+	return n, nil
+}
+
+// Truncated tells if some output has been dropped.
+func (b *outputBuffer) Truncated() bool {
+	return b.limit > 0 && b.total > b.limit
+}
+
+func (b *outputBuffer) String() string {
+	var tail []byte
+	if b.wrapped {
+		tail = append(append(tail, b.tail[b.tailPos:]...), b.tail[:b.tailPos]...)
+	} else {
+		tail = b.tail[:b.tailPos]
+	}
+
+	if !b.Truncated() {
+		return b.head.String() + string(tail)
+	}
+	dropped := b.total - int64(b.head.Len()) - int64(len(tail))
+	return fmt.Sprintf("%s\n... [%d bytes truncated] ...\n%s", b.head.String(), dropped, tail)
+}
+
+// maskWriter masks the secrets line by line
+// before writing to out.
+type maskWriter struct {
+	out    io.Writer
+	masker *masker
+	line   []byte
+	// write what can be masked at once, not a line at a
+	// time, for who is watching a terminal
+	eager bool
+}
+
+func (w *maskWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		index := bytes.IndexByte(p, '\n')
+		if index == -1 {
+			w.line = append(w.line, p...)
+			if len(w.line) < maskLineLimit && !w.eager {
+				return n, nil
+			}
+			return n, w.flushSafe()
+		}
+		w.line = append(w.line, p[:index+1]...)
+		p = p[index+1:]
+		if err := w.flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// flushSafe writes the part of the line that can be
+// masked alone, the rest waits for the next bytes.
+func (w *maskWriter) flushSafe() error {
+	at := w.masker.split(string(w.line))
+	if at == 0 {
+		return nil
+	}
+	_, err := io.WriteString(w.out, w.masker.mask(string(w.line[:at])))
+	w.line = append(w.line[:0], w.line[at:]...)
+	return err
+}
+
+func (w *maskWriter) flush() error {
+	if len(w.line) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(w.out, w.masker.mask(string(w.line)))
+	w.line = w.line[:0]
+	return err
+}
+
+// sink is where a stream of output goes: a bounded copy
+// in memory and, if enabled, the full log on disk. Both
+// are masked before any byte is dropped or written.
+// It may be written by more goroutines.
+type sink struct {
+	buffer *outputBuffer
+	// to buffer
+	masked *maskWriter
+	log    *maskWriter
+	file   *os.File
+	// error opening the log
+	err   error
+	mutex sync.Mutex
+}
+
+// newSink returns the sink of a stream of the run id.
+func (r *RuntimeTaskInfo) newSink(id, stream string) *sink {
+	s := &sink{
+		buffer: newOutputBuffer(r.maxOutput),
+	}
+	s.masked = &maskWriter{
+		out:    s.buffer,
+		masker: r.masker,
+	}
+	if r.logDir == "" {
+		return s
+	}
+
+	s.file, s.err = os.OpenFile(LogPath(r.logDir, AttemptID(id, r.attempt), stream),
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if s.err == nil {
+		s.log = &maskWriter{
+			out:    s.file,
+			masker: r.masker,
+		}
+	}
+	return s
+}
+
+func (s *sink) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.masked.Write(p)
+	if s.log != nil {
+		if _, err := s.log.Write(p); err != nil {
+			// keep reading the pipe, or the process would block
+			s.err = err
+			s.log = nil
+		}
+	}
+	return len(p), nil
+}
+
+// close flushes the log, returning the first error
+// occurred writing it.
+func (s *sink) close() error {
+	if s.masked != nil {
+		s.masked.flush()
+	}
+	if s.file == nil {
+		return s.err
+	}
+	if s.log != nil {
+		if err := s.log.flush(); err != nil && s.err == nil {
+			s.err = err
+		}
+	}
+	if err := s.file.Close(); err != nil && s.err == nil {
+		s.err = err
+	}
+	return s.err
+}
+
+// mergedLine formats a line of the merged log.
+func mergedLine(at time.Time, stream string, line []byte) []byte {
+	tagged := make([]byte, 0, len(line)+len(mergedTimeFormat)+len(stream)+5)
+	tagged = at.UTC().AppendFormat(tagged, mergedTimeFormat)
+	tagged = append(tagged, ' ')
+	tagged = append(tagged, stream...)
+	tagged = append(tagged, " | "...)
+	tagged = append(tagged, line...)
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		tagged = append(tagged, '\n')
+	}
+	return tagged
+}
+
+// copyLines copies pipe to out a line at a time, tagging
+// every line with the time it has been read and the stream.
+// A longer line than maskLineLimit is tagged in pieces, a
+// piece never ends inside one of the secrets of masker.
+func copyLines(out io.Writer, pipe io.Reader, stream string, masker *masker) error {
+	reader := bufio.NewReaderSize(pipe, maskLineLimit)
+	// the end of the last piece, it may be the start of a secret
+	var held []byte
+	for {
+		line, err := reader.ReadSlice('\n')
+		// a copy, the buffer of reader is reused
+		line = append(held, line...)
+		held = nil
+		if err == bufio.ErrBufferFull {
+			at := masker.split(string(line))
+			// the line is not kept whole in memory
+			if at == 0 {
+				at = len(line)
+			}
+			held = append(held, line[at:]...)
+			line = line[:at]
+		}
+		if len(line) > 0 {
+			out.Write(mergedLine(time.Now(), stream, line))
+		}
+		switch err {
+		case nil, bufio.ErrBufferFull:
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// drain reads stdout and stderr at the same time till the
+// end: a process filling one of them is never blocked.
+// In merged mode the output is a single interleaved log.
+func (r *RuntimeTaskInfo) drain(id string) (out, errOut *sink, outErr, errErr error) {
+	if r.Terminal != nil {
+		// a single stream
+		out, outErr = r.drainTerminal(id)
+		return out, &sink{buffer: newOutputBuffer(0)}, outErr, nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	if r.merged {
+		out = r.newSink(id, StreamMerged)
+		errOut = &sink{buffer: newOutputBuffer(0)}
+		go func() {
+			defer wg.Done()
+			outErr = copyLines(out, r.OutPipe, StreamStdout, r.masker)
+		}()
+		go func() {
+			defer wg.Done()
+			errErr = copyLines(out, r.ErrPipe, StreamStderr, r.masker)
+		}()
+	} else {
+		out = r.newSink(id, StreamStdout)
+		errOut = r.newSink(id, StreamStderr)
+		go func() {
+			defer wg.Done()
+			_, outErr = io.Copy(out, r.OutPipe)
+		}()
+		go func() {
+			defer wg.Done()
+			_, errErr = io.Copy(errOut, r.ErrPipe)
+		}()
+	}
+	wg.Wait()
+
+	if err := out.close(); outErr == nil {
+		outErr = err
+	}
+	if err := errOut.close(); errErr == nil {
+		errErr = err
+	}
+	return out, errOut, outErr, errErr
+}
@@ -0,0 +1,301 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type outputBufferTestCase struct {
+	limit     int64
+	writes    []string
+	expected  string
+	truncated bool
+}
+
+var allOutputBufferTests = []outputBufferTestCase{
+	{
+		limit:    0,
+		writes:   []string{"hello ", "world"},
+		expected: "hello world",
+	}, {
+		limit:    20,
+		writes:   []string{"hello ", "world"},
+		expected: "hello world",
+	}, {
+		limit:     6,
+		writes:    []string{"abc", "defgh", "ij"},
+		expected:  "abc\n... [4 bytes truncated] ...\nhij",
+		truncated: true,
+	}, {
+		limit:     4,
+		writes:    []string{"0123456789"},
+		expected:  "01\n... [6 bytes truncated] ...\n89",
+		truncated: true,
+	},
+}
+
+func (test *outputBufferTestCase) doTest(t *testing.T) {
+	buffer := newOutputBuffer(test.limit)
+	for _, w := range test.writes {
+		if n, err := buffer.Write([]byte(w)); err != nil || n != len(w) {
+			t.Fatalf("Bad write: %d %v", n, err)
+		}
+	}
+	if got := buffer.String(); got != test.expected {
+		t.Errorf("Output mismatch:\ngot: %q\nexpected: %q\n", got, test.expected)
+	}
+	if buffer.Truncated() != test.truncated {
+		t.Errorf("Truncated mismatch for %q", test.expected)
+	}
+}
+
+func TestOutputBuffer(t *testing.T) {
+	for _, testCase := range allOutputBufferTests {
+		testCase.doTest(t)
+	}
+}
+
+func TestOutputSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotask-logs")
+	if err != nil {
+		t.Fatalf("Fail to create dir: %s\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	test := Task{
+		Name:       "spill",
+		Command:    []string{"seq", "1", "1000"},
+		ShowOutput: true,
+		MaxOutput:  100,
+	}
+
+	taskInfo, err := test.RunWith(&RunOptions{LogDir: dir})
+	if err != nil {
+		t.Fatalf("Fail to run task: %s\n", err.Error())
+	}
+
+	doneChan := make(chan *CmdDoneChan)
+	errChan := make(chan *CmdDoneChan)
+	taskInfo.WaitPoll("spill", doneChan, errChan)
+
+	select {
+	case ret := <-doneChan:
+		if !ret.Truncated || !strings.HasPrefix(ret.Output, "1\n2\n") ||
+			!strings.HasSuffix(ret.Output, "999\n1000\n") || len(ret.Output) > 150 {
+			t.Errorf("Output not bounded: %q", ret.Output)
+		}
+	case ret := <-errChan:
+		t.Fatalf("Task finished with error: %s\n", ret.Error)
+	}
+
+	data, err := ioutil.ReadFile(LogPath(dir, "spill", StreamStdout))
+	if err != nil {
+		t.Fatalf("Missing log: %s\n", err.Error())
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1000 {
+		t.Errorf("Log not complete: %d lines", lines)
+	}
+}
+
+// waitTask runs test and returns what WaitPoll sends.
+func waitTask(test Task, opts *RunOptions, t *testing.T) *CmdDoneChan {
+	taskInfo, err := test.RunWith(opts)
+	if err != nil {
+		t.Fatalf("Fail to run task: %s\n", err.Error())
+	}
+
+	doneChan := make(chan *CmdDoneChan)
+	errChan := make(chan *CmdDoneChan)
+	taskInfo.WaitPoll(test.Name, doneChan, errChan)
+
+	select {
+	case ret := <-doneChan:
+		return ret
+	case ret := <-errChan:
+		return ret
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Task %s blocked", test.Name)
+	}
+	return nil
+}
+
+func TestFullStderr(t *testing.T) {
+	// more than a pipe buffer on stderr before any stdout
+	test := Task{
+		Name:    "stderr",
+		Command: []string{"head -c 200000 /dev/zero >&2; echo done"},
+		Shell:   "bash",
+	}
+
+	ret := waitTask(test, nil, t)
+	if ret.Output != "done\n" || len(ret.Error) != 200000 {
+		t.Errorf("Wrong output: %q, stderr of %d bytes", ret.Output, len(ret.Error))
+	}
+}
+
+func TestMergeOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotask-logs")
+	if err != nil {
+		t.Fatalf("Fail to create dir: %s\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	test := Task{
+		Name:        "merged",
+		Command:     []string{"echo one; sleep 0.1; echo two >&2; sleep 0.1; echo -n three"},
+		Shell:       "bash",
+		MergeOutput: true,
+	}
+
+	ret := waitTask(test, &RunOptions{LogDir: dir}, t)
+	if ret.Error != "" {
+		t.Errorf("Unexpected stderr: %q", ret.Error)
+	}
+
+	expected := []string{
+		"stdout | one",
+		"stderr | two",
+		"stdout | three",
+	}
+	lines := strings.Split(strings.TrimSuffix(ret.Output, "\n"), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Wrong merged output: %q", ret.Output)
+	}
+	var last time.Time
+	for i, line := range lines {
+		at, err := time.Parse(mergedTimeFormat, line[:len(mergedTimeFormat)])
+		if err != nil || at.Before(last) {
+			t.Errorf("Bad time in line %q", line)
+		}
+		last = at
+		if got := line[len(mergedTimeFormat)+1:]; got != expected[i] {
+			t.Errorf("Line mismatch:\ngot: %s\nexpected: %s\n", got, expected[i])
+		}
+	}
+
+	data, err := ioutil.ReadFile(LogPath(dir, "merged", StreamMerged))
+	if err != nil {
+		t.Fatalf("Missing log: %s\n", err.Error())
+	}
+	if string(data) != ret.Output {
+		t.Errorf("Log mismatch:\ngot: %q\nexpected: %q\n", data, ret.Output)
+	}
+}
+
+func TestMaskedTruncation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotask-mask")
+	if err != nil {
+		t.Fatalf("Fail to create dir: %s\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ioutil.WriteFile(path.Join(dir, VarFileName), nil, 0644); err != nil {
+		t.Fatalf("Cannot write var file: %s", err.Error())
+	}
+	if err = ioutil.WriteFile(path.Join(dir, SecretFileName),
+		[]byte("TOKEN: SUPERSECRETVALUE\n"), 0600); err != nil {
+		t.Fatalf("Cannot write secret file: %s", err.Error())
+	}
+
+	// the head and the tail end inside the secret
+	test := Task{
+		Name:       "mask",
+		Command:    []string{"echo -n 12345$TOKEN; head -c 100 /dev/zero; echo -n ${TOKEN}6789"},
+		Dir:        dir,
+		Shell:      "bash",
+		ShowOutput: true,
+		MaxOutput:  20,
+	}
+
+	ret := waitTask(test, nil, t)
+	if !ret.Truncated || strings.Contains(ret.Output, "SUPER") ||
+		strings.Contains(ret.Output, "VALUE") {
+		t.Errorf("Secret not masked: %q\n", ret.Output)
+	}
+}
+
+func TestMaskLongLine(t *testing.T) {
+	var out strings.Builder
+	writer := &maskWriter{
+		out:    &out,
+		masker: newMasker([]Var{{Name: "TOKEN", Value: "SECRETXYZ", Secret: true}}),
+	}
+
+	// the first write ends inside the secret,
+	// the third one starts inside it
+	writer.Write([]byte(strings.Repeat("a", maskLineLimit) + "SECR"))
+	writer.Write([]byte("ETXYZ" + strings.Repeat("b", maskLineLimit) + "SEC"))
+	writer.Write([]byte("RETXYZ\n"))
+	writer.flush()
+
+	expected := strings.Repeat("a", maskLineLimit) + SecretMask +
+		strings.Repeat("b", maskLineLimit) + SecretMask + "\n"
+	if out.String() != expected {
+		t.Errorf("Secret not masked across the split: %q\n",
+			out.String()[maskLineLimit-5:maskLineLimit+20])
+	}
+}
+
+func TestMaskMergedLongLine(t *testing.T) {
+	masker := newMasker([]Var{{Name: "TOKEN", Value: "SUPERSECRETVALUE", Secret: true}})
+	var out strings.Builder
+	writer := &maskWriter{out: &out, masker: masker}
+
+	// the buffer of the reader is full inside the secret
+	line := strings.Repeat("a", maskLineLimit-4) + "SUPERSECRETVALUE\n"
+	if err := copyLines(writer, strings.NewReader(line), StreamStdout, masker); err != nil {
+		t.Fatalf("Fail to copy: %s\n", err.Error())
+	}
+	writer.flush()
+
+	if strings.Contains(out.String(), "SUPE") || strings.Contains(out.String(), "VALUE") ||
+		!strings.HasSuffix(out.String(), " "+StreamStdout+" | "+SecretMask+"\n") {
+		t.Errorf("Secret not masked across the pieces: %q\n",
+			out.String()[len(out.String())-80:])
+	}
+}
+
+func TestMaskEager(t *testing.T) {
+	var out strings.Builder
+	writer := &maskWriter{
+		out:    &out,
+		masker: newMasker([]Var{{Name: "TOKEN", Value: "SECRETXYZ", Secret: true}}),
+		eager:  true,
+	}
+
+	// a prompt is written at once, the start
+	// of a secret waits for the rest
+	steps := []struct {
+		write, expected string
+	}{
+		{"password: ", "password: "},
+		{"SEC", "password: "},
+		{"RETXYZ ok", "password: " + SecretMask + " ok"},
+		{" SECRETX", "password: " + SecretMask + " ok "},
+		{"Y\n", "password: " + SecretMask + " ok SECRETXY\n"},
+	}
+	for _, step := range steps {
+		writer.Write([]byte(step.write))
+		if out.String() != step.expected {
+			t.Errorf("Wrong output after %q: %q, expected %q\n",
+				step.write, out.String(), step.expected)
+		}
+	}
+}
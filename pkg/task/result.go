@@ -0,0 +1,172 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The reasons for which the server kills a process.
+const (
+	KillTimeout  = "timeout"
+	KillCancel   = "cancel"
+	KillShutdown = "shutdown"
+	// another run of the same matrix has failed
+	KillFailFast = "failFast"
+
+	// the process has gone over Limits.CPU
+	KillCPULimit = "cpuLimit"
+	// the OOM killer has killed the process, the
+	// cgroup of the run has gone over Limits.Memory
+	KillMemoryLimit = "memoryLimit"
+)
+
+// RunResult describes how a process ended.
+type RunResult struct {
+	// -1 if terminated by a signal
+	ExitCode int `json:"exitCode"`
+	// the signal that terminated the process
+	Signal string `json:"signal,omitempty"`
+
+	// the process has been killed by the server,
+	// KillReason tells why
+	Killed     bool   `json:"killed,omitempty"`
+	KillReason string `json:"killReason,omitempty"`
+
+	StartAt  time.Time `json:"startAt"`
+	EndAt    time.Time `json:"endAt"`
+	Duration Duration  `json:"duration"`
+
+	// resources used by the process
+	UserCPU Duration `json:"userCPU"`
+	SysCPU  Duration `json:"sysCPU"`
+	// in kilobytes
+	MaxRSS int64 `json:"maxRSS"`
+
+	// the processes of the group still running
+	// after the task, they have been killed
+	Leftover []int `json:"leftover,omitempty"`
+
+	// the vars given to the process by the task,
+	// NAME=value, without the secrets
+	Env []string `json:"env,omitempty"`
+
+	// the temporary directory of the run, it may
+	// have been removed by its cleanup
+	RunDir string `json:"runDir,omitempty"`
+
+	// the files kept after the run, set
+	// by the supervisor of the run
+	Artifacts []Artifact `json:"artifacts,omitempty"`
+}
+
+// runState is shared by all the copies
+// of a RuntimeTaskInfo.
+type runState struct {
+	killReason string
+	timer      *time.Timer
+	// the process has been waited
+	exited bool
+	// set once started
+	execution Execution
+	*sync.Mutex
+}
+
+func newRunState() *runState {
+	return &runState{
+		Mutex: &sync.Mutex{},
+	}
+}
+
+// Kill kills the process and its group, reason is reported
+// in the RunResult. Only the first reason is kept.
+func (r *RuntimeTaskInfo) Kill(reason string) error {
+	if r.execution() == nil {
+		return nil
+	}
+
+	r.state.Lock()
+	if r.state.killReason == "" {
+		r.state.killReason = reason
+	}
+	r.state.Unlock()
+
+	return r.Signal(syscall.SIGKILL)
+}
+
+// execution returns the process, nil if not started.
+func (r *RuntimeTaskInfo) execution() Execution {
+	if r.state == nil {
+		return nil
+	}
+	r.state.Lock()
+	defer r.state.Unlock()
+	return r.state.execution
+}
+
+// startTimeout kills the process after timeout.
+func (r *RuntimeTaskInfo) startTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	r.state.Lock()
+	r.state.timer = time.AfterFunc(timeout, func() {
+		r.Kill(KillTimeout)
+	})
+	r.state.Unlock()
+}
+
+// result builds the RunResult once the process is done,
+// it stops the timeout too.
+func (r *RuntimeTaskInfo) result() *RunResult {
+	r.state.Lock()
+	defer r.state.Unlock()
+	if r.state.timer != nil {
+		r.state.timer.Stop()
+	}
+
+	result := &RunResult{
+		ExitCode:   -1,
+		Killed:     r.state.killReason != "",
+		KillReason: r.state.killReason,
+		StartAt:    r.StartAt,
+		EndAt:      r.EndAt,
+		Duration:   Duration(r.EndAt.Sub(r.StartAt)),
+		Env:        r.environ,
+	}
+	if r.workspace != nil {
+		result.RunDir = r.workspace.runDir
+	}
+
+	status := r.status
+	if status == nil {
+		return result
+	}
+
+	result.ExitCode = status.ExitCode
+	result.UserCPU = Duration(status.UserCPU)
+	result.SysCPU = Duration(status.SysCPU)
+	result.MaxRSS = status.MaxRSS
+	if status.Signal != 0 {
+		result.Signal = status.Signal.String()
+		reason := r.limitKill(status.Signal, status.UserCPU+status.SysCPU)
+		if reason != "" && !result.Killed {
+			result.Killed = true
+			result.KillReason = reason
+		}
+	}
+	return result
+}
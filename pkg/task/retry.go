@@ -0,0 +1,154 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// The backoff strategies of a RetryPolicy.
+const (
+	BackoffFixed       = "fixed"
+	BackoffExponential = "exponential"
+)
+
+// MaxRetryDelay is the longest wait of an exponential
+// backoff with no MaxDelay.
+const MaxRetryDelay = 24 * time.Hour
+
+// RetryPolicy tells when a failed run of a task
+// is tried again, and after how long.
+type RetryPolicy struct {
+	// the most runs, the first included
+	MaxAttempts int `json:"maxAttempts"`
+
+	// BackoffFixed, the default, or BackoffExponential
+	Backoff string `json:"backoff,omitempty"`
+	// the time before the first retry
+	Delay Duration `json:"delay,omitempty"`
+	// optional, the longest time between two attempts
+	MaxDelay Duration `json:"maxDelay,omitempty"`
+	// between 0 and 1, the fraction of the delay
+	// randomly taken away
+	Jitter float64 `json:"jitter,omitempty"`
+
+	// optional, retry only if the exit code
+	// is one of these
+	ExitCodes []int `json:"exitCodes,omitempty"`
+}
+
+// Attempt is a run of a task with a RetryPolicy.
+type Attempt struct {
+	Output    string     `json:"output,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Result    *RunResult `json:"run,omitempty"`
+	Truncated bool       `json:"truncated,omitempty"`
+	// with an OutputFormat
+	Structured json.RawMessage `json:"result,omitempty"`
+}
+
+// NewAttempt returns the attempt described by res.
+func NewAttempt(res *CmdDoneChan) Attempt {
+	return Attempt{
+		Output:     res.Output,
+		Error:      res.Error,
+		Result:     res.Result,
+		Truncated:  res.Truncated,
+		Structured: res.Structured,
+	}
+}
+
+// AttemptID returns the ID used for the logs of an attempt
+// of the run id, the first attempt uses id itself.
+func AttemptID(id string, attempt int) string {
+	if attempt <= 1 {
+		return id
+	}
+	return fmt.Sprintf("%s.%d", id, attempt)
+}
+
+// Retry tells if a run should be tried again after the
+// attempt, counted from 1, ended with res. A run cancelled, stopped
+// by the shutdown or by a fail-fast matrix is never tried again.
+func (p *RetryPolicy) Retry(attempt int, res *CmdDoneChan, failed bool) bool {
+	if p == nil || !failed || attempt >= p.MaxAttempts || res.Skipped {
+		return false
+	}
+	if res.Result == nil {
+		// not even started
+		return len(p.ExitCodes) == 0
+	}
+	switch res.Result.KillReason {
+	case KillCancel, KillShutdown, KillFailFast:
+		return false
+	}
+	if len(p.ExitCodes) == 0 {
+		return true
+	}
+	for _, code := range p.ExitCodes {
+		if res.Result.ExitCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the policy makes sense.
+func (p *RetryPolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	switch p.Backoff {
+	case "", BackoffFixed, BackoffExponential:
+	default:
+		return fmt.Errorf("Unknown backoff: %s", p.Backoff)
+	}
+	if p.MaxAttempts < 0 || p.Delay < 0 || p.MaxDelay < 0 {
+		return fmt.Errorf("Negative retry policy")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("Jitter not in [0, 1]: %g", p.Jitter)
+	}
+	return nil
+}
+
+// Wait returns the time to wait after the attempt,
+// counted from 1, before the next one.
+func (p *RetryPolicy) Wait(attempt int) time.Duration {
+	ceiling := time.Duration(p.MaxDelay)
+	if ceiling <= 0 {
+		ceiling = MaxRetryDelay
+	}
+	delay := time.Duration(p.Delay)
+	if p.Backoff == BackoffExponential {
+		// stopped before it overflows
+		for i := 1; i < attempt && delay > 0 && delay < ceiling; i++ {
+			delay *= 2
+		}
+	}
+	if delay > ceiling {
+		delay = ceiling
+	}
+	if p.Jitter > 0 && delay > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		delay -= time.Duration(rand.Float64() * jitter * float64(delay))
+	}
+	return delay
+}
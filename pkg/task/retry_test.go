@@ -0,0 +1,179 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"testing"
+	"time"
+)
+
+type retryTestCase struct {
+	policy   *RetryPolicy
+	attempt  int
+	res      CmdDoneChan
+	failed   bool
+	expected bool
+}
+
+var allRetryTests = []retryTestCase{
+	{
+		policy:   nil,
+		attempt:  1,
+		res:      CmdDoneChan{Result: &RunResult{ExitCode: 1}},
+		failed:   true,
+		expected: false,
+	}, {
+		policy:   &RetryPolicy{MaxAttempts: 3},
+		attempt:  1,
+		res:      CmdDoneChan{Result: &RunResult{ExitCode: 1}},
+		failed:   true,
+		expected: true,
+	}, {
+		policy:   &RetryPolicy{MaxAttempts: 3},
+		attempt:  1,
+		res:      CmdDoneChan{Result: &RunResult{}},
+		failed:   false,
+		expected: false,
+	}, {
+		policy:   &RetryPolicy{MaxAttempts: 3},
+		attempt:  3,
+		res:      CmdDoneChan{Result: &RunResult{ExitCode: 1}},
+		failed:   true,
+		expected: false,
+	}, {
+		policy:   &RetryPolicy{MaxAttempts: 3, ExitCodes: []int{75}},
+		attempt:  1,
+		res:      CmdDoneChan{Result: &RunResult{ExitCode: 1}},
+		failed:   true,
+		expected: false,
+	}, {
+		policy:   &RetryPolicy{MaxAttempts: 3, ExitCodes: []int{75}},
+		attempt:  2,
+		res:      CmdDoneChan{Result: &RunResult{ExitCode: 75}},
+		failed:   true,
+		expected: true,
+	}, {
+		policy:   &RetryPolicy{MaxAttempts: 3},
+		attempt:  1,
+		res:      CmdDoneChan{Result: &RunResult{ExitCode: -1, Killed: true, KillReason: KillCancel}},
+		failed:   true,
+		expected: false,
+	}, {
+		policy:   &RetryPolicy{MaxAttempts: 3},
+		attempt:  1,
+		res:      CmdDoneChan{Result: &RunResult{ExitCode: -1, Killed: true, KillReason: KillTimeout}},
+		failed:   true,
+		expected: true,
+	},
+}
+
+func (test *retryTestCase) doTest(t *testing.T) {
+	if got := test.policy.Retry(test.attempt, &test.res, test.failed); got != test.expected {
+		t.Errorf("Retry mismatch for %+v at %d:\ngot: %v\nexpected: %v\n",
+			test.policy, test.attempt, got, test.expected)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	for _, testCase := range allRetryTests {
+		testCase.doTest(t)
+	}
+}
+
+type backoffTestCase struct {
+	policy   RetryPolicy
+	expected []time.Duration
+}
+
+var allBackoffTests = []backoffTestCase{
+	{
+		policy: RetryPolicy{
+			Delay: Duration(time.Second),
+		},
+		expected: []time.Duration{time.Second, time.Second, time.Second},
+	}, {
+		policy: RetryPolicy{
+			Backoff: BackoffExponential,
+			Delay:   Duration(time.Second),
+		},
+		expected: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+	}, {
+		policy: RetryPolicy{
+			Backoff:  BackoffExponential,
+			Delay:    Duration(time.Second),
+			MaxDelay: Duration(3 * time.Second),
+		},
+		expected: []time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+	}, {
+		policy: RetryPolicy{
+			Backoff: BackoffExponential,
+			Delay:   Duration(time.Hour),
+		},
+		expected: []time.Duration{time.Hour, 2 * time.Hour, 4 * time.Hour,
+			8 * time.Hour, 16 * time.Hour, MaxRetryDelay, MaxRetryDelay},
+	},
+}
+
+func (test *backoffTestCase) doTest(t *testing.T) {
+	for i, expected := range test.expected {
+		if got := test.policy.Wait(i + 1); got != expected {
+			t.Errorf("Wait mismatch for %+v at %d:\ngot: %s\nexpected: %s\n",
+				test.policy, i+1, got, expected)
+		}
+	}
+
+	// the jitter only shortens the wait
+	jittered := test.policy
+	jittered.Jitter = 0.5
+	for i, expected := range test.expected {
+		if got := jittered.Wait(i + 1); got > expected || got < expected/2 {
+			t.Errorf("Jitter out of range at %d: %s\n", i+1, got)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, testCase := range allBackoffTests {
+		testCase.doTest(t)
+	}
+
+	// far past the overflow of the doubling
+	policy := RetryPolicy{Backoff: BackoffExponential, Delay: Duration(time.Second)}
+	if got := policy.Wait(100); got != MaxRetryDelay {
+		t.Errorf("Wait not bounded: %s\n", got)
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	invalid := []RetryPolicy{
+		{MaxAttempts: 3, Backoff: "exponentail"},
+		{MaxAttempts: -1},
+		{MaxAttempts: 3, Delay: Duration(-time.Second)},
+		{MaxAttempts: 3, MaxDelay: Duration(-time.Second)},
+		{MaxAttempts: 3, Jitter: -0.5},
+		{MaxAttempts: 3, Jitter: 1.5},
+	}
+	for _, policy := range invalid {
+		test := Task{Name: "retry", Command: []string{"true"}, Retry: &policy}
+		if _, err := test.Prepare(nil); err == nil {
+			t.Errorf("Invalid policy accepted: %+v\n", policy)
+		}
+	}
+
+	test := Task{Name: "retry", Command: []string{"true"},
+		Retry: &RetryPolicy{MaxAttempts: 3, Backoff: BackoffFixed, Jitter: 0.5}}
+	if _, err := test.Prepare(nil); err != nil {
+		t.Errorf("Valid policy rejected: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,297 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"syscall"
+)
+
+// DefaultSandboxPaths are the paths of the host available
+// read-only in a Sandbox with no ReadOnly.
+var DefaultSandboxPaths = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/etc"}
+
+// sandboxDevices are the devices of the host
+// available in a sandbox.
+var sandboxDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// the flags of a mount kept by a read-only bind,
+// a user namespace can't drop them
+const lockedMountFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+	syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME
+
+// Sandbox isolates a run using Linux namespaces, it needs no
+// privilege. The process has its own user, mount and PID
+// namespaces: it's root and PID 1 there, but it can't do more
+// than the server on the host. Its root is empty but for the
+// paths bound from the host, /proc, a few devices and a private
+// /tmp.
+type Sandbox struct {
+	// the paths of the host available read-only, if
+	// empty DefaultSandboxPaths, the Dir of the task
+	// is always available
+	ReadOnly []string `json:"readOnly,omitempty"`
+	// the paths of the host available read-write
+	Writable []string `json:"writable,omitempty"`
+	// a network namespace too, with no network:
+	// not even the loopback is up
+	NoNetwork bool `json:"noNetwork,omitempty"`
+}
+
+// sandboxBind is a path of the host
+// available in the sandbox.
+type sandboxBind struct {
+	Path     string `json:"path"`
+	Writable bool   `json:"writable,omitempty"`
+}
+
+// sandboxRequest is what Init needs to set up a sandbox.
+type sandboxRequest struct {
+	// created by Init, the server removes it
+	Root  string        `json:"root"`
+	Binds []sandboxBind `json:"binds"`
+	Dir   string        `json:"dir"`
+}
+
+// apply makes cmd start in the namespaces of the sandbox,
+// it returns what Init has to do in them.
+func (s *Sandbox) apply(cmd *exec.Cmd, runDir string) (*sandboxRequest, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	request := &sandboxRequest{
+		Root: path.Join(os.TempDir(), "gotask-sandbox-"+hex.EncodeToString(random)),
+		Dir:  cmd.Dir,
+	}
+
+	readOnly := s.ReadOnly
+	if len(readOnly) == 0 {
+		readOnly = DefaultSandboxPaths
+	}
+	binds := make(map[string]bool)
+	for _, bindPath := range readOnly {
+		binds[path.Clean(bindPath)] = false
+	}
+	if cmd.Dir != "" {
+		binds[path.Clean(cmd.Dir)] = false
+	}
+	for _, bindPath := range s.Writable {
+		binds[path.Clean(bindPath)] = true
+	}
+	// the temporary directory is the one of the process
+	if runDir != "" {
+		binds[runDir] = true
+	}
+	for bindPath, writable := range binds {
+		if !path.IsAbs(bindPath) {
+			return nil, fmt.Errorf("Sandbox path not absolute: %s", bindPath)
+		}
+		request.Binds = append(request.Binds, sandboxBind{
+			Path:     bindPath,
+			Writable: writable,
+		})
+	}
+	// the parents first
+	sort.Slice(request.Binds, func(i, j int) bool {
+		return request.Binds[i].Path < request.Binds[j].Path
+	})
+
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+	if s.NoNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+	cmd.SysProcAttr.Cloneflags = uintptr(flags)
+	// root in the sandbox is the server on the host
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{
+		{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+	}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{
+		{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+	}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	return request, nil
+}
+
+// setup is called by Init in the namespaces of the
+// sandbox: it builds the root and moves into it.
+func (s *sandboxRequest) setup() error {
+	// nothing goes back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+	if err := os.Mkdir(s.Root, 0700); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", s.Root, "tmpfs", 0, "mode=0755"); err != nil {
+		return err
+	}
+
+	// before the binds, that may be in it
+	tmp := path.Join(s.Root, "tmp")
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return err
+	}
+
+	for _, bind := range s.Binds {
+		if err := s.bind(bind); err != nil {
+			return fmt.Errorf("%s: %s", bind.Path, err.Error())
+		}
+	}
+
+	proc := path.Join(s.Root, "proc")
+	if err := os.MkdirAll(proc, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return err
+	}
+	if err := s.devices(); err != nil {
+		return err
+	}
+
+	oldRoot := path.Join(s.Root, ".oldroot")
+	if err := os.Mkdir(oldRoot, 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(s.Root, oldRoot); err != nil {
+		return err
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.oldroot", syscall.MNT_DETACH); err != nil {
+		return err
+	}
+	if err := os.Remove("/.oldroot"); err != nil {
+		return err
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		return err
+	}
+
+	dir := s.Dir
+	if dir == "" {
+		dir = "/"
+	}
+	return syscall.Chdir(dir)
+}
+
+// bind makes a path of the host available in the root,
+// a missing one is skipped.
+func (s *sandboxRequest) bind(bind sandboxBind) error {
+	info, err := os.Lstat(bind.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	target := path.Join(s.Root, bind.Path)
+	if err = os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		// such as /bin -> usr/bin
+		link, err := os.Readlink(bind.Path)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	case info.IsDir():
+		err = os.MkdirAll(target, 0755)
+	default:
+		err = touch(target)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = syscall.Mount(bind.Path, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	if bind.Writable {
+		return nil
+	}
+
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(target, &stat); err != nil {
+		return err
+	}
+	flags := uintptr(stat.Flags) & lockedMountFlags
+	return syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|flags, "")
+}
+
+// devices makes the devices of the host
+// available in /dev of the root.
+func (s *sandboxRequest) devices() error {
+	dev := path.Join(s.Root, "dev")
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return err
+	}
+	for _, device := range sandboxDevices {
+		source := path.Join("/dev", device)
+		if _, err := os.Stat(source); err != nil {
+			continue
+		}
+		target := path.Join(dev, device)
+		if err := touch(target); err != nil {
+			return err
+		}
+		if err := syscall.Mount(source, target, "", syscall.MS_BIND, ""); err != nil {
+			return err
+		}
+	}
+
+	for name, link := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		if err := os.Symlink(link, path.Join(dev, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// touch creates an empty file.
+func touch(name string) error {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// removeSandbox removes the root of the sandbox, it's
+// empty on the host once the namespaces are gone.
+func (r *RuntimeTaskInfo) removeSandbox() {
+	if r.sandboxRoot != "" {
+		os.Remove(r.sandboxRoot)
+	}
+}
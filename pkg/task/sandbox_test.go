@@ -0,0 +1,129 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+type sandboxTestCase struct {
+	name    string
+	command string
+	dir     string
+	sandbox Sandbox
+	output  string
+}
+
+func (test *sandboxTestCase) doTest(t *testing.T) {
+	toRun := Task{
+		Name:    test.name,
+		Command: []string{test.command},
+		Shell:   "bash",
+		Dir:     test.dir,
+		Sandbox: &test.sandbox,
+	}
+	ret := waitTask(toRun, nil, t)
+	if ret.Output != test.output {
+		t.Errorf("Wrong output of %s: %q, expected %q, error %q\n",
+			test.name, ret.Output, test.output, ret.Error)
+	}
+}
+
+// userNamespaces tells if the unprivileged
+// user namespaces are available.
+func userNamespaces() bool {
+	data, err := ioutil.ReadFile("/proc/sys/user/max_user_namespaces")
+	return err == nil && strings.TrimSpace(string(data)) != "0"
+}
+
+func TestSandbox(t *testing.T) {
+	if !userNamespaces() {
+		t.Skip("No user namespaces")
+	}
+
+	dir, err := ioutil.TempDir("", "gotask-sandbox-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(path.Join(dir, VarFileName), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writable, err := ioutil.TempDir("", "gotask-sandbox-writable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(writable)
+	// not bound, so not there
+	hidden, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	private := path.Join(os.TempDir(), "gotask-sandbox-private")
+
+	allSandboxTests := []sandboxTestCase{
+		{
+			name:    "pid",
+			command: "echo $$",
+			output:  "1\n",
+		}, {
+			name:    "readOnly",
+			command: "touch /usr/gotask-sandbox 2>/dev/null || echo ro",
+			output:  "ro\n",
+		}, {
+			name:    "tmp",
+			command: "echo a > " + private + " && cat " + private,
+			output:  "a\n",
+		}, {
+			name:    "hidden",
+			command: "test -e " + hidden + " || echo hidden",
+			output:  "hidden\n",
+		}, {
+			name:    "network",
+			command: "tail -n +3 /proc/net/dev | cut -d: -f1 | tr -d ' '",
+			sandbox: Sandbox{NoNetwork: true},
+			output:  "lo\n",
+		}, {
+			name:    "writable",
+			command: "echo b > " + writable + "/out; touch out 2>/dev/null || echo $PWD",
+			dir:     dir,
+			sandbox: Sandbox{Writable: []string{writable}},
+			output:  dir + "\n",
+		},
+	}
+	for _, test := range allSandboxTests {
+		test.doTest(t)
+	}
+
+	if _, err := os.Stat(private); !os.IsNotExist(err) {
+		t.Errorf("The private /tmp is on the host\n")
+	}
+	if data, err := ioutil.ReadFile(path.Join(writable, "out")); err != nil || string(data) != "b\n" {
+		t.Errorf("Wrong writable file: %q, %v\n", data, err)
+	}
+
+	identity := Task{
+		Name:    "identity",
+		Command: []string{"true"},
+		User:    "nobody",
+		Sandbox: &Sandbox{},
+	}
+	if _, err := identity.Prepare(nil); err == nil {
+		t.Errorf("Sandbox with an identity accepted\n")
+	}
+}
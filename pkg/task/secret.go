@@ -0,0 +1,190 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SecretMask is what is shown in place of a secret value.
+const SecretMask = "********"
+
+var (
+	// secretRef matches the ${secret:NAME} references.
+	secretRef = regexp.MustCompile(`\$\{secret:([A-Za-z_][A-Za-z0-9_.-]*)\}`)
+
+	secretName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+)
+
+// IsValidSecretName tells if name can be used
+// in a ${secret:NAME} reference.
+func IsValidSecretName(name string) bool {
+	return secretName.MatchString(name)
+}
+
+// SecretSource gives the value of a stored secret,
+// it is used to resolve the ${secret:NAME} references.
+type SecretSource interface {
+	Secret(name string) (string, error)
+}
+
+// secretResolver replaces the ${secret:NAME} references,
+// keeping track of the used secrets so that they can
+// be masked later.
+type secretResolver struct {
+	source SecretSource
+	used   map[string]string
+}
+
+func newSecretResolver(source SecretSource) *secretResolver {
+	return &secretResolver{
+		source: source,
+		used:   make(map[string]string),
+	}
+}
+
+func (r *secretResolver) expand(s string) (string, error) {
+	var err error
+	result := secretRef.ReplaceAllStringFunc(s, func(ref string) string {
+		name := secretRef.FindStringSubmatch(ref)[1]
+		if value, ok := r.used[name]; ok {
+			return value
+		}
+		if r.source == nil {
+			err = fmt.Errorf("Secret %s referenced but no secret store available", name)
+			return ref
+		}
+		value, secretErr := r.source.Secret(name)
+		if secretErr != nil {
+			err = secretErr
+			return ref
+		}
+		r.used[name] = value
+		return value
+	})
+	return result, err
+}
+
+func (r *secretResolver) expandAll(in []string) ([]string, error) {
+	out := make([]string, len(in))
+	for i, s := range in {
+		expanded, err := r.expand(s)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = expanded
+	}
+	return out, nil
+}
+
+// vars returns the resolved secrets, so that they can be masked.
+func (r *secretResolver) vars() []Var {
+	vars := make([]Var, 0, len(r.used))
+	for name, value := range r.used {
+		vars = append(vars, Var{
+			Name:   name,
+			Value:  value,
+			Secret: true,
+		})
+	}
+	return vars
+}
+
+// masker hides the secret values from a string.
+// A nil masker does nothing.
+type masker struct {
+	replacer *strings.Replacer
+	// longest first
+	values []string
+}
+
+func newMasker(secrets []Var) *masker {
+	var values []string
+	for _, secret := range secrets {
+		if secret.Secret && secret.Value != "" {
+			values = append(values, secret.Value)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	// longest first, so a secret containing another
+	// one is masked entirely
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, SecretMask)
+	}
+	return &masker{
+		replacer: strings.NewReplacer(pairs...),
+		values:   values,
+	}
+}
+
+func (m *masker) mask(s string) string {
+	if m == nil {
+		return s
+	}
+	return m.replacer.Replace(s)
+}
+
+// split returns how much of s can be masked alone: what
+// follows may be the start of a secret, or its rest.
+func (m *masker) split(s string) int {
+	if m == nil {
+		return len(s)
+	}
+
+	// a suffix that may go on with the next bytes
+	at := len(s)
+	for _, value := range m.values {
+		for k := len(value) - 1; k > 0; k-- {
+			if strings.HasSuffix(s, value[:k]) {
+				if len(s)-k < at {
+					at = len(s) - k
+				}
+				break
+			}
+		}
+	}
+
+	// a secret across at
+	for moved := true; moved; {
+		moved = false
+		for _, value := range m.values {
+			start, end := at-len(value)+1, at+len(value)-1
+			if start < 0 {
+				start = 0
+			}
+			if end > len(s) {
+				end = len(s)
+			}
+			if end-start < len(value) {
+				continue
+			}
+			if i := strings.Index(s[start:end], value); i != -1 && start+i < at {
+				at = start + i
+				moved = true
+			}
+		}
+	}
+	return at
+}
@@ -0,0 +1,237 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultSSHTimeout is the default time to
+// connect to the host of an SSHExecutor.
+const DefaultSSHTimeout = Duration(10 * time.Second)
+
+// sshSignals are the signals that can be sent
+// through SSH, by their number.
+var sshSignals = map[syscall.Signal]ssh.Signal{
+	syscall.SIGABRT: ssh.SIGABRT,
+	syscall.SIGALRM: ssh.SIGALRM,
+	syscall.SIGFPE:  ssh.SIGFPE,
+	syscall.SIGHUP:  ssh.SIGHUP,
+	syscall.SIGILL:  ssh.SIGILL,
+	syscall.SIGINT:  ssh.SIGINT,
+	syscall.SIGKILL: ssh.SIGKILL,
+	syscall.SIGPIPE: ssh.SIGPIPE,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+	syscall.SIGSEGV: ssh.SIGSEGV,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGUSR1: ssh.SIGUSR1,
+	syscall.SIGUSR2: ssh.SIGUSR2,
+}
+
+// SSHConfig is a remote host the
+// processes of a task run on.
+type SSHConfig struct {
+	// host:port, the port is 22 if missing
+	Host string `json:"host"`
+	User string `json:"user"`
+	// the private key used to log in, not encrypted
+	KeyFile string `json:"keyFile"`
+	// the known_hosts file with the key of Host
+	KnownHostsFile string `json:"knownHostsFile"`
+	// optional, the time to connect, if 0
+	// DefaultSSHTimeout is used
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// SSHExecutor runs the processes on a remote host, every
+// run has its own connection. The process has the env of
+// the login of the user, with the vars of the task.
+type SSHExecutor struct {
+	addr   string
+	dir    string
+	config *ssh.ClientConfig
+}
+
+// NewSSHExecutor returns an executor for the host in config,
+// the processes run in dir if not empty.
+func NewSSHExecutor(config *SSHConfig, dir string) (*SSHExecutor, error) {
+	if config.Host == "" || config.User == "" {
+		return nil, fmt.Errorf("SSH executor with no host or user")
+	}
+
+	key, err := ioutil.ReadFile(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(config.KnownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := config.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = DefaultSSHTimeout
+	}
+
+	return &SSHExecutor{
+		addr: addr,
+		dir:  dir,
+		config: &ssh.ClientConfig{
+			User:            config.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeys,
+			Timeout:         time.Duration(timeout),
+		},
+	}, nil
+}
+
+// LookPath leaves it to the remote shell.
+func (e *SSHExecutor) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+// Environ is empty, the remote host has its own.
+func (e *SSHExecutor) Environ() []string {
+	return nil
+}
+
+// Start runs Args of cmd on the remote host, with its Env
+// added and Stdin as input. Path and Dir are ignored.
+func (e *SSHExecutor) Start(cmd *exec.Cmd) (Execution, error) {
+	client, err := ssh.Dial("tcp", e.addr, e.config)
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	execution := &sshExecution{
+		client:  client,
+		session: session,
+	}
+	if execution.stdout, err = session.StdoutPipe(); err == nil {
+		execution.stderr, err = session.StderrPipe()
+	}
+	if err == nil {
+		// the env may have secrets, it's never on the
+		// command line, where the remote users see it
+		script := remoteScript(cmd, e.dir)
+		session.Stdin = strings.NewReader(script)
+		if cmd.Stdin != nil {
+			session.Stdin = io.MultiReader(session.Stdin, cmd.Stdin)
+		}
+		err = session.Start(fmt.Sprintf(`eval "$(dd bs=1 count=%d 2>/dev/null)"`, len(script)))
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return execution, nil
+}
+
+// remoteScript is run by the remote shell for cmd. It's the
+// first bytes of the stdin, read exactly, the process reads
+// the ones after.
+func remoteScript(cmd *exec.Cmd, dir string) string {
+	var script strings.Builder
+	for _, env := range cmd.Env {
+		script.WriteString("export " + shellQuote(env) + "\n")
+	}
+	if dir != "" {
+		script.WriteString("cd " + shellQuote(dir) + " || exit 1\n")
+	}
+	parts := []string{"exec"}
+	for _, arg := range cmd.Args {
+		parts = append(parts, shellQuote(arg))
+	}
+	script.WriteString(strings.Join(parts, " ") + "\n")
+	return script.String()
+}
+
+// sshExecution is a remote process, with
+// its connection.
+type sshExecution struct {
+	client  *ssh.Client
+	session *ssh.Session
+	stdout  io.Reader
+	stderr  io.Reader
+}
+
+func (e *sshExecution) Stdout() io.Reader {
+	return e.stdout
+}
+
+func (e *sshExecution) Stderr() io.Reader {
+	return e.stderr
+}
+
+func (e *sshExecution) Wait() (*ExitStatus, error) {
+	defer e.client.Close()
+
+	err := e.session.Wait()
+	if err == nil {
+		return &ExitStatus{}, nil
+	}
+	exitErr, ok := err.(*ssh.ExitError)
+	if !ok {
+		// the connection is gone
+		return nil, err
+	}
+
+	status := &ExitStatus{
+		ExitCode: exitErr.ExitStatus(),
+	}
+	if name := exitErr.Signal(); name != "" {
+		status.ExitCode = -1
+		for sig, sshSig := range sshSignals {
+			if string(sshSig) == name {
+				status.Signal = sig
+			}
+		}
+	}
+	return status, err
+}
+
+func (e *sshExecution) Signal(sig syscall.Signal) error {
+	var err error
+	if sshSig, ok := sshSignals[sig]; ok {
+		err = e.session.Signal(sshSig)
+	}
+	if sig == syscall.SIGKILL {
+		// the host may not support signals
+		return e.client.Close()
+	}
+	return err
+}
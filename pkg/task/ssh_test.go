@@ -0,0 +1,315 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshTestServer runs the commands of the sessions
+// with sh, accepting a single key.
+type sshTestServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	// the command lines run
+	commands chan string
+}
+
+// newSSHTestServer starts a server, writing the key of the
+// client and the known_hosts file in dir.
+func newSSHTestServer(dir string, t *testing.T) (*SSHConfig, *sshTestServer) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPublic, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized, err := ssh.NewPublicKey(clientPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &sshTestServer{
+		commands: make(chan string, 100),
+		config: &ssh.ServerConfig{
+			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				if !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+					return nil, ssh.ErrNoAuth
+				}
+				return nil, nil
+			},
+		},
+	}
+	server.config.AddHostKey(hostSigner)
+	if server.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go server.serve()
+
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &SSHConfig{
+		Host:           server.listener.Addr().String(),
+		User:           "gotask",
+		KeyFile:        path.Join(dir, "id_ed25519"),
+		KnownHostsFile: path.Join(dir, "known_hosts"),
+	}
+	if err = ioutil.WriteFile(config.KeyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(config.Host)}, hostSigner.PublicKey())
+	if err = ioutil.WriteFile(config.KnownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return config, server
+}
+
+func (s *sshTestServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			for newChannel := range channels {
+				if newChannel.ChannelType() != "session" {
+					newChannel.Reject(ssh.UnknownChannelType, "session only")
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go s.session(channel, requests)
+			}
+		}()
+	}
+}
+
+func (s *sshTestServer) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	var cmd *exec.Cmd
+	for request := range requests {
+		switch request.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if ssh.Unmarshal(request.Payload, &payload) != nil || cmd != nil {
+				request.Reply(false, nil)
+				continue
+			}
+			s.commands <- payload.Command
+			cmd = exec.Command("sh", "-c", payload.Command)
+			cmd.Stdin = channel
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			if err := cmd.Start(); err != nil {
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+			go func(cmd *exec.Cmd) {
+				cmd.Wait()
+				status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+				if status.Signaled() {
+					channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+						Signal     string
+						CoreDumped bool
+						Error      string
+						Lang       string
+					}{Signal: string(sshSignals[status.Signal()])}))
+				} else {
+					channel.SendRequest("exit-status", false, ssh.Marshal(struct {
+						Status uint32
+					}{uint32(status.ExitStatus())}))
+				}
+				channel.Close()
+			}(cmd)
+		case "signal":
+			var payload struct{ Signal string }
+			if ssh.Unmarshal(request.Payload, &payload) == nil && cmd != nil {
+				for sig, name := range sshSignals {
+					if string(name) == payload.Signal {
+						syscall.Kill(-cmd.Process.Pid, sig)
+					}
+				}
+			}
+		default:
+			request.Reply(false, nil)
+		}
+	}
+}
+
+type sshTestCase struct {
+	task     Task
+	output   string
+	error    string
+	exitCode int
+	killed   string
+}
+
+func (test *sshTestCase) doTest(t *testing.T) {
+	ret := waitTask(test.task, nil, t)
+	if ret.Output != test.output {
+		t.Errorf("Wrong output of %s: %q, expected %q, error %q\n",
+			test.task.Name, ret.Output, test.output, ret.Error)
+	}
+	if test.error != "" && !strings.Contains(ret.Error, test.error) {
+		t.Errorf("Wrong error of %s: %q, expected %q\n", test.task.Name, ret.Error, test.error)
+	}
+	if ret.Result.ExitCode != test.exitCode || ret.Result.KillReason != test.killed {
+		t.Errorf("Wrong result of %s: %+v\n", test.task.Name, ret.Result)
+	}
+}
+
+func TestSSHExecutor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotask-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config, server := newSSHTestServer(dir, t)
+	remote := &ExecutorConfig{Type: ExecutorSSH, SSH: config}
+	inDir := &ExecutorConfig{Type: ExecutorSSH, SSH: config, Dir: dir}
+
+	allSSHTests := []sshTestCase{
+		{
+			task: Task{
+				Name:     "exit",
+				Command:  []string{"echo out; echo err >&2; exit 3"},
+				Shell:    "sh",
+				Executor: remote,
+			},
+			output:   "out\n",
+			error:    "err\n",
+			exitCode: 3,
+		}, {
+			task: Task{
+				Name:     "env",
+				Command:  []string{`echo "${X}'s" $PWD`},
+				Env:      []EnvVar{{Name: "X", Value: "it"}, {Name: "LINES", Value: "a\nb"}},
+				Shell:    "sh",
+				Executor: inDir,
+			},
+			output: "it's " + dir + "\n",
+		}, {
+			task: Task{
+				Name:     "args",
+				Command:  []string{"echo", "a  b", "'c'"},
+				Executor: remote,
+			},
+			output: "a  b 'c'\n",
+		}, {
+			task: Task{
+				Name:     "lines",
+				Command:  []string{`echo "$LINES"; cat`},
+				Env:      []EnvVar{{Name: "LINES", Value: "a\nb"}},
+				Stdin:    "input",
+				Shell:    "sh",
+				Executor: remote,
+			},
+			output: "a\nb\ninput",
+		}, {
+			task: Task{
+				Name:     "stdin",
+				Command:  []string{"cat"},
+				Stdin:    "input",
+				Executor: remote,
+			},
+			output: "input",
+		}, {
+			task: Task{
+				Name:     "timeout",
+				Command:  []string{"sleep", "5"},
+				Timeout:  Duration(200 * time.Millisecond),
+				Executor: remote,
+			},
+			exitCode: -1,
+			killed:   KillTimeout,
+		},
+	}
+	for _, test := range allSSHTests {
+		test.doTest(t)
+	}
+	// the env is sent through stdin
+	for len(server.commands) > 0 {
+		if command := <-server.commands; strings.Contains(command, "X=it") {
+			t.Errorf("Env on the command line: %s\n", command)
+		}
+	}
+
+	for _, toRun := range []Task{
+		{Name: "tty", Command: []string{"true"}, Tty: true, Executor: remote},
+		{Name: "user", Command: []string{"true"}, User: "nobody", Executor: remote},
+		{Name: "unknown", Command: []string{"true"}, Executor: &ExecutorConfig{Type: "docker"}},
+		{Name: "nokey", Command: []string{"true"}, Executor: &ExecutorConfig{
+			Type: ExecutorSSH,
+			SSH:  &SSHConfig{Host: config.Host, User: "gotask", KeyFile: path.Join(dir, "none")},
+		}},
+	} {
+		if _, err := toRun.Prepare(nil); err == nil {
+			t.Errorf("Executor of %s accepted\n", toRun.Name)
+		}
+	}
+}
+
+func TestChrootLookPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "gotask-chroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err = os.MkdirAll(path.Join(root, "usr/bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path.Join(root, "usr/bin/gotask-tool"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	executor := LocalExecutor{Root: root}
+	if found, err := executor.LookPath("gotask-tool"); err != nil || found != "/usr/bin/gotask-tool" {
+		t.Errorf("Wrong path in the root: %q, %v\n", found, err)
+	}
+	if _, err := executor.LookPath("bash"); err == nil {
+		t.Errorf("Host path found in the root\n")
+	}
+}
@@ -14,14 +14,15 @@
 package task
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -55,10 +56,99 @@ type Task struct {
 	// env
 	Env []EnvVar `json:"env"`
 
+	// optional, dotenv files added to the env before
+	// Env, in order, relative to Dir
+	EnvFiles []string `json:"envFiles,omitempty"`
+
+	// optional, which vars of the server env the process
+	// has, the server may have a policy too
+	EnvPolicy *EnvPolicy `json:"envPolicy,omitempty"`
+
 	// run using a shell? which one
 	// considered only if not empty
 	// the option '-c' will be then used
 	Shell string `json:"shell"`
+
+	// optional, the var files to read, merged in order,
+	// relative to Dir. If empty VarFileName is used.
+	VarFiles []string `json:"varFiles,omitempty"`
+
+	// optional, a condition on the vars, the task is
+	// skipped when false, e.g. ${ENV} == "prod"
+	When string `json:"when,omitempty"`
+
+	// render Command, Env and Dir using text/template
+	// instead of the ${VAR} replacement
+	Template bool `json:"template,omitempty"`
+
+	// optional, the process is killed after it
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// optional, the bytes of stdout and of stderr kept
+	// in memory, the server may have a lower limit
+	MaxOutput int64 `json:"maxOutput,omitempty"`
+
+	// optional, stdout and stderr are kept in a single
+	// log, line by line, tagged with stream and time
+	MergeOutput bool `json:"mergeOutput,omitempty"`
+
+	// optional, the most runs of the task at the same
+	// time, the others are queued by the server
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+
+	// optional, a queued run with a higher
+	// priority is started first
+	Priority int `json:"priority,omitempty"`
+
+	// optional, when a failed run is tried again
+	Retry *RetryPolicy `json:"retry,omitempty"`
+
+	// optional, written to the stdin of the process
+	// when the run has no input
+	Stdin string `json:"stdin,omitempty"`
+
+	// optional, the process has a PTY as stdin, stdout
+	// and stderr, a long task can be attached to
+	Tty bool `json:"tty,omitempty"`
+
+	// optional, the resources a run may use
+	Limits *Limits `json:"limits,omitempty"`
+
+	// optional, the user and the group, by name or id,
+	// the process runs as, the server must be allowed
+	// to change identity
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+
+	// optional, the process runs isolated from the host,
+	// it can't be used with User and Group
+	Sandbox *Sandbox `json:"sandbox,omitempty"`
+
+	// optional, where the process runs, if nil on the
+	// server host. Tty, Limits and Sandbox need the
+	// server host, User and Group a local executor.
+	Executor *ExecutorConfig `json:"executor,omitempty"`
+
+	// optional, how the directory of the process is made,
+	// a temporary one needs the server host
+	DirPolicy *DirPolicy `json:"dirPolicy,omitempty"`
+
+	// optional, the labels an agent must have to run
+	// the task, if empty the task runs on the server
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// optional, globs relative to the directory of the
+	// run, the matching files are kept after it
+	Artifacts []string `json:"artifacts,omitempty"`
+
+	// optional, how the output is parsed in the structured
+	// result of the run, if empty OutputText. The result is
+	// shown like the output, only with ShowOutput
+	OutputFormat string `json:"outputFormat,omitempty"`
+
+	// optional, the task is run once for each
+	// combination of the values of its vars
+	Matrix *Matrix `json:"matrix,omitempty"`
 }
 
 // RuntimeTaskInfo keeps only the necessary info
@@ -71,9 +161,9 @@ type RuntimeTaskInfo struct {
 	ShowOutput bool
 
 	// pipe for stdout
-	OutPipe io.ReadCloser
+	OutPipe io.Reader
 	// pipe for stderr
-	ErrPipe io.ReadCloser
+	ErrPipe io.Reader
 	*exec.Cmd
 
 	// these are set after the call to wait
@@ -82,14 +172,88 @@ type RuntimeTaskInfo struct {
 	// accessed at the same time
 	Output string
 	Error  string
+
+	// the When condition was false, the
+	// command has not been started
+	Skipped bool
+
+	// how the process ended, set with Output
+	Result *RunResult
+	// some output has been dropped
+	Truncated bool
+	// all the attempts, with a RetryPolicy
+	Attempts []Attempt
+	// the output parsed as the OutputFormat says
+	Structured json.RawMessage
+
+	// the PTY, if the task has Tty
+	Terminal *Terminal
+
+	// the process group of the task, set by Launch
+	Pgid int
+
+	// hides secret values from the output
+	masker *masker
+	// kill and timeout info
+	state *runState
+
+	// output limits
+	maxOutput int64
+	logDir    string
+	// stdout and stderr in Output
+	merged bool
+	// from Task.Timeout
+	timeout time.Duration
+	// from RunOptions.Attempt
+	attempt int
+	// opened as stdin by Launch
+	inputFile string
+	// started with a PTY
+	tty bool
+	// from Task.Limits, with the cgroup of the run if any
+	limits    *Limits
+	cgroupDir string
+	// the OOM killer has killed a process of the cgroup
+	oomKilled bool
+	// the root of the Sandbox, removed after the run
+	sandboxRoot string
+	// the env of the process, for the RunResult
+	environ []string
+	// starts the process
+	executor Executor
+	// opened as stdin, closed after the run
+	input *os.File
+	// set after the wait
+	status *ExitStatus
+	// the directories made by Launch
+	workspace *workspace
+	// from Task.Artifacts
+	artifacts []string
+	// from Task.OutputFormat, with the
+	// result file of the run if any
+	outputFormat string
+	resultFile   string
+}
+
+// Mask hides the values of the secret variables
+// of the task from s.
+func (r *RuntimeTaskInfo) Mask(s string) string {
+	return r.masker.mask(s)
 }
 
 // CmdDoneChan is the struct written on the 'done' channel.
 // It is used on 'err' chan too.
 type CmdDoneChan struct {
-	Output string
-	Error  string
-	ID     string
+	Output    string
+	Error     string
+	ID        string
+	Skipped   bool
+	Result    *RunResult
+	Truncated bool
+	// all the attempts, with a RetryPolicy
+	Attempts []Attempt
+	// the output parsed as the OutputFormat says
+	Structured json.RawMessage
 }
 
 // WaitPoll waits the command to complete,
@@ -101,60 +265,65 @@ func (r *RuntimeTaskInfo) WaitPoll(
 	errChan chan<- *CmdDoneChan) {
 
 	go func() {
-		// we have to read output BEFORE call to Wait()
-		outStr, err := internalPipeToStr(r.OutPipe)
-		if err != nil {
-			errChan <- &CmdDoneChan{
-				ID:    id,
-				Error: fmt.Sprintf("Fail to get STDOUT: %s\n", err.Error()),
+		if r.Skipped {
+			doneChan <- &CmdDoneChan{
+				ID:      id,
+				Skipped: true,
 			}
+			return
 		}
 
-		// read error
-		errStr, err := internalPipeToStr(r.ErrPipe)
-		if err != nil {
-			errChan <- &CmdDoneChan{
-				ID:    id,
-				Error: fmt.Sprintf("Fail to get STDERR: %s\n", err.Error()),
-			}
+		// we have to read output BEFORE call to Wait()
+		out, errOut, outErr, errErr := r.drain(id)
+
+		// wait anyway, so that the process is released
+		var err error
+		r.status, err = r.execution().Wait()
+		r.EndAt = time.Now()
+		if r.input != nil {
+			r.input.Close()
 		}
-
-		// not wait
-		if err = r.Wait(); err != nil {
-			r.EndAt = time.Now()
-			errChan <- &CmdDoneChan{
-				ID:    id,
-				Error: err.Error(),
-			}
-		} else {
-			r.EndAt = time.Now()
-			doneChan <- &CmdDoneChan{
-				ID:     id,
-				Output: outStr,
-				Error:  errStr,
+		if r.Terminal != nil {
+			r.Terminal.close()
+		}
+		leftover := r.reapGroup()
+		r.oomKilled = r.removeCgroup()
+		r.removeSandbox()
+
+		res := &CmdDoneChan{
+			ID:        id,
+			Output:    out.buffer.String(),
+			Error:     errOut.buffer.String(),
+			Result:    r.result(),
+			Truncated: out.buffer.Truncated() || errOut.buffer.Truncated(),
+		}
+		res.Result.Leftover = leftover
+
+		// a failed run may have a result too
+		structured, parseErr := r.parseOutput(res.Output, out.buffer.Truncated())
+		res.Structured = structured
+
+		switch {
+		case outErr != nil:
+			res.Error = r.Mask(fmt.Sprintf("Fail to get STDOUT: %s\n", outErr.Error()))
+		case errErr != nil:
+			res.Error = r.Mask(fmt.Sprintf("Fail to get STDERR: %s\n", errErr.Error()))
+		case err != nil:
+			// the exit code is in the result,
+			// but keep a description if there's no stderr
+			if res.Error == "" {
+				res.Error = r.Mask(err.Error())
 			}
+		case parseErr != nil:
+			res.Error += fmt.Sprintf("Invalid %s output: %s\n", r.outputFormat, parseErr.Error())
+		default:
+			doneChan <- res
+			return
 		}
+		errChan <- res
 	}()
 }
 
-func internalPipeToStr(pipe io.ReadCloser) (string, error) {
-	out, err := ioutil.ReadAll(pipe)
-	if err != nil {
-		return "", err
-	}
-	return string(out), nil
-}
-
-// StdoutStr returns the output in string format
-// func (r *RuntimeTaskInfo) StdoutStr() (string, error) {
-// 	return internalPipeToStr(r.OutPipe)
-// }
-
-// StderrStr returns the output in string format
-// func (r *RuntimeTaskInfo) StderrStr() (string, error) {
-// 	return internalPipeToStr(r.ErrPipe)
-// }
-
 func (t *Task) String() string {
 	var writer strings.Builder
 	encoder := json.NewEncoder(&writer)
@@ -163,93 +332,560 @@ func (t *Task) String() string {
 	return writer.String()
 }
 
-// preRun takes care of adding eventual variables
+// preRunAddVars expands the variables in the command.
+// When not using a shell, an argument referencing a list
+// is repeated once for each item.
 // TODO add some default variable
 func (t *Task) preRunAddVars(vars []Var) {
+	t.Command = expandCommand(t.Command, vars, t.Shell == "")
+}
 
-	for _, variable := range vars {
-		for _, command := range t.Command {
-			command = strings.Replace(
-				command,
-				variable.ToReplacer(),
-				variable.Value,
-				-1)
+// expandCommand returns a new slice, so that
+// the command of the stored task is never touched.
+func expandCommand(command []string, vars []Var, splitLists bool) []string {
+	expanded := make([]string, 0, len(command))
+	for _, arg := range command {
+		expanded = append(expanded, expandArg(arg, vars, splitLists)...)
+	}
+	return expanded
+}
+
+func expandArg(arg string, vars []Var, splitLists bool) []string {
+	if splitLists {
+		for i, variable := range vars {
+			if variable.Type != VarList || !strings.Contains(arg, variable.ToReplacer()) {
+				continue
+			}
+			// the list is not used again for the other vars
+			others := make([]Var, 0, len(vars)-1)
+			others = append(append(others, vars[:i]...), vars[i+1:]...)
+
+			var args []string
+			for _, item := range variable.List {
+				args = append(args, expandArg(
+					strings.Replace(arg, variable.ToReplacer(), item, -1),
+					others, splitLists)...)
+			}
+			return args
 		}
 	}
+
+	for _, variable := range vars {
+		arg = strings.Replace(arg, variable.ToReplacer(), variable.Value, -1)
+	}
+	return []string{arg}
 }
 
 func (t *Task) preRunGetVars() ([]Var, error) {
-	return ReadVars(path.Join(t.Dir, VarFileName))
-}
+	if len(t.VarFiles) == 0 {
+		vars, err := ReadVars(path.Join(t.Dir, VarFileName))
+		if os.IsNotExist(err) && t.DirPolicy.creates() {
+			// Dir may be created by the run
+			return nil, nil
+		}
+		return vars, err
+	}
 
-func (t *Task) preRun() error {
-	if t.Dir != "" {
-		vars, err := t.preRunGetVars()
+	sets := make([][]Var, len(t.VarFiles))
+	for i, file := range t.VarFiles {
+		if !path.IsAbs(file) {
+			file = path.Join(t.Dir, file)
+		}
+		vars, err := ReadVars(file)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		sets[i] = vars
+	}
+	return MergeVars(sets...), nil
+}
+
+// preRunGetSecrets reads the secret file, if there's one.
+func (t *Task) preRunGetSecrets() ([]Var, error) {
+	secrets, err := ReadSecrets(path.Join(t.Dir, SecretFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return secrets, err
+}
+
+// preRun expands the variables, the ones of the files and then
+// extra, returning them and the secrets to be added to the environment.
+func (t *Task) preRun(extra []Var) ([]Var, []Var, error) {
+	if t.Dir == "" && len(t.VarFiles) == 0 {
+		if len(extra) > 0 && !t.Template {
+			t.preRunAddVars(extra)
 		}
+		return extra, nil, nil
+	}
+
+	vars, err := t.preRunGetVars()
+	if err != nil {
+		return nil, nil, err
+	}
+	vars = overrideVars(vars, extra)
+	// templates take the place of ${VAR}
+	if !t.Template {
 		t.preRunAddVars(vars)
 	}
-	return nil
+
+	if t.Dir == "" {
+		return vars, nil, nil
+	}
+	secrets, err := t.preRunGetSecrets()
+	return vars, secrets, err
+}
+
+// RunOptions are the options given by the server
+// at run time.
+type RunOptions struct {
+	// used to resolve the ${secret:NAME} references
+	// in Command and Env
+	Secrets SecretSource
+
+	// the ID of the run and its parameters,
+	// available to the templates
+	ID     string
+	Params map[string]string
+
+	// vars of the run, over the ones of the
+	// var files, like the ones of a matrix
+	Vars []Var
+
+	// the server limit to the output kept in memory,
+	// <= 0 means no limit
+	MaxOutput int64
+	// if not empty, the full output is written here
+	LogDir string
+
+	// the attempt of the run, from 1, when
+	// the task is tried again
+	Attempt int
+
+	// the input of the run, written to the stdin of
+	// the process, read from InputFile if not empty
+	Input     []byte
+	InputFile string
+
+	// the delegated cgroup v2 in which the runs with
+	// cgroup limits have their own cgroup
+	CgroupDir string
+
+	// the policy of the server, the env of the
+	// server goes through it before the task one
+	EnvPolicy *EnvPolicy
+
+	// the executor of the tasks with no Executor,
+	// if nil they run on the server host
+	Executor Executor
 }
 
 // Run runs the task in a non-blocking way
 // returning the RuntimeTaskInfo associated with.
 func (t *Task) Run() (*RuntimeTaskInfo, error) {
+	return t.RunWith(nil)
+}
+
+// RunWith is like Run but using the given options,
+// opts may be nil.
+func (t *Task) RunWith(opts *RunOptions) (*RuntimeTaskInfo, error) {
+	runtimeTask, err := t.Prepare(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = runtimeTask.Launch(); err != nil {
+		return nil, err
+	}
+	return runtimeTask, nil
+}
+
+// Launch starts a task returned by Prepare,
+// a skipped task is not started.
+func (r *RuntimeTaskInfo) Launch() error {
+	if r.Skipped {
+		return nil
+	}
+
+	if r.workspace != nil {
+		if err := r.workspace.make(); err != nil {
+			return err
+		}
+	}
+
+	cgroup, err := r.setupCgroup()
+	if err != nil {
+		r.removeRunDir()
+		return err
+	}
+
+	if r.tty {
+		err = r.launchTerminal()
+	} else {
+		err = r.launchPipes()
+	}
+
+	// the process is in it now
+	if cgroup != nil {
+		cgroup.Close()
+		if err != nil {
+			os.Remove(r.cgroupDir)
+		}
+	}
+	if err != nil {
+		r.removeRunDir()
+	}
+	return err
+}
+
+// launchPipes starts the process using the executor,
+// with a pipe for stdout and one for stderr.
+func (r *RuntimeTaskInfo) launchPipes() error {
+	if r.inputFile != "" {
+		file, err := os.Open(r.inputFile)
+		if err != nil {
+			return err
+		}
+		// a remote process reads it till the end
+		r.input = file
+		r.Stdin = file
+	}
+
+	execution, err := r.executor.Start(r.Cmd)
+	if err != nil {
+		if r.input != nil {
+			r.input.Close()
+		}
+		return err
+	}
+
+	r.OutPipe = execution.Stdout()
+	r.ErrPipe = execution.Stderr()
+	r.started(execution)
+	return nil
+}
+
+// started is called once the process has been started.
+func (r *RuntimeTaskInfo) started(execution Execution) {
+	r.state.Lock()
+	r.state.execution = execution
+	r.state.Unlock()
+
+	// a local process has its own group
+	if r.Process != nil {
+		r.Pgid = r.Process.Pid
+	}
+	r.StartAt = time.Now()
+	r.startTimeout(r.timeout)
+}
 
-	if err := t.preRun(); err != nil {
+// Validate checks the task could be run with the given options:
+// vars are read, templates are rendered and the condition is
+// evaluated, but nothing is started. It returns the command
+// that would be run, with the secrets masked.
+func (t *Task) Validate(opts *RunOptions) ([]string, error) {
+	runtimeTask, err := t.Prepare(opts)
+	if err != nil {
 		return nil, err
 	}
 
-	commands := t.Command
+	args := make([]string, len(runtimeTask.Args))
+	for i, arg := range runtimeTask.Args {
+		args[i] = runtimeTask.Mask(arg)
+	}
+	return args, nil
+}
+
+// Prepare does everything needed to run the task with the
+// given options but starting it, that is done by Launch.
+func (t *Task) Prepare(opts *RunOptions) (*RuntimeTaskInfo, error) {
+	if opts == nil {
+		opts = &RunOptions{}
+	}
+	// the vars, the templates and the ${RUN_DIR} of
+	// every run are only in its own copy
+	copied := *t
+	t = &copied
+
+	if len(t.Command) == 0 {
+		return nil, fmt.Errorf("Task %s has no command", t.Name)
+	}
+	if err := t.Limits.validate(); err != nil {
+		return nil, fmt.Errorf("Task %s: %s", t.Name, err.Error())
+	}
+	if err := t.Retry.validate(); err != nil {
+		return nil, fmt.Errorf("Task %s: %s", t.Name, err.Error())
+	}
+	if t.Limits.hasCgroup() && opts.CgroupDir == "" {
+		return nil, fmt.Errorf("Task %s has cgroup limits, but there's no cgroup", t.Name)
+	}
+	for _, policy := range []*EnvPolicy{opts.EnvPolicy, t.EnvPolicy} {
+		if err := policy.Validate(); err != nil {
+			return nil, fmt.Errorf("Task %s: %s", t.Name, err.Error())
+		}
+	}
+	if t.Sandbox != nil && (t.User != "" || t.Group != "") {
+		return nil, fmt.Errorf("Task %s has a sandbox, it can't change identity", t.Name)
+	}
+	if err := t.checkOutputFormat(); err != nil {
+		return nil, fmt.Errorf("Task %s: %s", t.Name, err.Error())
+	}
+	for _, pattern := range t.Artifacts {
+		if !validArtifactPattern(pattern) {
+			return nil, fmt.Errorf("Task %s: invalid artifact pattern: %s", t.Name, pattern)
+		}
+	}
+
+	executor, err := t.executor(opts)
+	if err != nil {
+		return nil, fmt.Errorf("Task %s: %s", t.Name, err.Error())
+	}
+	if !onHost(executor) && (t.Tty || t.Limits != nil || t.Sandbox != nil ||
+		(t.DirPolicy != nil && t.DirPolicy.Temp) || len(t.Artifacts) > 0 ||
+		t.OutputFormat == OutputResultFile) {
+		return nil, fmt.Errorf("Task %s has tty, limits, a sandbox, a temporary directory, "+
+			"artifacts or a result file, it must run on the server host", t.Name)
+	}
+	if _, local := executor.(LocalExecutor); !local && (t.User != "" || t.Group != "") {
+		return nil, fmt.Errorf("Task %s changes identity, it must run on the server", t.Name)
+	}
+
+	// what's inherited, seen by the templates too
+	inherited := t.EnvPolicy.filter(opts.EnvPolicy.filter(executor.Environ()))
+
+	// the var files are in Dir, so it can't use the vars
+	if t.Template {
+		dir, err := renderTemplate("Dir", t.Dir, newTemplateData(nil, opts, t.Name, inherited))
+		if err != nil {
+			return nil, err
+		}
+		t.Dir = dir
+	}
+
+	// made by Launch
+	space, err := t.DirPolicy.workspace(t.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("Task %s: %s", t.Name, err.Error())
+	}
+	runDir := ""
+	if space != nil {
+		runDir = space.runDir
+	}
+	resultFile := ""
+	if t.OutputFormat == OutputResultFile {
+		// the sandbox only sees the temporary directory
+		if t.Sandbox != nil && runDir == "" {
+			return nil, fmt.Errorf("Task %s has a sandbox, its result file "+
+				"needs a temporary directory", t.Name)
+		}
+		if resultFile, err = newResultFile(runDir); err != nil {
+			return nil, err
+		}
+	}
+
+	vars, secrets, err := t.preRun(opts.Vars)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Template {
+		var runVars []Var
+		if runDir != "" {
+			runVars = append(runVars, Var{Name: RunDirVar, Value: runDir})
+		}
+		if resultFile != "" {
+			runVars = append(runVars, Var{Name: ResultVar, Value: resultFile})
+		}
+		t.Command = expandCommand(t.Command, runVars, false)
+	}
+
+	envs := t.Env
+	if t.Template {
+		data := newTemplateData(vars, opts, t.Name, inherited)
+		data.Run.Dir = runDir
+		data.Run.ResultFile = resultFile
+		if t.Command, err = renderCommand(t.Command, data); err != nil {
+			return nil, err
+		}
+
+		envs = make([]EnvVar, len(t.Env))
+		for i, env := range t.Env {
+			env.Value, err = renderTemplate(fmt.Sprintf("Env[%s]", env.Name), env.Value, data)
+			if err != nil {
+				return nil, err
+			}
+			envs[i] = env
+		}
+	}
+
+	skip := false
+	if t.When != "" {
+		ok, err := EvalCondition(t.When, vars)
+		if err != nil {
+			return nil, err
+		}
+		skip = !ok
+	}
+
+	// secrets are decrypted only here, and never
+	// written back to the task
+	resolver := newSecretResolver(opts.Secrets)
+	commands, err := resolver.expandAll(t.Command)
+	if err != nil {
+		return nil, err
+	}
 
 	var cmd *exec.Cmd
 
 	if t.Shell != "" {
-		baseShell, err := exec.LookPath(t.Shell)
+		baseShell, err := executor.LookPath(t.Shell)
 		if err != nil {
 			return nil, err
 		}
 		cmd = exec.Command(baseShell, "-c", strings.Join(commands, " "))
+	} else if len(commands) == 0 {
+		// an empty list expanded to nothing
+		return nil, fmt.Errorf("Task %s has an empty command", t.Name)
 	} else {
 		cmd = exec.Command(commands[0], commands[1:]...)
+		// it's on the host of the executor
+		if found, err := executor.LookPath(commands[0]); err == nil {
+			cmd.Path, cmd.Err = found, nil
+		}
 	}
 
-	// now add other info if needed
-	if len(t.Env) > 0 {
-		envs := make([]string, len(t.Env))
-		for i, env := range t.Env {
-			envs[i] = env.String()
+	// what's inherited, then the env files, Env and the
+	// secrets, that are only given through the environment
+	env := inherited
+	fileVars, err := t.readEnvFiles()
+	if err != nil {
+		return nil, err
+	}
+	allEnvs := make([]EnvVar, 0, len(fileVars)+len(envs))
+	for _, variable := range fileVars {
+		allEnvs = append(allEnvs, EnvVar{Name: variable.Name, Value: variable.Value})
+	}
+	// the names of the vars given by the task
+	var set []string
+	for _, variable := range append(allEnvs, envs...) {
+		value, err := resolver.expand(variable.Value)
+		if err != nil {
+			return nil, err
 		}
-		cmd.Env = append(os.Environ(), envs...)
+		env = setEnv(env, variable.Name, value)
+		set = append(set, variable.Name)
 	}
+	if runDir != "" {
+		env = setEnv(env, RunDirVar, runDir)
+		set = append(set, RunDirVar)
+	}
+	if resultFile != "" {
+		env = setEnv(env, ResultVar, resultFile)
+		set = append(set, ResultVar)
+	}
+	for _, secret := range secrets {
+		env = setEnv(env, secret.Name, secret.Value)
+	}
+	cmd.Env = env
 
 	// set the path, if empty it's just fine
 	// because the Cmd works the same way
 	cmd.Dir = t.Dir
+	if runDir != "" {
+		cmd.Dir = runDir
+	}
 
-	pipeOut, err := cmd.StdoutPipe()
+	// its own group, so that the children can be killed
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	identity, err := t.Identity()
 	if err != nil {
 		return nil, err
 	}
+	if identity != nil {
+		if err = applyIdentity(cmd, identity); err != nil {
+			return nil, err
+		}
+		if space != nil {
+			space.uid, space.gid = int(identity.UID), int(identity.GID)
+		}
+	}
 
-	pipeErr, err := cmd.StderrPipe()
-	if err != nil {
-		return nil, err
+	masker := newMasker(append(secrets, resolver.vars()...))
+	// before Init is added to it
+	environ := recordEnv(cmd.Env, set, secrets, masker)
+
+	// the sandbox and the rlimits are set
+	// up before the command starts
+	request := &initRequest{}
+	if t.Limits.hasRlimits() {
+		request.Rlimits = t.Limits.rlimits()
+	}
+	if t.Sandbox != nil {
+		if request.Sandbox, err = t.Sandbox.apply(cmd, runDir); err != nil {
+			return nil, err
+		}
+	}
+	if request.needed() {
+		if err = wrapCommand(cmd, request); err != nil {
+			return nil, err
+		}
 	}
 
 	runtimeTask := &RuntimeTaskInfo{
 		Cmd:        cmd,
 		ShowOutput: t.ShowOutput,
-		OutPipe:    pipeOut,
-		ErrPipe:    pipeErr,
+		Skipped:    skip,
+		masker:     masker,
+		state:      newRunState(),
+		maxOutput:  minLimit(t.MaxOutput, opts.MaxOutput),
+		logDir:     opts.LogDir,
+		merged:     t.MergeOutput,
+		timeout:    time.Duration(t.Timeout),
+		attempt:    opts.Attempt,
+		tty:        t.Tty,
+		limits:     t.Limits,
+		environ:    environ,
+		executor:   executor,
+		workspace:  space,
+		artifacts:  t.Artifacts,
+
+		outputFormat: t.OutputFormat,
+		resultFile:   resultFile,
+	}
+	if request.Sandbox != nil {
+		runtimeTask.sandboxRoot = request.Sandbox.Root
 	}
 
-	if err := cmd.Start(); err != nil {
-		return nil, err
+	if t.Limits.hasCgroup() {
+		name := AttemptID(opts.ID, opts.Attempt)
+		if opts.ID == "" {
+			name = fmt.Sprintf("run-%d", time.Now().UnixNano())
+		}
+		runtimeTask.cgroupDir = path.Join(opts.CgroupDir, name)
 	}
 
-	runtimeTask.StartAt = time.Now()
+	switch {
+	case opts.InputFile != "":
+		runtimeTask.inputFile = opts.InputFile
+	case opts.Input != nil:
+		cmd.Stdin = bytes.NewReader(opts.Input)
+	case t.Stdin != "":
+		cmd.Stdin = strings.NewReader(t.Stdin)
+	}
+
+	if skip {
+		runtimeTask.StartAt = time.Now()
+		runtimeTask.EndAt = runtimeTask.StartAt
+	}
 
 	return runtimeTask, nil
 }
+
+// minLimit returns the lowest limit, a limit
+// <= 0 means no limit.
+func minLimit(a, b int64) int64 {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -14,7 +14,11 @@
 package task
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -175,16 +179,290 @@ var allExpansionTest = []taskExpansionTestCase{
 	},
 }
 
+var listExpansionTest = taskExpansionTestCase{
+	task: Task{
+		Command: []string{
+			"gcc",
+			"-I${includes}",
+			"${files}",
+			"-o",
+			"${out}",
+		},
+	},
+	vars: []Var{
+		NewListVar("includes", []string{"/usr/include", "include"}),
+		NewListVar("files", []string{"a.c", "b.c"}),
+		{
+			Name:  "out",
+			Value: "a.out",
+		},
+	},
+	expectedCommand: []string{
+		"gcc",
+		"-I/usr/include",
+		"-Iinclude",
+		"a.c",
+		"b.c",
+		"-o",
+		"a.out",
+	},
+}
+
+var listInShellExpansionTest = taskExpansionTestCase{
+	task: Task{
+		Command: []string{
+			"rm ${files}",
+		},
+		Shell: "bash",
+	},
+	vars: []Var{
+		NewListVar("files", []string{"a.c", "b.c"}),
+	},
+	expectedCommand: []string{
+		"rm a.c b.c",
+	},
+}
+
 func (test *taskExpansionTestCase) doTest(t *testing.T) {
 	test.task.preRunAddVars(test.vars)
-	if reflect.DeepEqual(test.task.Command, test.expectedCommand) {
+	if !reflect.DeepEqual(test.task.Command, test.expectedCommand) {
 		t.Errorf("Wrong expansion:\ngot: %v\nexpected: %v\n",
 			test.task.Command, test.expectedCommand)
 	}
 }
 
 func TestExpandTask(t *testing.T) {
-	for _, testCase := range allExpansionTest {
+	for _, testCase := range append(allExpansionTest,
+		listExpansionTest, listInShellExpansionTest) {
 		testCase.doTest(t)
 	}
 }
+
+func TestSkippedTask(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotask")
+	if err != nil {
+		t.Fatalf("Cannot create dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ioutil.WriteFile(path.Join(dir, VarFileName),
+		[]byte("ENV: dev\nbool DRY_RUN: false\n"), 0644); err != nil {
+		t.Fatalf("Cannot write var file: %s", err.Error())
+	}
+
+	for _, testCase := range []struct {
+		when    string
+		skipped bool
+	}{
+		{`${ENV} == "prod" && ${DRY_RUN} != true`, true},
+		{`${ENV} == "dev" && !${DRY_RUN}`, false},
+	} {
+		toRun := Task{
+			Name:    "skip",
+			Command: []string{"true"},
+			Dir:     dir,
+			When:    testCase.when,
+		}
+
+		taskInfo, err := toRun.Run()
+		if err != nil {
+			t.Fatalf("Fail to run task: %s\n", err.Error())
+		}
+
+		doneChan := make(chan *CmdDoneChan)
+		errChan := make(chan *CmdDoneChan)
+		taskInfo.WaitPoll("skip", doneChan, errChan)
+
+		select {
+		case ret := <-doneChan:
+			if ret.Skipped != testCase.skipped {
+				t.Errorf("Wrong skip for '%s':\ngot: %v\nexpected: %v\n",
+					testCase.when, ret.Skipped, testCase.skipped)
+			}
+		case ret := <-errChan:
+			t.Errorf("Task finished with error: %s\n", ret.Error)
+		}
+	}
+}
+
+func TestSecretMasking(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotask")
+	if err != nil {
+		t.Fatalf("Cannot create dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ioutil.WriteFile(path.Join(dir, VarFileName), nil, 0644); err != nil {
+		t.Fatalf("Cannot write var file: %s", err.Error())
+	}
+	if err = ioutil.WriteFile(path.Join(dir, SecretFileName),
+		[]byte("TOKEN: s3cr3t\n"), 0600); err != nil {
+		t.Fatalf("Cannot write secret file: %s", err.Error())
+	}
+
+	test := taskTestCase{
+		task: Task{
+			Name:       "secret",
+			Command:    []string{"echo -n token is $TOKEN"},
+			Dir:        dir,
+			ShowOutput: true,
+			Shell:      "bash",
+		},
+		expectedOutput: "token is " + SecretMask,
+	}
+
+	taskInfo, err := test.task.Run()
+	if err != nil {
+		t.Fatalf("Fail to run task: %s\n", err.Error())
+	}
+
+	doneChan := make(chan *CmdDoneChan)
+	errChan := make(chan *CmdDoneChan)
+	taskInfo.WaitPoll("secret", doneChan, errChan)
+
+	select {
+	case ret := <-doneChan:
+		if ret.Output != test.expectedOutput {
+			t.Errorf("Secret not masked:\ngot: %s\nexpected: %s\n",
+				ret.Output, test.expectedOutput)
+		}
+	case ret := <-errChan:
+		t.Errorf("Task finished with error: %s\n", ret.Error)
+	}
+}
+
+type resultTestCase struct {
+	task     Task
+	expected RunResult
+}
+
+var allResultTests = []resultTestCase{
+	{
+		task: Task{
+			Name:    "exit",
+			Command: []string{"exit 3"},
+			Shell:   "bash",
+		},
+		expected: RunResult{
+			ExitCode: 3,
+		},
+	}, {
+		task: Task{
+			Name:    "timeout",
+			Command: []string{"sleep", "5"},
+			Timeout: Duration(100 * time.Millisecond),
+		},
+		expected: RunResult{
+			ExitCode:   -1,
+			Signal:     "killed",
+			Killed:     true,
+			KillReason: KillTimeout,
+		},
+	},
+}
+
+func (test *resultTestCase) doTest(t *testing.T) {
+	taskInfo, err := test.task.Run()
+	if err != nil {
+		t.Fatalf("Fail to run task: %s\n", err.Error())
+	}
+
+	doneChan := make(chan *CmdDoneChan)
+	errChan := make(chan *CmdDoneChan)
+	taskInfo.WaitPoll(test.task.Name, doneChan, errChan)
+
+	var ret *CmdDoneChan
+	select {
+	case ret = <-doneChan:
+		t.Errorf("Task %s should have failed", test.task.Name)
+	case ret = <-errChan:
+	}
+
+	got := ret.Result
+	if got == nil {
+		t.Fatalf("Missing result for %s", test.task.Name)
+	}
+	if got.ExitCode != test.expected.ExitCode || got.Signal != test.expected.Signal ||
+		got.Killed != test.expected.Killed || got.KillReason != test.expected.KillReason {
+		t.Errorf("Result mismatch for %s:\ngot: %+v\nexpected: %+v\n",
+			test.task.Name, *got, test.expected)
+	}
+	if got.EndAt.Before(got.StartAt) || time.Duration(got.Duration) < 0 {
+		t.Errorf("Wrong times for %s: %+v", test.task.Name, *got)
+	}
+}
+
+func TestRunResult(t *testing.T) {
+	for _, testCase := range allResultTests {
+		testCase.doTest(t)
+	}
+}
+
+type stdinTestCase struct {
+	task     Task
+	opts     *RunOptions
+	expected string
+}
+
+var allStdinTests = []stdinTestCase{
+	{
+		task: Task{
+			Name:       "static",
+			Command:    []string{"cat"},
+			ShowOutput: true,
+			Stdin:      "static input",
+		},
+		expected: "static input",
+	}, {
+		task: Task{
+			Name:       "input",
+			Command:    []string{"cat"},
+			ShowOutput: true,
+			Stdin:      "static input",
+		},
+		opts: &RunOptions{
+			Input: []byte("run input"),
+		},
+		expected: "run input",
+	}, {
+		task: Task{
+			Name:       "none",
+			Command:    []string{"cat"},
+			ShowOutput: true,
+		},
+		expected: "",
+	},
+}
+
+func (test *stdinTestCase) doTest(t *testing.T) {
+	ret := waitTask(test.task, test.opts, t)
+	if ret.Output != test.expected {
+		t.Errorf("Output mismatch for %s:\ngot: %s\nexpected: %s\n",
+			test.task.Name, ret.Output, test.expected)
+	}
+}
+
+func TestStdin(t *testing.T) {
+	for _, testCase := range allStdinTests {
+		testCase.doTest(t)
+	}
+}
+
+func TestTty(t *testing.T) {
+	test := Task{
+		Name:       "tty",
+		Command:    []string{"read line; echo got:$line; tty -s && echo is-a-tty"},
+		Shell:      "bash",
+		ShowOutput: true,
+		Tty:        true,
+		Stdin:      "hello\n",
+	}
+
+	ret := waitTask(test, nil, t)
+	if !strings.Contains(ret.Output, "got:hello") || !strings.Contains(ret.Output, "is-a-tty") {
+		t.Errorf("Wrong terminal output: %q", ret.Output)
+	}
+	if ret.Result == nil || ret.Result.ExitCode != 0 {
+		t.Errorf("Wrong result: %+v", ret.Result)
+	}
+}
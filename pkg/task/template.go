@@ -0,0 +1,202 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateError is returned when a template of
+// a task can't be parsed or executed.
+type TemplateError struct {
+	// Command[i], Env[NAME] or Dir
+	Field string
+	Err   error
+}
+
+func (e TemplateError) Error() string {
+	return fmt.Sprintf("Template error in %s: %s", e.Field, e.Err.Error())
+}
+
+// RunMetadata describes the current run.
+type RunMetadata struct {
+	ID   string
+	Task string
+	Time time.Time
+	// the temporary directory, if the DirPolicy
+	// has one, empty in the Dir template
+	Dir string
+	// the result file, with OutputFormat
+	// OutputResultFile
+	ResultFile string
+}
+
+// TemplateData is what the templates are executed with.
+// Vars holds the typed values of the task vars: string,
+// int64, bool or []string for lists. A missing var or
+// param is an error, var and param are for the optional
+// ones: {{ var "arch" | default "amd64" }}.
+type TemplateData struct {
+	Vars   map[string]interface{}
+	Params map[string]string
+	Run    RunMetadata
+
+	// what the process inherits, after the EnvPolicy
+	env []string
+}
+
+// templateFuncs are the functions available to the templates,
+// the ones of the data are added by funcs.
+var templateFuncs = template.FuncMap{
+	"quote":   shellQuote,
+	"join":    templateJoin,
+	"default": templateDefault,
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+}
+
+// funcs returns the functions of the templates executed with d:
+// var, param and env return the value of a var, a param and an
+// env var of the process, nil or empty if missing. env only sees
+// what the EnvPolicy lets the process inherit.
+func (d *TemplateData) funcs() template.FuncMap {
+	funcs := template.FuncMap{
+		"var": func(name string) interface{} {
+			return d.Vars[name]
+		},
+		"param": func(name string) string {
+			return d.Params[name]
+		},
+		"env": func(name string) string {
+			return lookupEnv(d.env, name)
+		},
+	}
+	for name, function := range templateFuncs {
+		funcs[name] = function
+	}
+	return funcs
+}
+
+// shellQuote quotes s so that a shell sees it as a single word.
+func shellQuote(s interface{}) string {
+	return "'" + strings.Replace(fmt.Sprint(s), "'", `'\''`, -1) + "'"
+}
+
+// templateJoin joins the items of a list with sep.
+func templateJoin(sep string, list interface{}) (string, error) {
+	switch items := list.(type) {
+	case []string:
+		return strings.Join(items, sep), nil
+	case string:
+		return items, nil
+	}
+
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice {
+		return "", fmt.Errorf("join: not a list: %v", list)
+	}
+	items := make([]string, v.Len())
+	for i := range items {
+		items[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return strings.Join(items, sep), nil
+}
+
+// templateDefault returns def if value is empty.
+func templateDefault(def, value interface{}) interface{} {
+	if value == nil {
+		return def
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		if v.Len() == 0 {
+			return def
+		}
+	}
+	return value
+}
+
+// newTemplateData returns the data used by the templates,
+// secret vars are not given. env is what the process inherits.
+func newTemplateData(vars []Var, opts *RunOptions, taskName string, env []string) *TemplateData {
+	data := &TemplateData{
+		Vars:   make(map[string]interface{}, len(vars)),
+		Params: opts.Params,
+		Run: RunMetadata{
+			ID:   opts.ID,
+			Task: taskName,
+			Time: time.Now(),
+		},
+		env: env,
+	}
+	if data.Params == nil {
+		data.Params = make(map[string]string)
+	}
+
+	for _, variable := range vars {
+		if variable.Secret {
+			continue
+		}
+		switch variable.Type {
+		case VarInt:
+			num, _ := strconv.ParseInt(variable.Value, 10, 64)
+			data.Vars[variable.Name] = num
+		case VarBool:
+			b, _ := strconv.ParseBool(variable.Value)
+			data.Vars[variable.Name] = b
+		case VarList:
+			data.Vars[variable.Name] = variable.List
+		default:
+			data.Vars[variable.Name] = variable.Value
+		}
+	}
+	return data
+}
+
+// renderTemplate executes text as a template, field is used
+// in the error to tell where the problem is.
+func renderTemplate(field, text string, data *TemplateData) (string, error) {
+	tmpl, err := template.New(field).
+		Option("missingkey=error").
+		Funcs(data.funcs()).
+		Parse(text)
+	if err != nil {
+		return "", TemplateError{Field: field, Err: err}
+	}
+
+	var writer strings.Builder
+	if err = tmpl.Execute(&writer, data); err != nil {
+		return "", TemplateError{Field: field, Err: err}
+	}
+	return writer.String(), nil
+}
+
+// renderCommand renders every argument of the command.
+func renderCommand(command []string, data *TemplateData) ([]string, error) {
+	rendered := make([]string, len(command))
+	for i, arg := range command {
+		var err error
+		rendered[i], err = renderTemplate(fmt.Sprintf("Command[%d]", i), arg, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rendered, nil
+}
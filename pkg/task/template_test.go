@@ -0,0 +1,151 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+type templateTestCase struct {
+	task            Task
+	opts            *RunOptions
+	expectedCommand []string
+	withError       bool
+}
+
+var allTemplateTests = []templateTestCase{
+	{
+		task: Task{
+			Name: "deploy",
+			Command: []string{
+				"echo",
+				"{{ .Vars.env | upper }}",
+				"{{ join \",\" .Vars.targets }}",
+				"{{ param \"version\" | default \"latest\" }}",
+				"{{ var \"arch\" | default \"amd64\" }}",
+				"{{ .Run.ID }}-{{ .Run.Task }}",
+				"{{ quote \"it's\" }}",
+			},
+			Template: true,
+		},
+		opts: &RunOptions{
+			ID: "abc",
+		},
+		expectedCommand: []string{
+			"echo",
+			"PROD",
+			"linux,darwin",
+			"latest",
+			"amd64",
+			"abc-deploy",
+			`'it'\''s'`,
+		},
+	}, {
+		task: Task{
+			Name:     "params",
+			Command:  []string{"echo", "{{ .Params.version }}", "${env}"},
+			Template: true,
+		},
+		opts: &RunOptions{
+			Params: map[string]string{"version": "1.2"},
+		},
+		// no ${VAR} replacement in template mode
+		expectedCommand: []string{"echo", "1.2", "${env}"},
+	}, {
+		task: Task{
+			Name:     "optional",
+			Command:  []string{"echo", "{{ param \"nothing\" }}", "{{ var \"env\" | default \"dev\" }}"},
+			Template: true,
+		},
+		expectedCommand: []string{"echo", "", "prod"},
+	}, {
+		task: Task{
+			Name:     "missing param",
+			Command:  []string{"echo", "{{ .Params.nothing }}"},
+			Template: true,
+		},
+		withError: true,
+	}, {
+		task: Task{
+			Name:     "missing var",
+			Command:  []string{"echo", "{{ .Vars.enb }}"},
+			Template: true,
+		},
+		withError: true,
+	}, {
+		task: Task{
+			Name: "env",
+			Command: []string{
+				"echo",
+				"{{ env \"GOTASK_TEMPLATE_KEEP\" }}",
+				"{{ env \"GOTASK_TEMPLATE_DROP\" | default \"none\" }}",
+			},
+			EnvPolicy: &EnvPolicy{Mode: EnvInheritAllowlist, Allow: []string{"GOTASK_TEMPLATE_KEEP"}},
+			Template:  true,
+		},
+		// only what the process inherits
+		expectedCommand: []string{"echo", "keep", "none"},
+	}, {
+		task: Task{
+			Name:     "syntax",
+			Command:  []string{"echo", "{{ .Vars.env "},
+			Template: true,
+		},
+		withError: true,
+	},
+}
+
+func (test *templateTestCase) doTest(dir string, t *testing.T) {
+	test.task.Dir = dir
+	command, err := test.task.Validate(test.opts)
+	if test.withError {
+		if _, ok := err.(TemplateError); !ok {
+			t.Errorf("Expected template error for %s, got: %v", test.task.Name, err)
+		}
+		return
+	}
+
+	if err != nil {
+		t.Errorf("Got error for %s: %s\n", test.task.Name, err.Error())
+	} else if !reflect.DeepEqual(command, test.expectedCommand) {
+		t.Errorf("Wrong rendering for %s:\ngot: %v\nexpected: %v\n",
+			test.task.Name, command, test.expectedCommand)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotask")
+	if err != nil {
+		t.Fatalf("Cannot create dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ioutil.WriteFile(path.Join(dir, VarFileName),
+		[]byte("env: prod\nlist targets: linux, darwin\n"), 0644); err != nil {
+		t.Fatalf("Cannot write var file: %s", err.Error())
+	}
+
+	os.Setenv("GOTASK_TEMPLATE_KEEP", "keep")
+	os.Setenv("GOTASK_TEMPLATE_DROP", "drop")
+	defer os.Unsetenv("GOTASK_TEMPLATE_KEEP")
+	defer os.Unsetenv("GOTASK_TEMPLATE_DROP")
+
+	for _, testCase := range allTemplateTests {
+		testCase.doTest(dir, t)
+	}
+}
@@ -0,0 +1,204 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/creack/pty"
+)
+
+const (
+	// DefaultTerminalRows and DefaultTerminalCols are the
+	// size of a terminal till the first resize.
+	DefaultTerminalRows = 24
+	DefaultTerminalCols = 80
+
+	// the output chunks queued for an attached client,
+	// a slower client is detached
+	attachQueueSize = 256
+)
+
+// Terminal is the PTY of a task run with Tty: the output
+// is sent to the attached clients, that can write the input.
+type Terminal struct {
+	master *os.File
+
+	clients map[int]chan []byte
+	nextID  int
+	closed  bool
+	*sync.Mutex
+}
+
+func newTerminal(master *os.File) *Terminal {
+	return &Terminal{
+		master:  master,
+		clients: make(map[int]chan []byte),
+		Mutex:   &sync.Mutex{},
+	}
+}
+
+// Input writes p to the terminal, as if typed.
+func (t *Terminal) Input(p []byte) error {
+	_, err := t.master.Write(p)
+	return err
+}
+
+// Resize changes the size of the terminal.
+func (t *Terminal) Resize(rows, cols uint16) error {
+	return pty.Setsize(t.master, &pty.Winsize{
+		Rows: rows,
+		Cols: cols,
+	})
+}
+
+// Attach returns a channel receiving the output of the
+// terminal from now on. The channel is closed when the
+// process ends, when detach is called or when the client
+// is too slow to read.
+func (t *Terminal) Attach() (<-chan []byte, func()) {
+	t.Lock()
+	defer t.Unlock()
+
+	output := make(chan []byte, attachQueueSize)
+	if t.closed {
+		close(output)
+		return output, func() {}
+	}
+
+	id := t.nextID
+	t.nextID++
+	t.clients[id] = output
+	return output, func() {
+		t.Lock()
+		defer t.Unlock()
+		if client, ok := t.clients[id]; ok {
+			delete(t.clients, id)
+			close(client)
+		}
+	}
+}
+
+// broadcast sends p to the attached clients.
+func (t *Terminal) broadcast(p []byte) {
+	t.Lock()
+	defer t.Unlock()
+	for id, client := range t.clients {
+		select {
+		case client <- append([]byte(nil), p...):
+		default:
+			delete(t.clients, id)
+			close(client)
+		}
+	}
+}
+
+// close detaches all the clients and closes the PTY.
+func (t *Terminal) close() {
+	t.Lock()
+	defer t.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	for id, client := range t.clients {
+		delete(t.clients, id)
+		close(client)
+	}
+	t.master.Close()
+}
+
+// terminalWriter sends what is written to
+// the clients of the terminal.
+type terminalWriter struct {
+	*Terminal
+}
+
+func (w terminalWriter) Write(p []byte) (int, error) {
+	w.broadcast(p)
+	return len(p), nil
+}
+
+// launchTerminal starts the process with a PTY
+// as stdin, stdout and stderr.
+func (r *RuntimeTaskInfo) launchTerminal() error {
+	// the input is written to the terminal
+	input := r.Stdin
+	r.Stdin = nil
+	var file *os.File
+	if r.inputFile != "" {
+		var err error
+		if file, err = os.Open(r.inputFile); err != nil {
+			return err
+		}
+		input = file
+	}
+
+	// a new session, that is a new group too
+	r.SysProcAttr.Setpgid = false
+	master, err := pty.StartWithSize(r.Cmd, &pty.Winsize{
+		Rows: DefaultTerminalRows,
+		Cols: DefaultTerminalCols,
+	})
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}
+
+	r.Terminal = newTerminal(master)
+	r.OutPipe = master
+	r.started(&localExecution{
+		cmd:    r.Cmd,
+		stdout: master,
+		stderr: strings.NewReader(""),
+	})
+
+	if input != nil {
+		go func() {
+			io.Copy(master, input)
+			if file != nil {
+				file.Close()
+			}
+		}()
+	}
+	return nil
+}
+
+// drainTerminal reads the output of the PTY till the end.
+func (r *RuntimeTaskInfo) drainTerminal(id string) (*sink, error) {
+	out := r.newSink(id, StreamStdout)
+	// the attached clients see no secret either
+	attached := &maskWriter{
+		out:    terminalWriter{r.Terminal},
+		masker: r.masker,
+		eager:  true,
+	}
+	_, err := io.Copy(io.MultiWriter(out, attached), r.OutPipe)
+	attached.flush()
+	// the PTY gives EIO when the process is gone
+	if errors.Is(err, syscall.EIO) {
+		err = nil
+	}
+	if closeErr := out.close(); err == nil {
+		err = closeErr
+	}
+	return out, err
+}
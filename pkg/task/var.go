@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -27,6 +28,13 @@ const (
 
 	// VarFileName is the name of the var file.
 	VarFileName = ".taskvar"
+
+	// SecretFileName is the name of the secret var file.
+	// It has the same syntax of the var file, but it must
+	// not be readable by group or others. It's the only
+	// place of the secret vars: they can't be marked in a
+	// var file, that may be readable by anyone.
+	SecretFileName = ".tasksecret"
 )
 
 // VarReadingError is thrown when there's an error parsing
@@ -40,9 +48,43 @@ func (e VarReadingError) Error() string {
 	return fmt.Sprintf(SyntaxError+": %d, %s", e.Line, e.Desc)
 }
 
+// SecretPermissionError is returned when the secret file
+// is accessible by someone else than its owner.
+type SecretPermissionError struct {
+	Path string
+	Mode os.FileMode
+}
+
+func (e SecretPermissionError) Error() string {
+	return fmt.Sprintf("Secret file %s has mode %s, it must not be accessible by group or others",
+		e.Path, e.Mode)
+}
+
+// VarType is the type of a variable.
+type VarType string
+
+// The supported variable types.
+const (
+	VarString VarType = "string"
+	VarInt    VarType = "int"
+	VarBool   VarType = "bool"
+	VarList   VarType = "list"
+)
+
 // Var wraps a variable
 type Var struct {
 	Name, Value string
+
+	// a secret var is never shown, it is only
+	// injected in the environment of the process.
+	// Only the ones of SecretFileName are secret.
+	Secret bool
+
+	// empty means VarString
+	Type VarType
+	// the items of a VarList, Value has them
+	// joined by a space
+	List []string
 }
 
 // ToReplacer returns the variable name in the format
@@ -70,6 +112,57 @@ func (v *Var) cleanAndCheck() error {
 	return nil
 }
 
+// NewTypedVar returns a new variable of the given type,
+// value is checked to be of that type. A list value is
+// made of comma separated items.
+func NewTypedVar(name string, varType VarType, value string) (Var, error) {
+	taskVar, err := NewTaskVar(name, value)
+	if err != nil {
+		return taskVar, err
+	}
+
+	switch varType {
+	case VarString:
+		return taskVar, nil
+	case VarInt:
+		_, err = strconv.ParseInt(taskVar.Value, 10, 64)
+	case VarBool:
+		var b bool
+		b, err = strconv.ParseBool(taskVar.Value)
+		taskVar.Value = strconv.FormatBool(b)
+	case VarList:
+		var items []string
+		if taskVar.Value != "" {
+			for _, item := range strings.Split(taskVar.Value, ",") {
+				items = append(items, strings.TrimSpace(item))
+			}
+		}
+		return NewListVar(taskVar.Name, items), nil
+	default:
+		return taskVar, VarReadingError{
+			Desc: fmt.Sprintf("unknown type: %s", varType),
+		}
+	}
+
+	if err != nil {
+		return taskVar, VarReadingError{
+			Desc: fmt.Sprintf("near: %s, not a valid %s", taskVar.Value, varType),
+		}
+	}
+	taskVar.Type = varType
+	return taskVar, nil
+}
+
+// NewListVar returns a new variable of type VarList.
+func NewListVar(name string, items []string) Var {
+	return Var{
+		Name:  name,
+		Value: strings.Join(items, " "),
+		Type:  VarList,
+		List:  items,
+	}
+}
+
 // NewTaskVar returns a new TaskVar object
 // with some smart check such as trim spaces.
 // Returns error if there's at least one space in the Name
@@ -83,6 +176,23 @@ func NewTaskVar(name, value string) (Var, error) {
 	return taskVar, err
 }
 
+// readVar reads a var whose name may have
+// a type before, as in 'int count: 5'.
+func readVar(name, value string) (Var, error) {
+	fields := strings.Fields(name)
+	if len(fields) == 2 {
+		switch varType := VarType(fields[0]); varType {
+		case VarString, VarInt, VarBool, VarList:
+			return NewTypedVar(fields[1], varType, value)
+		case "secret":
+			return Var{}, VarReadingError{
+				Desc: "secret vars go in " + SecretFileName,
+			}
+		}
+	}
+	return NewTaskVar(name, value)
+}
+
 func readVarsFrom(in *bufio.Reader) ([]Var, error) {
 	var vars []Var
 	var currentVar Var
@@ -118,14 +228,16 @@ func readVarsFrom(in *bufio.Reader) ([]Var, error) {
 			break
 		}
 
-		unparsedVar = strings.Split(strLine, ":")
-		currentVar, err = NewTaskVar(unparsedVar[0], unparsedVar[1])
+		// the value may contain ':' too
+		unparsedVar = strings.SplitN(strLine, ":", 2)
+		currentVar, err = readVar(unparsedVar[0], unparsedVar[1])
 		if err != nil {
 			loop = false
 			break
 		} else {
 			vars = append(vars, currentVar)
 		}
+		lineCount++
 	}
 
 	// type assertion doesn't work inside the loop
@@ -138,12 +250,41 @@ func readVarsFrom(in *bufio.Reader) ([]Var, error) {
 }
 
 // ReadVars reads variable from the given path.
+// The format is detected by the extension: '.env' files
+// use the dotenv syntax, '.json' and '.yaml' files contain
+// a map, otherwise it's the 'name: value' syntax.
 func ReadVars(path string) ([]Var, error) {
 	varsFile, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer varsFile.Close()
+
+	return readVarsFormat(varsFile, varFormat(path))
+}
 
-	in := bufio.NewReader(varsFile)
-	return readVarsFrom(in)
+// ReadSecrets reads secret variables from the given path.
+// The file must not be accessible by group or others,
+// otherwise a SecretPermissionError is returned.
+func ReadSecrets(path string) ([]Var, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, SecretPermissionError{
+			Path: path,
+			Mode: info.Mode().Perm(),
+		}
+	}
+
+	vars, err := ReadVars(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range vars {
+		vars[i].Secret = true
+	}
+	return vars, nil
 }
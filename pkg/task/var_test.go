@@ -16,6 +16,7 @@ package task
 import (
 	"bufio"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"reflect"
 	"strings"
@@ -122,9 +123,160 @@ var inputNameSpaceError = varStrTestCase{
 	},
 }
 
+var inputDotenv = varStrTestCase{
+	input: []string{
+		"# a comment",
+		"output=/dev/null",
+		"export input=/dev/stdin",
+		"",
+		`quoted="a \"b\"" # comment`,
+		"single='$HOME'",
+		"url=http://localhost:80 # inline",
+	},
+	expected: []Var{
+		{
+			Name:  "output",
+			Value: "/dev/null",
+		}, {
+			Name:  "input",
+			Value: "/dev/stdin",
+		}, {
+			Name:  "quoted",
+			Value: `a "b"`,
+		}, {
+			Name:  "single",
+			Value: "$HOME",
+		}, {
+			Name:  "url",
+			Value: "http://localhost:80",
+		},
+	},
+}
+
+var inputDotenvError = varStrTestCase{
+	input: []string{
+		"ok=1",
+		"not ok",
+	},
+	withError: true,
+	expectedError: VarReadingError{
+		Desc: "missing '='",
+		Line: 2,
+	},
+}
+
+var inputJSON = varStrTestCase{
+	input: []string{
+		`{"output": "/dev/null", "count": 3, "debug": true, "dirs": ["a", "b"]}`,
+	},
+	expected: []Var{
+		{
+			Name:  "output",
+			Value: "/dev/null",
+		}, {
+			Name:  "count",
+			Value: "3",
+			Type:  VarInt,
+		}, {
+			Name:  "debug",
+			Value: "true",
+			Type:  VarBool,
+		}, {
+			Name:  "dirs",
+			Value: "a b",
+			Type:  VarList,
+			List:  []string{"a", "b"},
+		},
+	},
+}
+
+var inputYAML = varStrTestCase{
+	input: []string{
+		"output: /dev/null",
+		"count: 3",
+		"debug: true",
+		"dirs: [a, b]",
+	},
+	expected: []Var{
+		{
+			Name:  "output",
+			Value: "/dev/null",
+		}, {
+			Name:  "count",
+			Value: "3",
+			Type:  VarInt,
+		}, {
+			Name:  "debug",
+			Value: "true",
+			Type:  VarBool,
+		}, {
+			Name:  "dirs",
+			Value: "a b",
+			Type:  VarList,
+			List:  []string{"a", "b"},
+		},
+	},
+}
+
+var inputTyped = varStrTestCase{
+	input: []string{
+		"int count: 3",
+		"bool debug: True",
+		"list dirs: a, b",
+		"string url: http://localhost",
+	},
+	expected: []Var{
+		{
+			Name:  "count",
+			Value: "3",
+			Type:  VarInt,
+		}, {
+			Name:  "debug",
+			Value: "true",
+			Type:  VarBool,
+		}, {
+			Name:  "dirs",
+			Value: "a b",
+			Type:  VarList,
+			List:  []string{"a", "b"},
+		}, {
+			Name:  "url",
+			Value: "http://localhost",
+		},
+	},
+}
+
+var inputTypeError = varStrTestCase{
+	input: []string{
+		"int count: 3",
+		"int other: three",
+	},
+	withError: true,
+	expectedError: VarReadingError{
+		Desc: "near: three, not a valid int",
+		Line: 2,
+	},
+}
+
+// secrets are only in the secret file
+var inputSecretError = varStrTestCase{
+	input: []string{
+		"debug: true",
+		"secret token: s3cr3t",
+	},
+	withError: true,
+	expectedError: VarReadingError{
+		Desc: "secret vars go in " + SecretFileName,
+		Line: 2,
+	},
+}
+
 var strAllInputs = []varStrTestCase{
 	inputOk,
 	inputNameSpaceError,
+	inputTyped,
+	inputTypeError,
+	inputSecretError,
 }
 
 var fileAllInputs = []varFileTestCase{
@@ -134,6 +286,18 @@ var fileAllInputs = []varFileTestCase{
 	}, {
 		varStrTestCase: inputNameSpaceError,
 		file:           "input_not_ok.vars",
+	}, {
+		varStrTestCase: inputDotenv,
+		file:           "input_ok.env",
+	}, {
+		varStrTestCase: inputDotenvError,
+		file:           "input_not_ok.env",
+	}, {
+		varStrTestCase: inputJSON,
+		file:           "input_ok.json",
+	}, {
+		varStrTestCase: inputYAML,
+		file:           "input_ok.yaml",
 	},
 }
 
@@ -148,3 +312,63 @@ func TestVarsFromFile(t *testing.T) {
 		testCase.doTest(t)
 	}
 }
+
+type secretFileTestCase struct {
+	file      string
+	mode      os.FileMode
+	withError bool
+}
+
+func (s *secretFileTestCase) doTest(t *testing.T) {
+	if err := ioutil.WriteFile(s.file, []byte("token: abc\n"), s.mode); err != nil {
+		t.Fatalf("Cannot create file: %s", err.Error())
+	}
+	defer os.Remove(s.file)
+	// umask may have removed some bits
+	if err := os.Chmod(s.file, s.mode); err != nil {
+		t.Fatalf("Cannot chmod file: %s", err.Error())
+	}
+
+	vars, err := ReadSecrets(s.file)
+	if s.withError {
+		if _, ok := err.(SecretPermissionError); !ok {
+			t.Errorf("Expected permission error, got: %v", err)
+		}
+		return
+	}
+
+	if err != nil {
+		t.Errorf("Got error while expecting none: %s\n", err.Error())
+	} else if len(vars) != 1 || !vars[0].Secret {
+		t.Errorf("Secret not marked as such: %v", vars)
+	}
+}
+
+var secretFileInputs = []secretFileTestCase{
+	{
+		file: "secret_ok.vars",
+		mode: 0600,
+	}, {
+		file:      "secret_not_ok.vars",
+		mode:      0644,
+		withError: true,
+	},
+}
+
+func TestSecretsFromFile(t *testing.T) {
+	for _, testCase := range secretFileInputs {
+		testCase.doTest(t)
+	}
+}
+
+func TestMergeVars(t *testing.T) {
+	first := []Var{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}
+	second := []Var{{Name: "c", Value: "3"}, {Name: "a", Value: "4"}}
+
+	expected := []Var{{Name: "a", Value: "4"}, {Name: "b", Value: "2"}, {Name: "c", Value: "3"}}
+	got := MergeVars(first, second)
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("MergeVars mismatch:\ngot: %v\nexpected: %v\n", got, expected)
+	}
+}
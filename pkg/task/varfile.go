@@ -0,0 +1,264 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package task
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The formats of a var file, detected by extension.
+const (
+	VarFormatTaskVar = "taskvar"
+	VarFormatDotenv  = ".env"
+	VarFormatJSON    = ".json"
+	VarFormatYAML    = ".yaml"
+	VarFormatYML     = ".yml"
+)
+
+// varFormat returns the format of the var file
+// looking at its extension.
+func varFormat(file string) string {
+	switch ext := path.Ext(file); ext {
+	case VarFormatDotenv, VarFormatJSON, VarFormatYAML:
+		return ext
+	case VarFormatYML:
+		return VarFormatYAML
+	default:
+		return VarFormatTaskVar
+	}
+}
+
+// readVarsFormat reads the vars from in using the given format.
+func readVarsFormat(in io.Reader, format string) ([]Var, error) {
+	switch format {
+	case VarFormatDotenv:
+		return readDotenvFrom(bufio.NewReader(in))
+	case VarFormatJSON:
+		return readJSONVarsFrom(in)
+	case VarFormatYAML:
+		return readYAMLVarsFrom(in)
+	default:
+		return readVarsFrom(bufio.NewReader(in))
+	}
+}
+
+// readDotenvFrom reads a dotenv file, that is KEY=value lines,
+// with optional 'export', quotes and comments.
+func readDotenvFrom(in *bufio.Reader) ([]Var, error) {
+	var vars []Var
+	lineCount := 0
+
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+		lineCount++
+
+		strLine := strings.TrimSpace(line)
+		if strLine != "" && !strings.HasPrefix(strLine, "#") {
+			variable, parseErr := parseDotenvLine(strLine)
+			if parseErr != nil {
+				parseErr.Line = lineCount
+				return nil, *parseErr
+			}
+			vars = append(vars, variable)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	return vars, nil
+}
+
+func parseDotenvLine(line string) (Var, *VarReadingError) {
+	line = strings.TrimPrefix(line, "export ")
+
+	index := strings.Index(line, "=")
+	if index == -1 {
+		return Var{}, &VarReadingError{Desc: "missing '='"}
+	}
+
+	name := strings.TrimSpace(line[:index])
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return Var{}, &VarReadingError{Desc: fmt.Sprintf("invalid name: %s", name)}
+	}
+
+	value := strings.TrimSpace(line[index+1:])
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := strings.LastIndex(value, `"`)
+		if end == 0 {
+			return Var{}, &VarReadingError{Desc: "unterminated '\"'"}
+		}
+		unquoted, err := strconv.Unquote(value[:end+1])
+		if err != nil {
+			return Var{}, &VarReadingError{Desc: fmt.Sprintf("bad quoting: %s", err.Error())}
+		}
+		value = unquoted
+	case strings.HasPrefix(value, "'"):
+		end := strings.LastIndex(value, "'")
+		if end == 0 {
+			return Var{}, &VarReadingError{Desc: "unterminated '''"}
+		}
+		value = value[1:end]
+	default:
+		// inline comment
+		if index := strings.Index(value, " #"); index != -1 {
+			value = strings.TrimSpace(value[:index])
+		}
+	}
+
+	return Var{
+		Name:  name,
+		Value: value,
+	}, nil
+}
+
+// newVarFrom returns a typed var from a JSON or YAML value.
+func newVarFrom(name string, value interface{}) (Var, error) {
+	switch v := value.(type) {
+	case string:
+		return NewTaskVar(name, v)
+	case nil:
+		return NewTaskVar(name, "")
+	case bool:
+		return NewTypedVar(name, VarBool, strconv.FormatBool(v))
+	case int, int64:
+		return NewTypedVar(name, VarInt, fmt.Sprintf("%d", v))
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return NewTypedVar(name, VarInt, v.String())
+		}
+		return NewTaskVar(name, v.String())
+	case float64:
+		return NewTaskVar(name, strconv.FormatFloat(v, 'f', -1, 64))
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			variable, err := newVarFrom(name, item)
+			if err != nil {
+				return variable, err
+			}
+			if variable.Type == VarList {
+				return variable, fmt.Errorf("Nested lists not supported for variable %s", name)
+			}
+			items[i] = variable.Value
+		}
+		variable, err := NewTaskVar(name, "")
+		if err != nil {
+			return variable, err
+		}
+		return NewListVar(variable.Name, items), nil
+	default:
+		return Var{}, fmt.Errorf("Unsupported value for variable %s: %v", name, value)
+	}
+}
+
+// readJSONVarsFrom reads a JSON object of name: value,
+// keeping the order of the file.
+func readJSONVarsFrom(in io.Reader) ([]Var, error) {
+	decoder := json.NewDecoder(in)
+	decoder.UseNumber()
+
+	// a map has no order, the object is walked
+	if token, err := decoder.Token(); err != nil {
+		return nil, err
+	} else if token != json.Delim('{') {
+		return nil, fmt.Errorf("JSON var file is not an object")
+	}
+
+	var vars []Var
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := token.(string)
+		if !ok {
+			return nil, fmt.Errorf("Invalid name in JSON var file: %v", token)
+		}
+		var value interface{}
+		if err = decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		variable, err := newVarFrom(name, value)
+		if err != nil {
+			return nil, err
+		}
+		vars = append(vars, variable)
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	// as a map, the last one of a name wins
+	return MergeVars(vars), nil
+}
+
+// readYAMLVarsFrom reads a YAML map of name: value,
+// keeping the order of the file.
+func readYAMLVarsFrom(in io.Reader) ([]Var, error) {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var receiver yaml.MapSlice
+	if err = yaml.Unmarshal(data, &receiver); err != nil {
+		return nil, err
+	}
+
+	vars := make([]Var, 0, len(receiver))
+	for _, item := range receiver {
+		name := fmt.Sprintf("%v", item.Key)
+		variable, err := newVarFrom(name, item.Value)
+		if err != nil {
+			return nil, err
+		}
+		vars = append(vars, variable)
+	}
+	return vars, nil
+}
+
+// MergeVars merges the given sets of vars: a var
+// in a later set overrides the one with the same name
+// in the earlier ones, keeping its first position.
+func MergeVars(sets ...[]Var) []Var {
+	var merged []Var
+	index := make(map[string]int)
+	for _, set := range sets {
+		for _, variable := range set {
+			if i, ok := index[variable.Name]; ok {
+				merged[i] = variable
+			} else {
+				index[variable.Name] = len(merged)
+				merged = append(merged, variable)
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,223 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbena/gotask/pkg/agent"
+	"github.com/nbena/gotask/pkg/client"
+	"github.com/nbena/gotask/pkg/req"
+	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+type agentTestCase struct {
+	serverConfig *server.Config
+	clientConfig *client.Config
+	agentConfig  *agent.Config
+	tasks        []task.Task
+}
+
+// executeAsync runs a task, the response is sent on the channel.
+func executeAsync(taskClient *client.TaskClient, name string,
+	t *testing.T) <-chan *req.ShortRunningTaskResponse {
+	ch := make(chan *req.ShortRunningTaskResponse, 1)
+	go func() {
+		resp, err := taskClient.Execute(name)
+		if err != nil {
+			t.Errorf("Execute error of %s: %s\n", name, err.Error())
+		}
+		ch <- resp
+	}()
+	return ch
+}
+
+// waitResponse waits for the response of an executeAsync.
+func waitResponse(ch <-chan *req.ShortRunningTaskResponse, t *testing.T) *req.ShortRunningTaskResponse {
+	select {
+	case resp := <-ch:
+		if resp == nil {
+			t.FailNow()
+		}
+		return resp
+	case <-time.After(10 * time.Second):
+		t.Fatalf("No response\n")
+		return nil
+	}
+}
+
+// runningID waits for a running job and returns its ID.
+func runningID(taskClient *client.TaskClient, t *testing.T) string {
+	for i := 0; i < 100; i++ {
+		queue, err := taskClient.Queue()
+		if err != nil {
+			t.Fatalf("Queue error: %s\n", err.Error())
+		}
+		if len(queue.Running) > 0 {
+			return queue.Running[0].ID
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Nothing running\n")
+	return ""
+}
+
+func (s *agentTestCase) doTest(t *testing.T) {
+	if err := os.MkdirAll(s.serverConfig.LogDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(s.serverConfig.LogDir)
+
+	defer runServer(s.serverConfig, s.tasks, t)()
+
+	taskClient := client.NewTaskClient(s.clientConfig)
+	agentConfig := *s.clientConfig
+	agentConfig.Token = s.agentConfig.Token
+	agentClient := client.NewTaskClient(&agentConfig)
+
+	if _, err := taskClient.RegisterAgent(req.RegisterAgentRequest{Name: "intruder"}); err == nil {
+		t.Errorf("Agent registered without the token\n")
+	}
+
+	// an agent that takes a job and dies
+	dead, err := agentClient.RegisterAgent(req.RegisterAgentRequest{
+		Name:   "dead",
+		Labels: s.agentConfig.Labels,
+	})
+	if err != nil {
+		t.Fatalf("Register error: %s\n", err.Error())
+	}
+	remote := executeAsync(taskClient, "remote", t)
+	var job *req.AgentJob
+	for i := 0; i < 10 && job == nil; i++ {
+		if job, err = agentClient.NextJob(dead.ID); err != nil {
+			t.Fatalf("NextJob error: %s\n", err.Error())
+		}
+	}
+	if job == nil || job.Task.Name != "remote" {
+		t.Fatalf("Wrong job: %+v\n", job)
+	}
+
+	worker, err := agent.New(s.agentConfig)
+	if err != nil {
+		t.Fatalf("Fail to start agent: %s\n", err.Error())
+	}
+	defer os.RemoveAll(s.agentConfig.WorkDir)
+	go func() {
+		if err := worker.Run(); err != nil {
+			t.Errorf("Agent error: %s\n", err.Error())
+		}
+	}()
+	defer worker.Stop()
+
+	// the job goes to the live agent
+	resp := waitResponse(remote, t)
+	if resp.Output != "hello\n" || resp.Run == nil || resp.Run.ExitCode != 0 {
+		t.Errorf("Wrong response of remote: %+v\n", resp)
+	}
+	if data, _, err := taskClient.Logs(job.ID, task.StreamStdout, 0); err != nil || string(data) != "hello\n" {
+		t.Errorf("Wrong log of remote: %q, %v\n", data, err)
+	}
+	if err = agentClient.SendResult(dead.ID, job.ID, &req.AgentResult{}); err != client.ErrAgentUnknown {
+		t.Errorf("Result of a dead agent accepted: %v\n", err)
+	}
+	agents, err := taskClient.Agents()
+	if err != nil || len(agents) != 1 || agents[0].Name != s.agentConfig.Name {
+		t.Errorf("Wrong agents: %+v, %v\n", agents, err)
+	}
+
+	// killed on the agent
+	sleeper := executeAsync(taskClient, "sleeper", t)
+	for i := 0; i < 100; i++ {
+		if agents, err = taskClient.Agents(); err == nil && len(agents) == 1 && len(agents[0].Jobs) == 1 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err = taskClient.Cancel(runningID(taskClient, t)); err != nil {
+		t.Errorf("Cancel error: %s\n", err.Error())
+	}
+	resp = waitResponse(sleeper, t)
+	if resp.Run == nil || resp.Run.KillReason != task.KillCancel {
+		t.Errorf("Sleeper not cancelled: %+v\n", resp)
+	}
+
+	// no agent has the labels
+	unmatched := executeAsync(taskClient, "unmatched", t)
+	if err = taskClient.Cancel(runningID(taskClient, t)); err != nil {
+		t.Errorf("Cancel error: %s\n", err.Error())
+	}
+	resp = waitResponse(unmatched, t)
+	if !strings.Contains(resp.Error, "waiting for an agent") || resp.Run != nil {
+		t.Errorf("Unmatched not cancelled: %+v\n", resp)
+	}
+}
+
+var agentTests = []agentTestCase{
+	{
+		serverConfig: &server.Config{
+			ListenAddr:       "127.0.0.1",
+			ListenPort:       7890,
+			TaskFile:         "agent_tasks.json",
+			InternalChanSize: 5,
+			LogDir:           "agent_logs",
+			AgentToken:       "agent-token",
+			AgentTimeout:     task.Duration(600 * time.Millisecond),
+		},
+		clientConfig: &client.Config{
+			ServerAddr:   "127.0.0.1",
+			ServerPort:   7890,
+			PollInterval: 50 * time.Millisecond,
+		},
+		agentConfig: &agent.Config{
+			ServerAddr:     "127.0.0.1",
+			ServerPort:     7890,
+			Token:          "agent-token",
+			Name:           "worker",
+			Labels:         map[string]string{"os": "linux"},
+			Capacity:       2,
+			WorkDir:        "agent_work",
+			StreamInterval: task.Duration(50 * time.Millisecond),
+		},
+		tasks: []task.Task{
+			{
+				Name:       "remote",
+				Command:    []string{"echo hello"},
+				Shell:      "bash",
+				ShowOutput: true,
+				Long:       true,
+				Labels:     map[string]string{"os": "linux"},
+			}, {
+				Name:    "sleeper",
+				Command: []string{"sleep", "30"},
+				Long:    true,
+				Labels:  map[string]string{"os": "linux"},
+			}, {
+				Name:    "unmatched",
+				Command: []string{"true"},
+				Labels:  map[string]string{"os": "plan9"},
+			},
+		},
+	},
+}
+
+func TestAgents(t *testing.T) {
+	for _, test := range agentTests {
+		test.doTest(t)
+	}
+}
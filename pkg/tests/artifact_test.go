@@ -0,0 +1,214 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbena/gotask/pkg/agent"
+	"github.com/nbena/gotask/pkg/client"
+	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+// sha256 of "abc"
+const abcSum = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+
+type artifactTestCase struct {
+	serverConfig *server.Config
+	clientConfig *client.Config
+	agentConfig  *agent.Config
+	tasks        []task.Task
+}
+
+// checkArtifacts checks the artifacts of a run of
+// the tasks, as returned and as downloaded.
+func checkArtifacts(taskClient *client.TaskClient, name string, t *testing.T) string {
+	resp, err := taskClient.Execute(name)
+	if err != nil {
+		t.Fatalf("Execute error: %s\n", err.Error())
+	}
+	if resp.Run == nil || resp.RunID == "" {
+		t.Fatalf("No run for %s: %+v\n", name, resp)
+	}
+	artifacts := resp.Run.Artifacts
+	if len(artifacts) != 2 || artifacts[0].Name != "out/abc.bin" ||
+		artifacts[0].Size != 3 || artifacts[0].SHA256 != abcSum ||
+		artifacts[1].Name != "out/dir.txt" {
+		t.Errorf("Wrong artifacts of %s: %+v, error %q\n", name, artifacts, resp.Error)
+	}
+
+	listed, err := taskClient.Artifacts(resp.RunID)
+	if err != nil || !reflect.DeepEqual(listed, artifacts) {
+		t.Errorf("Wrong list of %s: %+v, %v\n", name, listed, err)
+	}
+
+	var buffer bytes.Buffer
+	if err = taskClient.DownloadArtifact(resp.RunID, "out/abc.bin", &buffer); err != nil ||
+		buffer.String() != "abc" {
+		t.Errorf("Wrong artifact of %s: %q, %v\n", name, buffer.String(), err)
+	}
+	if err = taskClient.DownloadArtifact(resp.RunID, "skipped", ioutil.Discard); err == nil {
+		t.Errorf("Not an artifact downloaded from %s\n", name)
+	}
+
+	buffer.Reset()
+	if err = taskClient.DownloadArtifacts(resp.RunID, &buffer); err != nil {
+		t.Fatalf("Bundle error of %s: %s\n", name, err.Error())
+	}
+	compressed, err := gzip.NewReader(&buffer)
+	if err != nil {
+		t.Fatalf("Wrong bundle of %s: %s\n", name, err.Error())
+	}
+	archive := tar.NewReader(compressed)
+	files := make(map[string]string)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Wrong bundle of %s: %s\n", name, err.Error())
+		}
+		data, _ := ioutil.ReadAll(archive)
+		files[header.Name] = string(data)
+	}
+	if len(files) != 2 || files["out/abc.bin"] != "abc" ||
+		files["out/dir.txt"] != resp.Run.RunDir+"\n" {
+		t.Errorf("Wrong bundle of %s: %v\n", name, files)
+	}
+	return resp.RunID
+}
+
+func (s *artifactTestCase) doTest(t *testing.T) {
+	defer os.RemoveAll(s.serverConfig.ArtifactDir)
+
+	defer runServer(s.serverConfig, s.tasks, t)()
+
+	worker, err := agent.New(s.agentConfig)
+	if err != nil {
+		t.Fatalf("Fail to start agent: %s\n", err.Error())
+	}
+	defer os.RemoveAll(s.agentConfig.WorkDir)
+	go func() {
+		if err := worker.Run(); err != nil {
+			t.Errorf("Agent error: %s\n", err.Error())
+		}
+	}()
+	defer worker.Stop()
+
+	taskClient := client.NewTaskClient(s.clientConfig)
+	first := checkArtifacts(taskClient, "local", t)
+	checkArtifacts(taskClient, "remote", t)
+
+	// only the last two runs are kept
+	if _, err = taskClient.Artifacts(first); err != nil {
+		t.Errorf("Artifacts of %s removed: %s\n", first, err.Error())
+	}
+	checkArtifacts(taskClient, "local", t)
+	if _, err = taskClient.Artifacts(first); err == nil {
+		t.Errorf("Artifacts of %s kept\n", first)
+	}
+
+	// missing artifacts fail the run, it's tried again
+	for _, name := range []string{"large", "large-local"} {
+		resp, err := taskClient.Execute(name)
+		if err != nil {
+			t.Fatalf("Execute error: %s\n", err.Error())
+		}
+		if len(resp.Attempts) != 2 || !strings.Contains(resp.Error, "artifacts") {
+			t.Errorf("Run of %s not failed: %d attempts, error %q\n",
+				name, len(resp.Attempts), resp.Error)
+		}
+	}
+}
+
+var artifactTests = []artifactTestCase{
+	{
+		serverConfig: &server.Config{
+			ListenAddr:       "127.0.0.1",
+			ListenPort:       7892,
+			TaskFile:         "artifact_tasks.json",
+			InternalChanSize: 5,
+			AgentToken:       "agent-token",
+			ArtifactDir:      "artifact_store",
+			MaxArtifactRuns:  2,
+			MaxArtifactSize:  1024,
+		},
+		clientConfig: &client.Config{
+			ServerAddr:   "127.0.0.1",
+			ServerPort:   7892,
+			PollInterval: 50 * time.Millisecond,
+		},
+		agentConfig: &agent.Config{
+			ServerAddr:     "127.0.0.1",
+			ServerPort:     7892,
+			Token:          "agent-token",
+			Name:           "builder",
+			Labels:         map[string]string{"role": "build"},
+			WorkDir:        "artifact_work",
+			StreamInterval: task.Duration(50 * time.Millisecond),
+		},
+		tasks: []task.Task{
+			{
+				Name: "local",
+				Command: []string{"mkdir out && printf abc > out/abc.bin && " +
+					"echo $RUN_DIR > out/dir.txt && touch skipped"},
+				Shell:     "bash",
+				DirPolicy: &task.DirPolicy{Temp: true},
+				Artifacts: []string{"out"},
+			}, {
+				Name: "remote",
+				Command: []string{"mkdir out && printf abc > out/abc.bin && " +
+					"echo $RUN_DIR > out/dir.txt && touch skipped"},
+				Shell:     "bash",
+				Long:      true,
+				DirPolicy: &task.DirPolicy{Temp: true},
+				Artifacts: []string{"out"},
+				Labels:    map[string]string{"role": "build"},
+			}, {
+				Name:      "large",
+				Command:   []string{"head -c 2048 /dev/zero > large.bin"},
+				Shell:     "bash",
+				Long:      true,
+				DirPolicy: &task.DirPolicy{Temp: true},
+				Artifacts: []string{"large.bin"},
+				Labels:    map[string]string{"role": "build"},
+				Retry:     &task.RetryPolicy{MaxAttempts: 2},
+			}, {
+				Name:      "large-local",
+				Command:   []string{"head -c 2048 /dev/zero > large.bin"},
+				Shell:     "bash",
+				DirPolicy: &task.DirPolicy{Temp: true},
+				Artifacts: []string{"large.bin"},
+				Retry:     &task.RetryPolicy{MaxAttempts: 2},
+			},
+		},
+	},
+}
+
+func TestArtifacts(t *testing.T) {
+	for _, test := range artifactTests {
+		test.doTest(t)
+	}
+}
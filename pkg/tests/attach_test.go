@@ -0,0 +1,107 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nbena/gotask/pkg/client"
+	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+type attachTestCase struct {
+	queueTestCase
+	clientConfig *client.Config
+	input        string
+	expected     []string
+}
+
+func (s *attachTestCase) runTest(t *testing.T) {
+	if err := s.startServer(); err != nil {
+		t.Fatalf("Fail to start server: %s\n", err.Error())
+	}
+	defer end(s.config, t)
+	defer func() {
+		s.server.ServerCloseChan <- syscall.SIGINT
+	}()
+
+	taskClient := client.NewTaskClient(s.clientConfig)
+	if err := taskClient.AttachIO("unknown", strings.NewReader(""), &bytes.Buffer{}, 0, 0); err == nil {
+		t.Errorf("Attached to an unknown task\n")
+	}
+
+	id := s.submit(s.tasks[0].Name, server.StatusExecute, t)
+
+	// the process may not be started yet
+	var out bytes.Buffer
+	var err error
+	for i := 0; i < 20; i++ {
+		if err = taskClient.AttachIO(id, strings.NewReader(s.input), &out, 30, 100); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Attach error: %s\n", err.Error())
+	}
+	for _, expected := range s.expected {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Missing %q in terminal output: %q\n", expected, out.String())
+		}
+	}
+
+	s.poll(id, http.StatusOK, t)
+}
+
+var attachTests = []attachTestCase{
+	{
+		queueTestCase: queueTestCase{
+			serverTestCase: serverTestCase{
+				tasks: []task.Task{
+					{
+						Name:    "interactive",
+						Command: []string{"read line; echo got:$line; stty size"},
+						Shell:   "bash",
+						Long:    true,
+						Tty:     true,
+					},
+				},
+				config: &server.Config{
+					ListenAddr:       "127.0.0.1",
+					ListenPort:       7885,
+					TaskFile:         "attach_tasks.json",
+					InternalChanSize: 5,
+				},
+			},
+		},
+		clientConfig: &client.Config{
+			ServerAddr: "127.0.0.1",
+			ServerPort: 7885,
+		},
+		input:    "hello\n",
+		expected: []string{"got:hello", "30 100"},
+	},
+}
+
+func TestAttach(t *testing.T) {
+	for _, testCase := range attachTests {
+		testCase.runTest(t)
+	}
+}
@@ -16,6 +16,7 @@ package tests
 import (
 	"os"
 	"reflect"
+	"syscall"
 	"testing"
 
 	"github.com/nbena/gotask/pkg/server"
@@ -86,6 +87,22 @@ func end(config *server.Config, t *testing.T) {
 	}
 }
 
+// runServer starts a server with tasks, the returned
+// func stops it and removes its task file.
+func runServer(config *server.Config, tasks []task.Task, t *testing.T) func() {
+	taskServer, err := basicServerRun(config, tasks)
+	if err != nil {
+		t.Fatalf("Fail to start server: %s\n", err.Error())
+	}
+	go func() {
+		taskServer.Run()
+	}()
+	return func() {
+		taskServer.ServerCloseChan <- syscall.SIGINT
+		end(config, t)
+	}
+}
+
 func tasksCheck(expected, got []task.Task, t *testing.T) {
 	count := 0
 	for _, task := range expected {
@@ -0,0 +1,92 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nbena/gotask/pkg/client"
+	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+type dirTestCase struct {
+	serverConfig *server.Config
+	clientConfig *client.Config
+	tasks        []task.Task
+	// by task, the temporary directory is kept
+	kept []bool
+}
+
+func (s *dirTestCase) doTest(t *testing.T) {
+	defer runServer(s.serverConfig, s.tasks, t)()
+
+	taskClient := client.NewTaskClient(s.clientConfig)
+	for i, toRun := range s.tasks {
+		resp, err := taskClient.Execute(toRun.Name)
+		if err != nil {
+			t.Fatalf("Execute error: %s\n", err.Error())
+		}
+		if resp.Run == nil || resp.Run.RunDir == "" {
+			t.Fatalf("No directory for %s: %+v\n", toRun.Name, resp)
+		}
+		if resp.Output != resp.Run.RunDir+"\n" {
+			t.Errorf("Wrong output of %s: %q\n", toRun.Name, resp.Output)
+		}
+		if _, err = os.Stat(resp.Run.RunDir); (err == nil) != s.kept[i] {
+			t.Errorf("Directory of %s kept: %v\n", toRun.Name, err == nil)
+		}
+		os.RemoveAll(resp.Run.RunDir)
+	}
+}
+
+var dirTests = []dirTestCase{
+	{
+		serverConfig: &server.Config{
+			ListenAddr:       "127.0.0.1",
+			ListenPort:       7891,
+			TaskFile:         "dir_tasks.json",
+			InternalChanSize: 5,
+		},
+		clientConfig: &client.Config{
+			ServerAddr:   "127.0.0.1",
+			ServerPort:   7891,
+			PollInterval: 50 * time.Millisecond,
+		},
+		tasks: []task.Task{
+			{
+				Name:       "succeeded",
+				Command:    []string{"pwd"},
+				ShowOutput: true,
+				DirPolicy:  &task.DirPolicy{Temp: true, Cleanup: task.CleanupOnSuccess},
+			}, {
+				Name:       "failed",
+				Command:    []string{"pwd; false"},
+				Shell:      "bash",
+				ShowOutput: true,
+				Long:       true,
+				DirPolicy:  &task.DirPolicy{Temp: true, Cleanup: task.CleanupOnSuccess},
+			},
+		},
+		kept: []bool{false, true},
+	},
+}
+
+func TestDirPolicy(t *testing.T) {
+	for _, test := range dirTests {
+		test.doTest(t)
+	}
+}
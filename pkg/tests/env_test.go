@@ -0,0 +1,105 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nbena/gotask/pkg/client"
+	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+type envTestCase struct {
+	serverConfig *server.Config
+	clientConfig *client.Config
+	tasks        []task.Task
+	// by task
+	outputs []string
+	envs    [][]string
+}
+
+func (s *envTestCase) doTest(t *testing.T) {
+	defer runServer(s.serverConfig, s.tasks, t)()
+
+	taskClient := client.NewTaskClient(s.clientConfig)
+	for i, toRun := range s.tasks {
+		resp, err := taskClient.Execute(toRun.Name)
+		if err != nil {
+			t.Fatalf("Execute error: %s\n", err.Error())
+		}
+		if resp.Output != s.outputs[i] {
+			t.Errorf("Wrong output of %s: %q\n", toRun.Name, resp.Output)
+		}
+		if resp.Run == nil || !reflect.DeepEqual(resp.Run.Env, s.envs[i]) {
+			t.Errorf("Wrong env of %s: %+v\n", toRun.Name, resp.Run)
+		}
+	}
+}
+
+var envTests = []envTestCase{
+	{
+		serverConfig: &server.Config{
+			ListenAddr:       "127.0.0.1",
+			ListenPort:       7889,
+			TaskFile:         "env_tasks.json",
+			InternalChanSize: 5,
+			EnvPolicy: &task.EnvPolicy{
+				Mode:   task.EnvInheritAllowlist,
+				Allow:  []string{"GOTASK_SERVER_*"},
+				Remove: []string{"GOTASK_SERVER_KEY"},
+			},
+		},
+		clientConfig: &client.Config{
+			ServerAddr:   "127.0.0.1",
+			ServerPort:   7889,
+			PollInterval: 50 * time.Millisecond,
+		},
+		tasks: []task.Task{
+			{
+				Name:       "server_policy",
+				Command:    []string{"env"},
+				ShowOutput: true,
+			}, {
+				Name:       "clean",
+				Command:    []string{"env"},
+				Env:        []task.EnvVar{{Name: "A", Value: "a"}},
+				EnvPolicy:  &task.EnvPolicy{Mode: task.EnvClean},
+				ShowOutput: true,
+				Long:       true,
+			}, {
+				Name:    "hidden",
+				Command: []string{"env"},
+				Env:     []task.EnvVar{{Name: "A", Value: "a"}},
+			},
+		},
+		outputs: []string{"GOTASK_SERVER_NAME=test\n", "A=a\n", ""},
+		// only what the task gives, if its output is shown
+		envs: [][]string{nil, {"A=a"}, nil},
+	},
+}
+
+func TestEnvPolicy(t *testing.T) {
+	os.Setenv("GOTASK_SERVER_NAME", "test")
+	os.Setenv("GOTASK_SERVER_KEY", "s3cr3t")
+	defer os.Unsetenv("GOTASK_SERVER_NAME")
+	defer os.Unsetenv("GOTASK_SERVER_KEY")
+
+	for _, testCase := range envTests {
+		testCase.doTest(t)
+	}
+}
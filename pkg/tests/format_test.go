@@ -0,0 +1,109 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbena/gotask/pkg/client"
+	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+type formatTestCase struct {
+	serverConfig *server.Config
+	clientConfig *client.Config
+	tasks        []task.Task
+	// by task, the compacted result
+	results []string
+	// by task, part of the error
+	errors []string
+}
+
+func (s *formatTestCase) doTest(t *testing.T) {
+	defer runServer(s.serverConfig, s.tasks, t)()
+
+	taskClient := client.NewTaskClient(s.clientConfig)
+	for i, toRun := range s.tasks {
+		resp, err := taskClient.Execute(toRun.Name)
+		if err != nil {
+			t.Fatalf("Execute error: %s\n", err.Error())
+		}
+		if string(resp.Structured) != s.results[i] {
+			t.Errorf("Wrong result of %s: %q, error %q\n", toRun.Name, resp.Structured, resp.Error)
+		}
+		if !strings.Contains(resp.Error, s.errors[i]) {
+			t.Errorf("Wrong error of %s: %q\n", toRun.Name, resp.Error)
+		}
+	}
+}
+
+var formatTests = []formatTestCase{
+	{
+		serverConfig: &server.Config{
+			ListenAddr:       "127.0.0.1",
+			ListenPort:       7893,
+			TaskFile:         "format_tasks.json",
+			InternalChanSize: 5,
+		},
+		clientConfig: &client.Config{
+			ServerAddr:   "127.0.0.1",
+			ServerPort:   7893,
+			PollInterval: 50 * time.Millisecond,
+		},
+		tasks: []task.Task{
+			{
+				Name:         "short",
+				Command:      []string{`echo '{"version": "1.2"}'`},
+				Shell:        "bash",
+				OutputFormat: task.OutputJSON,
+				ShowOutput:   true,
+			}, {
+				Name:         "long",
+				Command:      []string{`echo '{"step": 1}'; echo '{"step": 2}'`},
+				Shell:        "bash",
+				Long:         true,
+				OutputFormat: task.OutputJSONLines,
+				ShowOutput:   true,
+			}, {
+				Name:         "file",
+				Command:      []string{`echo '{"files": 3}' > $GOTASK_RESULT`},
+				Shell:        "bash",
+				Long:         true,
+				OutputFormat: task.OutputResultFile,
+				ShowOutput:   true,
+			}, {
+				Name:         "invalid",
+				Command:      []string{"echo", "done"},
+				OutputFormat: task.OutputJSON,
+			}, {
+				// the result is hidden with the output
+				Name:         "hidden",
+				Command:      []string{`echo '{"version": "1.2"}'`},
+				Shell:        "bash",
+				OutputFormat: task.OutputJSON,
+			},
+		},
+		results: []string{`{"version":"1.2"}`, `[{"step":1},{"step":2}]`, `{"files":3}`, "", ""},
+		errors:  []string{"", "", "", "Invalid json output", ""},
+	},
+}
+
+func TestOutputFormat(t *testing.T) {
+	for _, test := range formatTests {
+		test.doTest(t)
+	}
+}
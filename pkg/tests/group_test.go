@@ -0,0 +1,141 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbena/gotask/pkg/client"
+	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+type groupTestCase struct {
+	serverConfig *server.Config
+	clientConfig *client.Config
+	tasks        []task.Task
+	// the child writes its pid here
+	pidFile string
+}
+
+// processRunning tells if pid is alive, zombies are not.
+func processRunning(pid int) bool {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+// cancelRunning cancels the first job running on the
+// server, once its child has written pidFile.
+func cancelRunning(taskClient *client.TaskClient, pidFile string, t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if data, _ := ioutil.ReadFile(pidFile); !strings.HasSuffix(string(data), "\n") {
+			time.Sleep(20 * time.Millisecond)
+			continue
+		}
+		queue, err := taskClient.Queue()
+		if err != nil {
+			t.Errorf("Queue error: %s\n", err.Error())
+			return
+		}
+		if len(queue.Running) > 0 {
+			if err = taskClient.Cancel(queue.Running[0].ID); err != nil {
+				t.Errorf("Cancel error: %s\n", err.Error())
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("Nothing running\n")
+}
+
+func (s *groupTestCase) doTest(t *testing.T) {
+	defer os.Remove(s.pidFile)
+
+	defer runServer(s.serverConfig, s.tasks, t)()
+
+	taskClient := client.NewTaskClient(s.clientConfig)
+	for _, toRun := range s.tasks {
+		os.Remove(s.pidFile)
+
+		go cancelRunning(taskClient, s.pidFile, t)
+		resp, err := taskClient.Execute(toRun.Name)
+		if err != nil {
+			t.Fatalf("Execute error: %s\n", err.Error())
+		}
+		if resp.Run == nil || resp.Run.KillReason != task.KillCancel {
+			t.Errorf("Task %s not cancelled: %+v\n", toRun.Name, resp)
+		}
+
+		data, err := ioutil.ReadFile(s.pidFile)
+		if err != nil {
+			t.Fatalf("Fail to read pid: %s\n", err.Error())
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			t.Fatalf("Wrong pid: %q\n", data)
+		}
+		for i := 0; i < 20 && processRunning(pid); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if processRunning(pid) {
+			t.Errorf("Child %d of %s still running\n", pid, toRun.Name)
+		}
+	}
+}
+
+var groupTests = []groupTestCase{
+	{
+		serverConfig: &server.Config{
+			ListenAddr:       "127.0.0.1",
+			ListenPort:       7886,
+			TaskFile:         "group_tasks.json",
+			InternalChanSize: 5,
+		},
+		clientConfig: &client.Config{
+			ServerAddr:   "127.0.0.1",
+			ServerPort:   7886,
+			PollInterval: 50 * time.Millisecond,
+		},
+		tasks: []task.Task{
+			{
+				Name:    "children",
+				Command: []string{"sleep 30 & echo $! > group_pid; wait"},
+				Shell:   "bash",
+			}, {
+				Name:    "children_long",
+				Command: []string{"sleep 30 & echo $! > group_pid; wait"},
+				Shell:   "bash",
+				Long:    true,
+			},
+		},
+		pidFile: "group_pid",
+	},
+}
+
+func TestProcessGroup(t *testing.T) {
+	for _, testCase := range groupTests {
+		testCase.doTest(t)
+	}
+}
@@ -0,0 +1,105 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbena/gotask/pkg/client"
+	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+type identityTestCase struct {
+	serverConfig *server.Config
+	clientConfig *client.Config
+	tasks        []task.Task
+	// by task, empty if refused
+	outputs []string
+}
+
+func (s *identityTestCase) doTest(t *testing.T) {
+	defer runServer(s.serverConfig, s.tasks, t)()
+
+	taskClient := client.NewTaskClient(s.clientConfig)
+	for i, toRun := range s.tasks {
+		resp, err := taskClient.Execute(toRun.Name)
+		if s.outputs[i] == "" {
+			if err == nil || !strings.Contains(err.Error(), "403") {
+				t.Errorf("Task %s not refused: %v\n", toRun.Name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Execute error: %s\n", err.Error())
+		}
+		if resp.Output != s.outputs[i] {
+			t.Errorf("Wrong output of %s: %q\n", toRun.Name, resp.Output)
+		}
+	}
+}
+
+var identityTests = []identityTestCase{
+	{
+		serverConfig: &server.Config{
+			ListenAddr:       "127.0.0.1",
+			ListenPort:       7888,
+			TaskFile:         "identity_tasks.json",
+			InternalChanSize: 5,
+			AllowedUsers:     []string{"nobody"},
+			AllowedGroups:    []string{"1"},
+		},
+		clientConfig: &client.Config{
+			ServerAddr:   "127.0.0.1",
+			ServerPort:   7888,
+			PollInterval: 50 * time.Millisecond,
+		},
+		tasks: []task.Task{
+			{
+				Name:       "as_nobody",
+				Command:    []string{"id", "-un"},
+				User:       "nobody",
+				ShowOutput: true,
+			}, {
+				Name:       "as_daemon",
+				Command:    []string{"id", "-gn"},
+				User:       "nobody",
+				Group:      "daemon",
+				ShowOutput: true,
+				Long:       true,
+			}, {
+				Name:    "as_root",
+				Command: []string{"id", "-un"},
+				User:    "root",
+			}, {
+				Name:    "as_root_group",
+				Command: []string{"id", "-un"},
+				Group:   "root",
+			},
+		},
+		outputs: []string{"nobody\n", "daemon\n", "", ""},
+	},
+}
+
+func TestIdentity(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Can't change identity")
+	}
+	for _, testCase := range identityTests {
+		testCase.doTest(t)
+	}
+}
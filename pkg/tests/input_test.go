@@ -0,0 +1,99 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbena/gotask/pkg/client"
+	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+type inputTestCase struct {
+	serverConfig *server.Config
+	clientConfig *client.Config
+	tasks        []task.Task
+}
+
+func (s *inputTestCase) doTest(t *testing.T) {
+	defer runServer(s.serverConfig, s.tasks, t)()
+
+	taskClient := client.NewTaskClient(s.clientConfig)
+	binary := []byte{0, 1, 2, 127}
+	large := strings.Repeat("x", int(s.serverConfig.MaxInputSize)+1)
+
+	for _, toRun := range s.tasks {
+		resp, err := taskClient.ExecuteWithInput(toRun.Name, nil, binary)
+		if err != nil {
+			t.Fatalf("Execute error: %s\n", err.Error())
+		}
+		if resp.Output != string(binary) {
+			t.Errorf("Wrong output of %s: %q\n", toRun.Name, resp.Output)
+		}
+
+		resp, err = taskClient.ExecuteStream(toRun.Name, strings.NewReader("streamed"))
+		if err != nil {
+			t.Fatalf("ExecuteStream error: %s\n", err.Error())
+		}
+		if resp.Output != "streamed" {
+			t.Errorf("Wrong output of %s: %q\n", toRun.Name, resp.Output)
+		}
+
+		if _, err = taskClient.ExecuteWithInput(toRun.Name, nil, []byte(large)); err == nil {
+			t.Errorf("Input over the limit accepted\n")
+		}
+		if _, err = taskClient.ExecuteStream(toRun.Name, bytes.NewBufferString(large)); err == nil {
+			t.Errorf("Streamed input over the limit accepted\n")
+		}
+	}
+}
+
+var inputTests = []inputTestCase{
+	{
+		serverConfig: &server.Config{
+			ListenAddr:       "127.0.0.1",
+			ListenPort:       7884,
+			TaskFile:         "input_tasks.json",
+			InternalChanSize: 5,
+			MaxInputSize:     1024,
+		},
+		clientConfig: &client.Config{
+			ServerAddr:   "127.0.0.1",
+			ServerPort:   7884,
+			PollInterval: 50 * time.Millisecond,
+		},
+		tasks: []task.Task{
+			{
+				Name:       "cat",
+				Command:    []string{"cat"},
+				ShowOutput: true,
+			}, {
+				Name:       "cat_long",
+				Command:    []string{"cat"},
+				ShowOutput: true,
+				Long:       true,
+			},
+		},
+	},
+}
+
+func TestInput(t *testing.T) {
+	for _, testCase := range inputTests {
+		testCase.doTest(t)
+	}
+}
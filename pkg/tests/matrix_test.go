@@ -0,0 +1,176 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbena/gotask/pkg/client"
+	"github.com/nbena/gotask/pkg/req"
+	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+type matrixTestCase struct {
+	serverConfig *server.Config
+	clientConfig *client.Config
+	tasks        []task.Task
+}
+
+// checkMatrix checks the runs of a matrix ended with
+// the given results, empty if the run failed.
+func checkMatrix(resp *req.ShortRunningTaskResponse, results []string, t *testing.T) {
+	if len(resp.Matrix) != len(results) {
+		t.Fatalf("Wrong runs: %+v\n", resp.Matrix)
+	}
+	for i, child := range resp.Matrix {
+		if child.ID == "" || child.Status != req.PollStatusCompleted {
+			t.Errorf("Wrong run %d: %+v\n", i, child)
+		}
+		if string(child.Structured) != results[i] || child.Failed != (results[i] == "") {
+			t.Errorf("Wrong result of run %d: %q, failed %v, error %q\n",
+				i, child.Structured, child.Failed, child.Error)
+		}
+	}
+}
+
+func (s *matrixTestCase) doTest(t *testing.T) {
+	defer runServer(s.serverConfig, s.tasks, t)()
+
+	taskClient := client.NewTaskClient(s.clientConfig)
+
+	// the matrix of the task
+	resp, err := taskClient.Execute("build")
+	if err != nil {
+		t.Fatalf("Execute error: %s\n", err.Error())
+	}
+	if resp.Error != "" {
+		t.Errorf("Wrong error of build: %q\n", resp.Error)
+	}
+	checkMatrix(resp, []string{
+		`{"arch":"amd64","os":"linux"}`,
+		`{"arch":"amd64","os":"bsd"}`,
+		`{"arch":"arm64","os":"linux"}`,
+	}, t)
+	if resp.Matrix[2].Vars["ARCH"] != "arm64" || resp.Matrix[2].Vars["OS"] != "linux" {
+		t.Errorf("Wrong vars: %v\n", resp.Matrix[2].Vars)
+	}
+
+	// the one given to /exec, a failed run doesn't stop the others
+	resp, err = taskClient.ExecuteMatrix("build", nil, &task.Matrix{
+		Vars: map[string][]string{"ARCH": {"", "mips"}, "OS": {"plan9"}},
+	})
+	if err != nil {
+		t.Fatalf("Execute error: %s\n", err.Error())
+	}
+	if resp.Error != "1 of 2 runs failed" {
+		t.Errorf("Wrong error of build: %q\n", resp.Error)
+	}
+	checkMatrix(resp, []string{"", `{"arch":"mips","os":"plan9"}`}, t)
+
+	// the first one fails, the second one is killed
+	// and the others are never started
+	start := time.Now()
+	resp, err = taskClient.Execute("failing")
+	if err != nil {
+		t.Fatalf("Execute error: %s\n", err.Error())
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Runs of failing not stopped\n")
+	}
+	if resp.Error != "4 of 4 runs failed" {
+		t.Errorf("Wrong error of failing: %q\n", resp.Error)
+	}
+	checkMatrix(resp, []string{"", "", "", ""}, t)
+	if run := resp.Matrix[0].Run; run == nil || run.ExitCode != 1 {
+		t.Errorf("Wrong first run: %+v\n", resp.Matrix[0])
+	}
+	for _, child := range resp.Matrix[2:] {
+		if child.Error != "Cancelled by fail-fast" {
+			t.Errorf("Wrong error of %s: %q\n", child.ID, child.Error)
+		}
+	}
+
+	// an invalid combination, no run is made
+	if _, err = taskClient.Execute("invalid"); err == nil {
+		t.Errorf("Invalid matrix run\n")
+	}
+	if queue, err := taskClient.Queue(); err != nil || len(queue.Waiting)+len(queue.Running) > 0 {
+		t.Errorf("Runs of invalid made: %+v, %v\n", queue, err)
+	}
+
+	// an input can't be given to every run
+	_, err = taskClient.ExecuteStream("failing", strings.NewReader("input"))
+	if err == nil {
+		t.Errorf("Streamed input accepted\n")
+	}
+}
+
+var matrixTests = []matrixTestCase{
+	{
+		serverConfig: &server.Config{
+			ListenAddr:       "127.0.0.1",
+			ListenPort:       7894,
+			TaskFile:         "matrix_tasks.json",
+			InternalChanSize: 5,
+			MaxConcurrent:    2,
+		},
+		clientConfig: &client.Config{
+			ServerAddr:   "127.0.0.1",
+			ServerPort:   7894,
+			PollInterval: 50 * time.Millisecond,
+		},
+		tasks: []task.Task{
+			{
+				Name: "build",
+				Command: []string{`[ -n "${ARCH}" ] && ` +
+					`echo '{"arch": "${ARCH}", "os": "${OS}"}'`},
+				Shell:        "bash",
+				OutputFormat: task.OutputJSON,
+				ShowOutput:   true,
+				Matrix: &task.Matrix{
+					Vars: map[string][]string{
+						"OS":   {"linux", "bsd"},
+						"ARCH": {"amd64", "arm64"},
+					},
+					Exclude: []map[string]string{{"OS": "bsd", "ARCH": "arm64"}},
+				},
+			}, {
+				Name:    "failing",
+				Command: []string{"[ ${N} != 1 ] || exit 1; sleep 10"},
+				Shell:   "bash",
+				Matrix: &task.Matrix{
+					Vars:     map[string][]string{"N": {"1", "2", "3", "4"}},
+					FailFast: true,
+				},
+			}, {
+				Name:     "invalid",
+				Command:  []string{`{{ if eq .Vars.N "2" }}{{ .Missing }}{{ end }}sleep 10`},
+				Shell:    "bash",
+				Template: true,
+				Matrix: &task.Matrix{
+					Vars: map[string][]string{"N": {"1", "2"}},
+				},
+			},
+		},
+	},
+}
+
+func TestMatrix(t *testing.T) {
+	for _, test := range matrixTests {
+		test.doTest(t)
+	}
+}
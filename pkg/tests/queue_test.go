@@ -0,0 +1,258 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"syscall"
+	"testing"
+
+	"github.com/nbena/gotask/pkg/req"
+	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+type queueTestCase struct {
+	serverTestCase
+}
+
+// submit runs a long task, returning its ID.
+func (s *queueTestCase) submit(name string, expectedStatus int, t *testing.T) string {
+	return s.submitAs(name, "", nil, expectedStatus, t)
+}
+
+// submitAs runs a long task as the caller with the
+// given token, returning its ID.
+func (s *queueTestCase) submitAs(name, token string, priority *int,
+	expectedStatus int, t *testing.T) string {
+
+	dataEnc, err := json.Marshal(req.ExecuteMessageRequest{
+		TaskName: name,
+		Priority: priority,
+	})
+	if err != nil {
+		t.Fatalf("Fail to marshal data: %s\n", err.Error())
+	}
+
+	uri := fmt.Sprintf("http://%s:%d%s", s.config.ListenAddr, s.config.ListenPort, server.APIExecute)
+	request, err := http.NewRequest(server.MethodExecute, uri, bytes.NewReader(dataEnc))
+	if err != nil {
+		t.Fatalf("Error in preparing request: %s\n", err.Error())
+	}
+	if token != "" {
+		request.Header.Set(server.AuthHeader, server.AuthPrefix+token)
+	}
+
+	resp, err := s.client.Do(request)
+	if err != nil {
+		t.Fatalf("Error in %s %s: %s\n", server.MethodExecute, uri, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Errorf("Status error:\ngot: %d\nexpected: %d\n", resp.StatusCode, expectedStatus)
+		return ""
+	}
+
+	var receiver req.LongRunningTaskResponse
+	if expectedStatus == server.StatusExecute {
+		if err = json.NewDecoder(resp.Body).Decode(&receiver); err != nil {
+			t.Errorf("Fail to unmarshal data: %s\n", err.Error())
+		}
+	}
+	return receiver.ID
+}
+
+func (s *queueTestCase) status(id string, t *testing.T) req.PollStatusInProgressResponse {
+	resp := s.request(server.MethodPoll, server.APIPoll+"?id="+id, server.StatusPoll, nil, t)
+	if resp == nil {
+		t.Fatalf("Impossible to do the request\n")
+	}
+	defer resp.Body.Close()
+
+	var receiver req.PollStatusInProgressResponse
+	if err := json.NewDecoder(resp.Body).Decode(&receiver); err != nil {
+		t.Errorf("Fail to unmarshal data: %s\n", err.Error())
+	}
+	return receiver
+}
+
+func (s *queueTestCase) queue(t *testing.T) req.QueueResponse {
+	resp := s.request(server.MethodQueue, server.APIQueue, server.StatusQueue, nil, t)
+	if resp == nil {
+		t.Fatalf("Impossible to do the request\n")
+	}
+	defer resp.Body.Close()
+
+	var receiver req.QueueResponse
+	if err := json.NewDecoder(resp.Body).Decode(&receiver); err != nil {
+		t.Errorf("Fail to unmarshal data: %s\n", err.Error())
+	}
+	return receiver
+}
+
+func (s *queueTestCase) runTest(t *testing.T) {
+	if err := s.startServer(); err != nil {
+		t.Fatalf("Fail to start server: %s\n", err.Error())
+	}
+	defer end(s.config, t)
+	defer func() {
+		s.server.ServerCloseChan <- syscall.SIGINT
+	}()
+
+	name := s.tasks[0].Name
+	first := s.submit(name, server.StatusExecute, t)
+	second := s.submit(name, server.StatusExecute, t)
+	third := s.submit(name, server.StatusExecute, t)
+	// the queue is full
+	s.submit(name, http.StatusTooManyRequests, t)
+
+	if status := s.status(second, t); status.Status != req.PollStatusQueued || status.Position != 1 {
+		t.Errorf("Task not queued: %+v\n", status)
+	}
+
+	queue := s.queue(t)
+	if len(queue.Running) != 1 || queue.Running[0].ID != first ||
+		len(queue.Waiting) != 2 || queue.Waiting[0].ID != second || queue.Waiting[1].ID != third {
+		t.Errorf("Wrong queue: %+v\n", queue)
+	}
+
+	// a queued task can be cancelled
+	s.request(server.MethodCancel, server.APICancel+"?id="+third, server.StatusCancel, nil, t)
+
+	s.poll(first, http.StatusOK, t)
+	s.poll(second, http.StatusOK, t)
+	s.poll(third, http.StatusOK, t)
+
+	queue = s.queue(t)
+	if len(queue.Running) != 0 || len(queue.Waiting) != 0 {
+		t.Errorf("Queue not empty: %+v\n", queue)
+	}
+}
+
+var queueTests = []queueTestCase{
+	{
+		serverTestCase: serverTestCase{
+			tasks: []task.Task{
+				{
+					Name:    "slow",
+					Command: []string{"sleep", "0.3"},
+					Long:    true,
+				},
+			},
+			config: &server.Config{
+				ListenAddr:       "127.0.0.1",
+				ListenPort:       7881,
+				TaskFile:         "queue_tasks.json",
+				InternalChanSize: 5,
+				MaxConcurrent:    1,
+				MaxQueued:        2,
+			},
+		},
+	},
+}
+
+func TestQueue(t *testing.T) {
+	for _, testCase := range queueTests {
+		testCase.runTest(t)
+	}
+}
+
+type priorityTestCase struct {
+	queueTestCase
+}
+
+func (s *priorityTestCase) runTest(t *testing.T) {
+	if err := s.startServer(); err != nil {
+		t.Fatalf("Fail to start server: %s\n", err.Error())
+	}
+	defer end(s.config, t)
+	defer func() {
+		s.server.ServerCloseChan <- syscall.SIGINT
+	}()
+
+	name := s.tasks[0].Name
+	s.submitAs(name, "unknown", nil, http.StatusForbidden, t)
+
+	// alice floods the queue, bob and carol come later
+	first := s.submitAs(name, s.config.Callers["alice"], nil, server.StatusExecute, t)
+	var alice []string
+	for i := 0; i < 3; i++ {
+		alice = append(alice, s.submitAs(name, s.config.Callers["alice"], nil, server.StatusExecute, t))
+	}
+	bob := s.submitAs(name, s.config.Callers["bob"], nil, server.StatusExecute, t)
+	urgent := 5
+	carol := s.submitAs(name, s.config.Callers["carol"], &urgent, server.StatusExecute, t)
+
+	expected := append([]string{carol, bob}, alice...)
+	queue := s.queue(t)
+	if len(queue.Waiting) != len(expected) {
+		t.Fatalf("Wrong queue: %+v\n", queue)
+	}
+	for i, info := range queue.Waiting {
+		if info.ID != expected[i] {
+			t.Errorf("Wrong order at %d:\ngot: %+v\nexpected: %s\n", i, info, expected[i])
+		}
+	}
+	if queue.Waiting[0].Priority != urgent || queue.Waiting[0].Caller != "carol" {
+		t.Errorf("Wrong job info: %+v\n", queue.Waiting[0])
+	}
+
+	if status := s.status(bob, t); status.Position != 2 {
+		t.Errorf("Wrong position: %+v\n", status)
+	}
+
+	for _, id := range expected {
+		s.request(server.MethodCancel, server.APICancel+"?id="+id, server.StatusCancel, nil, t)
+	}
+	s.poll(first, http.StatusOK, t)
+}
+
+var priorityTests = []priorityTestCase{
+	{
+		queueTestCase: queueTestCase{
+			serverTestCase: serverTestCase{
+				tasks: []task.Task{
+					{
+						Name:    "slow",
+						Command: []string{"sleep", "0.3"},
+						Long:    true,
+					},
+				},
+				config: &server.Config{
+					ListenAddr:       "127.0.0.1",
+					ListenPort:       7882,
+					TaskFile:         "priority_tasks.json",
+					InternalChanSize: 5,
+					MaxConcurrent:    1,
+					PriorityAging:    -1,
+					Callers: map[string]string{
+						"alice": "alice-token",
+						"bob":   "bob-token",
+						"carol": "carol-token",
+					},
+				},
+			},
+		},
+	},
+}
+
+func TestPriority(t *testing.T) {
+	for _, testCase := range priorityTests {
+		testCase.runTest(t)
+	}
+}
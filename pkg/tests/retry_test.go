@@ -0,0 +1,103 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nbena/gotask/pkg/client"
+	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+type retryTestCase struct {
+	serverConfig *server.Config
+	clientConfig *client.Config
+	tasks        []task.Task
+	marker       string
+}
+
+func (s *retryTestCase) doTest(t *testing.T) {
+	defer os.Remove(s.marker)
+
+	defer runServer(s.serverConfig, s.tasks, t)()
+
+	taskClient := client.NewTaskClient(s.clientConfig)
+	for _, toRun := range s.tasks {
+		os.Remove(s.marker)
+
+		resp, err := taskClient.Execute(toRun.Name)
+		if err != nil {
+			t.Fatalf("Execute error: %s\n", err.Error())
+		}
+
+		// the first attempt fails, the second succeeds
+		if resp.Error != "" || resp.Output != "ok" || resp.Run == nil || resp.Run.ExitCode != 0 {
+			t.Errorf("Task %s not retried: %+v\n", toRun.Name, resp)
+		}
+		if len(resp.Attempts) != 2 || resp.Attempts[0].Result.ExitCode != 75 ||
+			resp.Attempts[0].Output != "flaky" || resp.Attempts[1].Output != "ok" {
+			t.Errorf("Wrong attempts of %s: %+v\n", toRun.Name, resp.Attempts)
+		}
+	}
+}
+
+var retryTests = []retryTestCase{
+	{
+		serverConfig: &server.Config{
+			ListenAddr:       "127.0.0.1",
+			ListenPort:       7883,
+			TaskFile:         "retry_tasks.json",
+			InternalChanSize: 5,
+		},
+		clientConfig: &client.Config{
+			ServerAddr:   "127.0.0.1",
+			ServerPort:   7883,
+			PollInterval: 50 * time.Millisecond,
+		},
+		tasks: []task.Task{
+			{
+				Name:       "flaky",
+				Command:    []string{"test -f retry_marker && echo -n ok || { touch retry_marker; echo -n flaky; exit 75; }"},
+				ShowOutput: true,
+				Shell:      "bash",
+				Retry: &task.RetryPolicy{
+					MaxAttempts: 3,
+					Backoff:     task.BackoffExponential,
+					Delay:       task.Duration(50 * time.Millisecond),
+					ExitCodes:   []int{75},
+				},
+			}, {
+				Name:       "flaky_long",
+				Command:    []string{"test -f retry_marker && echo -n ok || { touch retry_marker; echo -n flaky; exit 75; }"},
+				ShowOutput: true,
+				Long:       true,
+				Shell:      "bash",
+				Retry: &task.RetryPolicy{
+					MaxAttempts: 2,
+					Delay:       task.Duration(50 * time.Millisecond),
+				},
+			},
+		},
+		marker: "retry_marker",
+	},
+}
+
+func TestRetry(t *testing.T) {
+	for _, testCase := range retryTests {
+		testCase.doTest(t)
+	}
+}
@@ -0,0 +1,136 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nbena/gotask/pkg/client"
+	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+type secretsTestCase struct {
+	serverConfig *server.Config
+	clientConfig *client.Config
+	tasks        []task.Task
+	secretName   string
+	secretValue  string
+}
+
+func (s *secretsTestCase) doTest(t *testing.T) {
+	defer os.Remove(s.serverConfig.SecretsFile)
+
+	defer runServer(s.serverConfig, s.tasks, t)()
+
+	// without token
+	anonConfig := *s.clientConfig
+	anonConfig.Token = ""
+	if err := client.NewTaskClient(&anonConfig).SetSecret(s.secretName, s.secretValue); err == nil {
+		t.Errorf("Secret set without admin token")
+	}
+
+	taskClient := client.NewTaskClient(s.clientConfig)
+	if err := taskClient.SetSecret(s.secretName, s.secretValue); err != nil {
+		t.Fatalf("SetSecret error: %s\n", err.Error())
+	}
+
+	secrets, err := taskClient.ListSecrets()
+	if err != nil {
+		t.Errorf("ListSecrets error: %s\n", err.Error())
+	} else if len(secrets) != 1 || secrets[0].Name != s.secretName {
+		t.Errorf("Wrong secrets list: %v\n", secrets)
+	}
+
+	// the value must not be on disk in clear
+	data, err := ioutil.ReadFile(s.serverConfig.SecretsFile)
+	if err != nil {
+		t.Errorf("Cannot read secrets file: %s\n", err.Error())
+	} else if strings.Contains(string(data), s.secretValue) {
+		t.Errorf("Secret stored in plaintext\n")
+	}
+
+	resp, err := taskClient.Execute(s.tasks[0].Name)
+	if err != nil {
+		t.Fatalf("Execute error: %s\n", err.Error())
+	}
+	if resp.Output != "token="+task.SecretMask {
+		t.Errorf("Secret not masked in output: %s\n", resp.Output)
+	}
+
+	// the file can't be written, nothing changes
+	tmp := s.serverConfig.SecretsFile + ".tmp"
+	if err = os.Mkdir(tmp, 0700); err != nil {
+		t.Fatalf("Cannot create %s: %s\n", tmp, err.Error())
+	}
+	if err = taskClient.SetSecret("unsaved", "value"); err == nil {
+		t.Errorf("Secret set without writing it\n")
+	}
+	if err = taskClient.DeleteSecret(s.secretName); err == nil {
+		t.Errorf("Secret deleted without writing it\n")
+	}
+	if secrets, err = taskClient.ListSecrets(); err != nil || len(secrets) != 1 ||
+		secrets[0].Name != s.secretName {
+		t.Errorf("Secrets changed by a failed write: %v, %v\n", secrets, err)
+	}
+	os.Remove(tmp)
+
+	if err = taskClient.DeleteSecret(s.secretName); err != nil {
+		t.Errorf("DeleteSecret error: %s\n", err.Error())
+	}
+
+	resp, err = taskClient.Execute(s.tasks[0].Name)
+	if err == nil && resp.Error == "" {
+		t.Errorf("Task run with a deleted secret\n")
+	}
+}
+
+var secretsTests = []secretsTestCase{
+	{
+		serverConfig: &server.Config{
+			ListenAddr:        "127.0.0.1",
+			ListenPort:        7880,
+			TaskFile:          "secrets_tasks.json",
+			InternalChanSize:  5,
+			AdminToken:        "admin",
+			SecretsFile:       "secrets.json",
+			SecretsPassphrase: "passphrase",
+		},
+		clientConfig: &client.Config{
+			ServerAddr: "127.0.0.1",
+			ServerPort: 7880,
+			Token:      "admin",
+		},
+		tasks: []task.Task{
+			{
+				Name:       "secret",
+				Command:    []string{"echo -n token=$TOKEN"},
+				Env:        []task.EnvVar{{Name: "TOKEN", Value: "${secret:api_token}"}},
+				ShowOutput: true,
+				Shell:      "bash",
+			},
+		},
+		secretName:  "api_token",
+		secretValue: "very-secret-value",
+	},
+}
+
+func TestSecrets(t *testing.T) {
+	for _, testCase := range secretsTests {
+		testCase.doTest(t)
+	}
+}
@@ -222,7 +222,8 @@ func (s *serverTestCase) execute(i int, t *testing.T) {
 
 		t.Logf("Long task ID: %s\n", receiver.ID)
 
-		// s.poll(receiver.ID, http.StatusOK, t)
+		// wait for it, the next tasks may need its result
+		s.poll(receiver.ID, http.StatusOK, t)
 	} else {
 
 		var receiver req.ShortRunningTaskResponse
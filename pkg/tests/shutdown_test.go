@@ -0,0 +1,141 @@
+// go-task, a simple client-server task runner
+// Copyright (C) 2018 nbena
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nbena/gotask/pkg/req"
+	"github.com/nbena/gotask/pkg/server"
+	"github.com/nbena/gotask/pkg/task"
+)
+
+type shutdownTestCase struct {
+	queueTestCase
+}
+
+// run starts the server, done is closed when Run returns.
+func (s *shutdownTestCase) run(t *testing.T) <-chan struct{} {
+	taskServer, err := basicServerRun(s.config, s.tasks)
+	if err != nil {
+		t.Fatalf("Fail to start server: %s\n", err.Error())
+	}
+	s.server = taskServer
+	s.client = &http.Client{}
+
+	done := make(chan struct{})
+	go func() {
+		s.server.Run()
+		close(done)
+	}()
+	return done
+}
+
+func (s *shutdownTestCase) completed(id string, t *testing.T) req.PollStatusCompletedResponse {
+	resp := s.request(server.MethodPoll, server.APIPoll+"?id="+id, server.StatusPoll, nil, t)
+	if resp == nil {
+		t.Fatalf("Impossible to do the request\n")
+	}
+	defer resp.Body.Close()
+
+	var receiver req.PollStatusCompletedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&receiver); err != nil {
+		t.Errorf("Fail to unmarshal data: %s\n", err.Error())
+	}
+	if receiver.Status != req.PollStatusCompleted {
+		t.Errorf("Task %s not completed: %+v\n", id, receiver)
+	}
+	return receiver
+}
+
+func (s *shutdownTestCase) runTest(t *testing.T) {
+	defer os.Remove(s.config.StateFile)
+	defer end(s.config, t)
+
+	done := s.run(t)
+	quick := s.submit("quick", server.StatusExecute, t)
+	stuck := s.submit("stuck", server.StatusExecute, t)
+	queued := s.submit("quick", server.StatusExecute, t)
+
+	s.server.ServerCloseChan <- syscall.SIGINT
+	time.Sleep(50 * time.Millisecond)
+
+	// draining, no more runs
+	s.submit("quick", http.StatusServiceUnavailable, t)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server not shut down\n")
+	}
+
+	// the final states are read back
+	done = s.run(t)
+	defer func() {
+		s.server.ServerCloseChan <- syscall.SIGINT
+		<-done
+	}()
+
+	if res := s.completed(quick, t); res.Output != "done" || res.Run == nil || res.Run.Killed {
+		t.Errorf("Task not drained: %+v\n", res)
+	}
+	if res := s.completed(stuck, t); res.Run == nil || res.Run.KillReason != task.KillShutdown {
+		t.Errorf("Task not killed: %+v\n", res)
+	}
+	if res := s.completed(queued, t); res.Error != "Cancelled by shutdown" || res.Run != nil {
+		t.Errorf("Task not dropped: %+v\n", res)
+	}
+}
+
+var shutdownTests = []shutdownTestCase{
+	{
+		queueTestCase: queueTestCase{
+			serverTestCase: serverTestCase{
+				tasks: []task.Task{
+					{
+						Name:       "quick",
+						Command:    []string{"sleep 0.2; echo -n done"},
+						Shell:      "bash",
+						ShowOutput: true,
+						Long:       true,
+					}, {
+						Name:    "stuck",
+						Command: []string{"sleep", "30"},
+						Long:    true,
+					},
+				},
+				config: &server.Config{
+					ListenAddr:       "127.0.0.1",
+					ListenPort:       7887,
+					TaskFile:         "shutdown_tasks.json",
+					InternalChanSize: 5,
+					MaxConcurrent:    2,
+					DrainTimeout:     task.Duration(500 * time.Millisecond),
+					StateFile:        "shutdown_state.json",
+				},
+			},
+		},
+	},
+}
+
+func TestShutdown(t *testing.T) {
+	for _, testCase := range shutdownTests {
+		testCase.runTest(t)
+	}
+}